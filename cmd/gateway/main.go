@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/FPT-OJT/gateway/internal/cache"
 	"github.com/FPT-OJT/gateway/internal/config"
+	"github.com/FPT-OJT/gateway/internal/jwks"
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
 	"github.com/FPT-OJT/gateway/internal/server"
 	"github.com/FPT-OJT/gateway/pkg/logger"
+	"github.com/rs/zerolog"
 )
 
 func main() {
@@ -24,6 +31,9 @@ func main() {
 		Str("port", cfg.Port).
 		Str("core_service_url", cfg.CoreServiceURL).
 		Str("redis_url", cfg.RedisURL).
+		Str("rate_limit_key", cfg.RateLimitKey.String()).
+		Str("rate_limit_failure_mode", string(cfg.RateLimitFailureMode)).
+		Int("trusted_proxies", len(cfg.TrustedProxies)).
 		Msg("configuration loaded")
 
 	rdb, err := cache.NewRedisClient(cfg.RedisURL)
@@ -34,21 +44,117 @@ func main() {
 
 	log.Info().Str("redis_url", cfg.RedisURL).Msg("redis connected")
 
-	pubKey, err := loadPublicKey(cfg.PublicKey)
+	store := cache.NewRedisStore(rdb)
+
+	// Shared by every router, and so by all policies and reloads, so that an
+	// outage is detected, and logged, once and local buckets are kept.
+	limiter := mw.NewFallbackLimiter(store, mw.FallbackConfig{
+		Mode:      cfg.RateLimitFailureMode,
+		Instances: cfg.RateLimitInstances,
+	}, log)
+
+	newRouter := func(cfg *config.Config) (http.Handler, error) {
+		keys, err := newKeyProvider(cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		stores := server.Stores{
+			RateLimit:   limiter,
+			Cache:       store,
+			Revocation:  store,
+			Quota:       store,
+			Concurrency: store,
+			DenyList:    store,
+		}
+		if cfg.APIKeysEnabled {
+			if stores.APIKeys, err = newAPIKeyStore(cfg, store, log); err != nil {
+				return nil, err
+			}
+		}
+		return server.NewRouter(cfg, stores, keys, log), nil
+	}
+
+	router, err := newRouter(cfg)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to parse public key")
+		log.Fatal().Err(err).Msg("failed to build router")
 	}
-	log.Info().Msg("public key loaded for JWT verification")
 
-	store := cache.NewRedisStore(rdb)
-	router := server.NewRouter(cfg, store, store, pubKey, log)
+	// The configuration last applied, whose files are watched for changes.
+	var current atomic.Pointer[config.Config]
+	current.Store(cfg)
 
-	srv := server.New(":"+cfg.Port, router, log)
+	// Settings that are bound at startup (listen port, Redis connection, rate
+	// limit failure mode) are not affected by a reload; everything that lives
+	// in the router is.
+	reloader := server.NewReloader(router, func() (http.Handler, error) {
+		next, err := config.Load()
+		if err != nil {
+			return nil, err
+		}
+		if next.Port != cfg.Port || next.RedisURL != cfg.RedisURL {
+			log.Warn().Msg("reload: PORT and REDIS_URL changes require a restart and are ignored")
+		}
+		if next.RateLimitFailureMode != cfg.RateLimitFailureMode || next.RateLimitInstances != cfg.RateLimitInstances {
+			log.Warn().Msg("reload: RATE_LIMIT_FAILURE_MODE and RATE_LIMIT_INSTANCES changes require a restart and are ignored")
+			next.RateLimitFailureMode, next.RateLimitInstances = cfg.RateLimitFailureMode, cfg.RateLimitInstances
+		}
+		if next.WatchInterval != cfg.WatchInterval {
+			log.Warn().Msg("reload: CONFIG_WATCH_INTERVAL changes require a restart and are ignored")
+		}
+		h, err := newRouter(next)
+		if err != nil {
+			return nil, err
+		}
+		current.Store(next)
+		return h, nil
+	}, log)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, func() []string { return current.Load().Sources() }, cfg.WatchInterval)
+
+	srv := server.New(":"+cfg.Port, reloader, log)
+	srv.OnReload(reloader.Reload)
 	if err := srv.Run(); err != nil {
 		log.Fatal().Err(err).Msg("server exited with error")
 	}
 }
 
+// newKeyProvider prefers JWKS discovery and falls back to the static PUBLIC_KEY.
+func newKeyProvider(cfg *config.Config, log zerolog.Logger) (mw.KeyProvider, error) {
+	if cfg.JWKSURL != "" {
+		log.Info().Str("jwks_url", cfg.JWKSURL).Msg("JWKS key discovery enabled for JWT verification")
+		return jwks.New(jwks.Config{
+			URL:                cfg.JWKSURL,
+			RefreshInterval:    cfg.JWKSRefreshInterval,
+			MinRefreshInterval: 10 * time.Second,
+			RetainRotated:      cfg.JWKSRefreshInterval,
+		}, log), nil
+	}
+
+	pubKey, err := loadPublicKey(cfg.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	log.Info().Msg("public key loaded for JWT verification")
+	return mw.StaticKey(pubKey), nil
+}
+
+// newAPIKeyStore serves API keys from API_KEYS_FILE when set, otherwise from
+// Redis.
+func newAPIKeyStore(cfg *config.Config, redisStore *cache.RedisStore, log zerolog.Logger) (mw.APIKeyStore, error) {
+	if cfg.APIKeysFile == "" {
+		log.Info().Msg("API key authentication enabled, keys stored in Redis")
+		return redisStore, nil
+	}
+	keys, err := cache.LoadAPIKeyFile(cfg.APIKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("file", cfg.APIKeysFile).Msg("API key authentication enabled, keys loaded from file")
+	return keys, nil
+}
+
 func loadPublicKey(key string) (*rsa.PublicKey, error) {
 	// Decode base64 string
 	decoded, err := base64.StdEncoding.DecodeString(key)
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"gopkg.in/yaml.v3"
+)
+
+// FileAPIKeyStore is a read-only APIKeyStore loaded from a YAML or JSON file:
+//
+//	keys:
+//	  - hash: <hex SHA-256 of the raw key>
+//	    owner: judge-worker-1
+//	    scopes: [submissions:write]
+//	    tier: internal
+type FileAPIKeyStore struct {
+	keys map[string]mw.APIKey
+}
+
+type apiKeyFile struct {
+	Keys []struct {
+		Hash      string `yaml:"hash"`
+		mw.APIKey `yaml:",inline"`
+	} `yaml:"keys"`
+}
+
+// LoadAPIKeyFile reads and validates an API key file.
+func LoadAPIKeyFile(path string) (*FileAPIKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cache: read api key file: %w", err)
+	}
+
+	var f apiKeyFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("cache: parse api key file %s: %w", path, err)
+	}
+
+	s := &FileAPIKeyStore{keys: make(map[string]mw.APIKey, len(f.Keys))}
+	for i, k := range f.Keys {
+		hash := strings.ToLower(strings.TrimSpace(k.Hash))
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("cache: api key file %s: key %d: hash must be a hex SHA-256 digest", path, i)
+		}
+		if k.Owner == "" {
+			return nil, fmt.Errorf("cache: api key file %s: key %d: owner is required", path, i)
+		}
+		if _, dup := s.keys[hash]; dup {
+			return nil, fmt.Errorf("cache: api key file %s: key %d: duplicate hash", path, i)
+		}
+		s.keys[hash] = k.APIKey
+	}
+	return s, nil
+}
+
+func (s *FileAPIKeyStore) LookupAPIKey(_ context.Context, hash string) (mw.APIKey, bool, error) {
+	k, ok := s.keys[hash]
+	return k, ok, nil
+}
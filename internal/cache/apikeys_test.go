@@ -0,0 +1,57 @@
+package cache_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FPT-OJT/gateway/internal/cache"
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api-keys.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadAPIKeyFile(t *testing.T) {
+	path := writeKeyFile(t, `
+keys:
+  - hash: `+mw.HashAPIKey("worker-key")+`
+    owner: judge-worker-1
+    scopes: [submissions:write]
+    tier: internal
+`)
+
+	store, err := cache.LoadAPIKeyFile(path)
+	require.NoError(t, err)
+
+	key, found, err := store.LookupAPIKey(context.Background(), mw.HashAPIKey("worker-key"))
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, mw.APIKey{Owner: "judge-worker-1", Scopes: []string{"submissions:write"}, Tier: "internal"}, key)
+
+	_, found, err = store.LookupAPIKey(context.Background(), mw.HashAPIKey("other"))
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestLoadAPIKeyFile_Invalid(t *testing.T) {
+	hash := mw.HashAPIKey("k")
+	for name, content := range map[string]string{
+		"raw key instead of hash": "keys: [{hash: my-secret, owner: a}]",
+		"missing owner":           "keys: [{hash: " + hash + "}]",
+		"duplicate hash":          "keys: [{hash: " + hash + ", owner: a}, {hash: " + hash + ", owner: b}]",
+		"not yaml":                "keys: [",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := cache.LoadAPIKeyFile(writeKeyFile(t, content))
+			assert.Error(t, err)
+		})
+	}
+}
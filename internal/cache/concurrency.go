@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// acquireScript takes a concurrency slot. The key is a sorted set of lease
+// ids scored by their expiry in Unix milliseconds on the server clock, so
+// the leases of a crashed instance lapse on their own.
+//
+//	KEYS[1] slot key
+//	ARGV[1] lease id, ARGV[2] limit, ARGV[3] lease TTL (ms)
+//
+// Returns 1 when the lease was taken or renewed, 0 when every slot is held.
+var acquireScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local ttl = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) or redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], now + ttl, ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	return 1
+end
+return 0
+`)
+
+// Acquire takes one of limit slots of key for the lease id, valid for ttl.
+// Acquiring a lease already held renews it.
+func (s *RedisStore) Acquire(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, error) {
+	v, err := acquireScript.Run(ctx, s.client, []string{key}, id, limit, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return v == 1, nil
+}
+
+// Release gives up the lease id on key.
+func (s *RedisStore) Release(ctx context.Context, key, id string) error {
+	return s.client.ZRem(ctx, key, id).Err()
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"context"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DenyListKey is the hash holding the dynamic IP denylist: each field is a
+// prefix in CIDR notation and its value the Unix time the entry lapses, or
+// 0 for a permanent entry.
+const DenyListKey = "ipdeny"
+
+// DenyList returns the denylist, removing lapsed and malformed entries.
+func (s *RedisStore) DenyList(ctx context.Context) (map[netip.Prefix]time.Time, error) {
+	fields, err := s.client.HGetAll(ctx, DenyListKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entries := make(map[netip.Prefix]time.Time, len(fields))
+	var stale []string
+	for field, value := range fields {
+		prefix, perr := netip.ParsePrefix(field)
+		unix, verr := strconv.ParseInt(value, 10, 64)
+		if perr != nil || verr != nil {
+			stale = append(stale, field)
+			continue
+		}
+		var until time.Time
+		if unix > 0 {
+			until = time.Unix(unix, 0)
+			if !now.Before(until) {
+				stale = append(stale, field)
+				continue
+			}
+		}
+		entries[prefix] = until
+	}
+
+	if len(stale) > 0 {
+		// Best effort; lapsed entries are skipped on every read anyway.
+		_ = s.client.HDel(ctx, DenyListKey, stale...).Err()
+	}
+	return entries, nil
+}
+
+func (s *RedisStore) Deny(ctx context.Context, prefix netip.Prefix, until time.Time) error {
+	var unix int64
+	if !until.IsZero() {
+		unix = until.Unix()
+	}
+	return s.client.HSet(ctx, DenyListKey, prefix.Masked().String(), unix).Err()
+}
+
+func (s *RedisStore) Undeny(ctx context.Context, prefix netip.Prefix) error {
+	return s.client.HDel(ctx, DenyListKey, prefix.Masked().String()).Err()
+}
+
+// strikeScript increments KEYS[1] and starts its window on the first strike,
+// in one step so that the counter can never be left without an expiry.
+var strikeScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 or redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// Strike increments key, which expires window after its first strike.
+func (s *RedisStore) Strike(ctx context.Context, key string, window time.Duration) (int64, error) {
+	return strikeScript.Run(ctx, s.client, []string{key}, window.Milliseconds()).Int64()
+}
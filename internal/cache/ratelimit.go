@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/redis/go-redis/v9"
+)
+
+// gcraScript is ratelimit.Evaluate run atomically inside Redis, using the
+// server clock so that gateway instances with skewed clocks share one view.
+// The key holds the TAT in Unix microseconds and expires once the bucket is
+// full again.
+//
+//	KEYS[1] bucket key
+//	ARGV[1] emission interval (µs), ARGV[2] tolerance (µs), ARGV[3] n
+//
+// Returns {allowed, remaining, retry_after_us, reset_after_us}.
+var gcraScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local new_tat = tat + interval * n
+local allow_at = new_tat - tolerance
+
+if allow_at > now then
+	return {0, math.floor(math.max(now - (tat - tolerance), 0) / interval), allow_at - now, tat - now}
+end
+
+redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((now - allow_at) / interval), 0, new_tat - now}
+`)
+
+func (s *RedisStore) AllowN(ctx context.Context, key string, limit ratelimit.Limit, n int) (ratelimit.Result, error) {
+	if err := limit.Validate(); err != nil {
+		return ratelimit.Result{}, err
+	}
+
+	v, err := gcraScript.Run(ctx, s.client, []string{key}, limit.EmissionInterval(), limit.Tolerance(), n).Int64Slice()
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+
+	return ratelimit.Result{
+		Allowed:    v[0] == 1,
+		Limit:      limit.Burst,
+		Remaining:  int(v[1]),
+		RetryAfter: time.Duration(v[2]) * time.Microsecond,
+		ResetAfter: time.Duration(v[3]) * time.Microsecond,
+	}, nil
+}
+
+// debitScript is ratelimit.Debit run atomically inside Redis.
+//
+//	KEYS[1] bucket key
+//	ARGV[1] emission interval (µs), ARGV[2] n
+var debitScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local new_tat = tat + tonumber(ARGV[1]) * tonumber(ARGV[2])
+redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', math.ceil((new_tat - now) / 1000))
+return 1
+`)
+
+func (s *RedisStore) DebitN(ctx context.Context, key string, limit ratelimit.Limit, n int) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+	return debitScript.Run(ctx, s.client, []string{key}, limit.EmissionInterval(), n).Err()
+}
+
+// quotaScript charges ARGV[1] to every counter in KEYS unless one of them
+// would exceed its limit, in which case nothing is charged. Counters expire
+// at their window's reset time.
+//
+//	KEYS    counter keys
+//	ARGV[1] n, then per key: limit, reset (Unix seconds)
+//
+// Returns {allowed, used_1, ..., used_k}.
+var quotaScript = redis.NewScript(`
+local n = tonumber(ARGV[1])
+local used = {}
+local allowed = 1
+for i, key in ipairs(KEYS) do
+	used[i] = tonumber(redis.call('GET', key) or '0')
+	if used[i] + n > tonumber(ARGV[2 * i]) then
+		allowed = 0
+	end
+end
+if allowed == 1 then
+	for i, key in ipairs(KEYS) do
+		used[i] = redis.call('INCRBY', key, n)
+		redis.call('EXPIREAT', key, ARGV[2 * i + 1])
+	end
+end
+table.insert(used, 1, allowed)
+return used
+`)
+
+func (s *RedisStore) ConsumeQuota(ctx context.Context, counters []ratelimit.QuotaCounter, n int64) ([]int64, bool, error) {
+	if len(counters) == 0 {
+		return nil, true, nil
+	}
+	keys := make([]string, len(counters))
+	args := make([]any, 0, 1+2*len(counters))
+	args = append(args, n)
+	for i, c := range counters {
+		keys[i] = c.Key
+		args = append(args, c.Limit, c.ResetAt.Unix())
+	}
+
+	v, err := quotaScript.Run(ctx, s.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, false, err
+	}
+	return v[1:], v[0] == 1, nil
+}
+
+func (s *RedisStore) QuotaUsage(ctx context.Context, keys []string) ([]int64, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	vals, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	used := make([]int64, len(vals))
+	for i, v := range vals {
+		if str, ok := v.(string); ok {
+			used[i], _ = strconv.ParseInt(str, 10, 64)
+		}
+	}
+	return used, nil
+}
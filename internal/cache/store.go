@@ -2,8 +2,11 @@ package cache
 
 import (
 	"context"
+	"encoding/json"
+	"strconv"
 	"time"
 
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -15,14 +18,6 @@ func NewRedisStore(client *redis.Client) *RedisStore {
 	return &RedisStore{client: client}
 }
 
-func (s *RedisStore) Incr(ctx context.Context, key string) (int64, error) {
-	return s.client.Incr(ctx, key).Result()
-}
-
-func (s *RedisStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
-	return s.client.Expire(ctx, key, ttl).Err()
-}
-
 func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
 	data, err := s.client.Get(ctx, key).Bytes()
 	if err == redis.Nil {
@@ -37,3 +32,57 @@ func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, bool, error)
 func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
 	return s.client.Set(ctx, key, value, ttl).Err()
 }
+
+const (
+	revokedTokenPrefix   = "revoked:jti:"
+	revokedSubjectPrefix = "revoked:sub:"
+)
+
+func (s *RedisStore) RevokeToken(ctx context.Context, jti string, ttl time.Duration) error {
+	return s.client.Set(ctx, revokedTokenPrefix+jti, 1, ttl).Err()
+}
+
+func (s *RedisStore) TokenRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := s.client.Exists(ctx, revokedTokenPrefix+jti).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RevokeSubject stores before as Unix seconds. A later call replaces the
+// marker, so the most recent revocation wins.
+func (s *RedisStore) RevokeSubject(ctx context.Context, sub string, before time.Time, ttl time.Duration) error {
+	return s.client.Set(ctx, revokedSubjectPrefix+sub, before.Unix(), ttl).Err()
+}
+
+func (s *RedisStore) SubjectRevokedBefore(ctx context.Context, sub string) (time.Time, bool, error) {
+	v, err := s.client.Get(ctx, revokedSubjectPrefix+sub).Result()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(sec, 0), true, nil
+}
+
+// APIKeyPrefix is the Redis key prefix of API key records. Each record is the
+// JSON encoded middleware.APIKey stored under APIKeyPrefix+HashAPIKey(key).
+const APIKeyPrefix = "apikey:"
+
+func (s *RedisStore) LookupAPIKey(ctx context.Context, hash string) (mw.APIKey, bool, error) {
+	data, found, err := s.Get(ctx, APIKeyPrefix+hash)
+	if err != nil || !found {
+		return mw.APIKey{}, false, err
+	}
+	var key mw.APIKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return mw.APIKey{}, false, err
+	}
+	return key, true, nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+)
+
+// RouteConcurrency bounds the requests of a route in flight at once, for
+// long-running upstream calls that a per-second rate limit cannot bound.
+type RouteConcurrency struct {
+	// PerKey bounds the requests in flight per client; zero disables it.
+	PerKey int `yaml:"per_key"`
+	// Key selects the client; it defaults to RATE_LIMIT_KEY.
+	Key string `yaml:"key"`
+	// Total bounds the requests in flight across all clients; zero
+	// disables it.
+	Total int `yaml:"total"`
+	// Queue is how many requests each instance holds waiting for a slot, for
+	// at most QueueTimeout. Zero rejects them at once.
+	Queue        int           `yaml:"queue"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// LeaseTTL is how long the slot of a crashed instance stays taken.
+	LeaseTTL time.Duration `yaml:"lease_ttl"`
+
+	// KeyStrategy is the parsed Key.
+	KeyStrategy ratelimit.Key `yaml:"-"`
+}
+
+// Enabled reports whether any concurrency limit is set.
+func (c RouteConcurrency) Enabled() bool {
+	return c.PerKey > 0 || c.Total > 0
+}
+
+// normalizeConcurrency validates the routes' concurrency limits and parses
+// their keys.
+func normalizeConcurrency(c *Config) error {
+	for i := range c.Routes {
+		rt := &c.Routes[i]
+		cc := &rt.Concurrency
+		if cc.PerKey < 0 || cc.Total < 0 || cc.Queue < 0 {
+			return fmt.Errorf("route %q: concurrency limits must not be negative", rt.Name)
+		}
+		if cc.QueueTimeout < 0 || cc.LeaseTTL < 0 {
+			return fmt.Errorf("route %q: concurrency timeouts must not be negative", rt.Name)
+		}
+		if cc.LeaseTTL > 0 && cc.LeaseTTL < time.Second {
+			return fmt.Errorf("route %q: concurrency lease_ttl must be at least 1s", rt.Name)
+		}
+		cc.KeyStrategy = c.RateLimitKey
+		if cc.Key != "" {
+			key, err := ratelimit.ParseKey(cc.Key)
+			if err != nil {
+				return fmt.Errorf("route %q: concurrency: %w", rt.Name, err)
+			}
+			cc.KeyStrategy = key
+		}
+	}
+	return nil
+}
@@ -2,11 +2,15 @@ package config
 
 import (
 	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
 	"github.com/joho/godotenv"
 )
 
@@ -19,18 +23,111 @@ type Config struct {
 
 	LogLevel string
 
+	// PublicKey is a base64 encoded RSA key used when JWKSURL is not set.
 	PublicKey string
+	// JWKSURL points at the auth service's key set. When set, keys are
+	// discovered and rotated automatically and PublicKey is ignored.
+	JWKSURL             string
+	JWKSRefreshInterval time.Duration
+
+	// JWT validation rules. Empty issuer/audience lists disable those checks.
+	JWTIssuers    []string
+	JWTAudiences  []string
+	JWTAlgorithms []string
+	JWTLeeway     time.Duration
+
+	// Claims that populate the authenticated principal (dot-separated paths).
+	RolesClaim  string
+	ScopesClaim string
+	EmailClaim  string
+	TenantClaim string
+
+	// ClaimHeaders forwards token claims to upstreams as request headers.
+	ClaimHeaders        []ClaimHeader
+	ClaimHeaderMaxBytes int
+
+	// OwnedHeaders are removed from every inbound request because only the
+	// gateway may set them. A trailing "*" matches a header name prefix.
+	OwnedHeaders []string
+
+	// RevocationTTL is how long revoked token IDs and subject markers are
+	// kept. It must cover the longest access token lifetime.
+	RevocationTTL time.Duration
+	// RevocationCacheTTL is how long revocation lookups are cached in-process.
+	RevocationCacheTTL time.Duration
+	// RevocationFailClosed rejects authenticated requests while the
+	// revocation store is unreachable.
+	RevocationFailClosed bool
+
+	// API key authentication for machine clients. Keys are looked up in
+	// APIKeysFile when set, otherwise in Redis.
+	APIKeysEnabled   bool
+	APIKeyHeader     string
+	APIKeyQueryParam string
+	APIKeysFile      string
+
+	// AdminRole is the role required to call the gateway's admin endpoints.
+	AdminRole string
+
 	// Redis connection URL (e.g. redis://:password@host:6379/0).
 	RedisURL string
 
 	RateLimitRPS   int
 	RateLimitBurst int
+	// Limits applied to requests without a token or API key.
+	RateLimitAnonRPS   int
+	RateLimitAnonBurst int
+	// RateLimitKey selects the rate limit bucket, e.g. "user" or "user+ip".
+	RateLimitKey ratelimit.Key
+	// RateLimitFailureMode applies while Redis is unavailable; in local mode
+	// each of RateLimitInstances gateways allows its share of every limit.
+	RateLimitFailureMode ratelimit.FailureMode
+	RateLimitInstances   int
+	// RateLimitPolicies holds the named policies, always including
+	// DefaultRateLimitPolicy.
+	RateLimitPolicies map[string]RateLimitPolicy
+	// Quotas holds the long-window quotas declared in ROUTES_FILE.
+	Quotas map[string]Quota
+
+	// TrustedProxies are the reverse proxies whose forwarding headers are
+	// believed when resolving the client IP; TrustedProxyHeader names the
+	// header they maintain, "X-Forwarded-For" or "Forwarded".
+	TrustedProxies     []netip.Prefix
+	TrustedProxyHeader string
+
+	// IPRules are the ordered allow/deny rules applied to every request.
+	IPRules []IPRule
+	// DenyListRefresh is how often the dynamic denylist is reloaded.
+	DenyListRefresh time.Duration
+	// IPBanThreshold 401/429 responses within IPBanWindow ban a client
+	// address for IPBanTTL. Zero disables automatic bans.
+	IPBanThreshold int64
+	IPBanWindow    time.Duration
+	IPBanTTL       time.Duration
 
 	CacheTTL time.Duration
+	// CacheKeepStale is how long stale responses with an upstream ETag or
+	// Last-Modified are kept for revalidation.
+	CacheKeepStale time.Duration
+
+	// RoutesFile is the optional path of the declarative route table.
+	RoutesFile string
+	Routes     []Route
+
+	// WatchInterval is how often config sources are polled for changes.
+	// Zero disables the watcher; SIGHUP still triggers a reload.
+	WatchInterval time.Duration
 }
 
+// EnvFile is the optional dotenv file read by Load. Variables already set in
+// the process environment take precedence over its values.
+const EnvFile = ".env"
+
 func Load() (*Config, error) {
-	_ = godotenv.Load()
+	// The dotenv file is read rather than loaded into the process environment
+	// so that edits to it are picked up when the configuration is reloaded.
+	dotenv, _ := godotenv.Read(EnvFile)
+	getEnv := env(dotenv).get
 
 	rps, err := strconv.Atoi(getEnv("RATE_LIMIT_RPS", "100"))
 	if err != nil {
@@ -42,29 +139,184 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("config: RATE_LIMIT_BURST must be an integer: %w", err)
 	}
 
+	anonRPS, err := strconv.Atoi(getEnv("RATE_LIMIT_ANON_RPS", strconv.Itoa(rps)))
+	if err != nil {
+		return nil, fmt.Errorf("config: RATE_LIMIT_ANON_RPS must be an integer: %w", err)
+	}
+
+	anonBurst, err := strconv.Atoi(getEnv("RATE_LIMIT_ANON_BURST", strconv.Itoa(burst)))
+	if err != nil {
+		return nil, fmt.Errorf("config: RATE_LIMIT_ANON_BURST must be an integer: %w", err)
+	}
+
+	rateLimitKey, err := ratelimit.ParseKey(getEnv("RATE_LIMIT_KEY", "user"))
+	if err != nil {
+		return nil, fmt.Errorf("config: RATE_LIMIT_KEY: %w", err)
+	}
+
+	failureMode, err := ratelimit.ParseFailureMode(strings.ToLower(getEnv("RATE_LIMIT_FAILURE_MODE", "open")))
+	if err != nil {
+		return nil, fmt.Errorf("config: RATE_LIMIT_FAILURE_MODE: %w", err)
+	}
+
+	instances, err := strconv.Atoi(getEnv("RATE_LIMIT_INSTANCES", "1"))
+	if err != nil {
+		return nil, fmt.Errorf("config: RATE_LIMIT_INSTANCES must be an integer: %w", err)
+	}
+
 	ttlSec, err := strconv.Atoi(getEnv("CACHE_TTL", "60"))
 	if err != nil {
 		return nil, fmt.Errorf("config: CACHE_TTL must be an integer (seconds): %w", err)
 	}
 
+	keepStaleSec, err := strconv.Atoi(getEnv("CACHE_KEEP_STALE", "600"))
+	if err != nil {
+		return nil, fmt.Errorf("config: CACHE_KEEP_STALE must be an integer (seconds): %w", err)
+	}
+
+	watchSec, err := strconv.Atoi(getEnv("CONFIG_WATCH_INTERVAL", "5"))
+	if err != nil {
+		return nil, fmt.Errorf("config: CONFIG_WATCH_INTERVAL must be an integer (seconds): %w", err)
+	}
+
+	jwksRefreshSec, err := strconv.Atoi(getEnv("JWKS_REFRESH_INTERVAL", "300"))
+	if err != nil {
+		return nil, fmt.Errorf("config: JWKS_REFRESH_INTERVAL must be an integer (seconds): %w", err)
+	}
+
+	leewaySec, err := strconv.Atoi(getEnv("JWT_LEEWAY", "30"))
+	if err != nil {
+		return nil, fmt.Errorf("config: JWT_LEEWAY must be an integer (seconds): %w", err)
+	}
+
+	claimHeaders, err := parseClaimHeaders(getEnv("CLAIM_HEADERS", "roles=X-User-Roles,scope=X-User-Scopes,email=X-User-Email,org_id=X-User-Org"))
+	if err != nil {
+		return nil, fmt.Errorf("config: CLAIM_HEADERS: %w", err)
+	}
+
+	claimMax, err := strconv.Atoi(getEnv("CLAIM_HEADER_MAX_BYTES", "1024"))
+	if err != nil {
+		return nil, fmt.Errorf("config: CLAIM_HEADER_MAX_BYTES must be an integer: %w", err)
+	}
+
+	revocationSec, err := strconv.Atoi(getEnv("REVOCATION_TTL", "86400"))
+	if err != nil {
+		return nil, fmt.Errorf("config: REVOCATION_TTL must be an integer (seconds): %w", err)
+	}
+
+	revocationCacheSec, err := strconv.Atoi(getEnv("REVOCATION_CACHE_TTL", "5"))
+	if err != nil {
+		return nil, fmt.Errorf("config: REVOCATION_CACHE_TTL must be an integer (seconds): %w", err)
+	}
+
+	revocationFailClosed, err := strconv.ParseBool(getEnv("REVOCATION_FAIL_CLOSED", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("config: REVOCATION_FAIL_CLOSED must be a boolean: %w", err)
+	}
+
+	apiKeysEnabled, err := strconv.ParseBool(getEnv("API_KEYS_ENABLED", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("config: API_KEYS_ENABLED must be a boolean: %w", err)
+	}
+
+	banThreshold, err := strconv.ParseInt(getEnv("IP_BAN_THRESHOLD", "0"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("config: IP_BAN_THRESHOLD must be an integer: %w", err)
+	}
+
+	banWindowSec, err := strconv.Atoi(getEnv("IP_BAN_WINDOW", "60"))
+	if err != nil {
+		return nil, fmt.Errorf("config: IP_BAN_WINDOW must be an integer (seconds): %w", err)
+	}
+
+	banTTLSec, err := strconv.Atoi(getEnv("IP_BAN_TTL", "900"))
+	if err != nil {
+		return nil, fmt.Errorf("config: IP_BAN_TTL must be an integer (seconds): %w", err)
+	}
+
+	denyListRefreshSec, err := strconv.Atoi(getEnv("IP_DENYLIST_REFRESH", "10"))
+	if err != nil {
+		return nil, fmt.Errorf("config: IP_DENYLIST_REFRESH must be an integer (seconds): %w", err)
+	}
+
+	var trustedProxies []netip.Prefix
+	for _, cidr := range splitList(getEnv("TRUSTED_PROXIES", "")) {
+		prefix, err := ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("config: TRUSTED_PROXIES: %w", err)
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+
 	publicKey := getEnv("PUBLIC_KEY", "")
-	if publicKey == "" {
-		return nil, fmt.Errorf("config: PUBLIC_KEY must not be empty")
+	jwksURL := getEnv("JWKS_URL", "")
+	if publicKey == "" && jwksURL == "" {
+		return nil, fmt.Errorf("config: one of PUBLIC_KEY or JWKS_URL must be set")
 	}
 
 	cfg := &Config{
-		Port:           getEnv("PORT", "8080"),
-		CoreServiceURL: getEnv("CORE_SERVICE_URL", "http://localhost:8090"),
-		AuthServiceURL: getEnv("AUTH_SERVICE_URL", "http://localhost:8091"),
-		AiServiceURL:   getEnv("AI_SERVICE_URL", "http://localhost:8092"),
-		LogLevel:       strings.ToLower(getEnv("LOG_LEVEL", "info")),
-		PublicKey:      publicKey,
-		RedisURL:       getEnv("REDIS_URL", "redis://localhost:6379/0"),
-		RateLimitRPS:   rps,
-		RateLimitBurst: burst,
-		CacheTTL:       time.Duration(ttlSec) * time.Second,
+		Port:                 getEnv("PORT", "8080"),
+		CoreServiceURL:       getEnv("CORE_SERVICE_URL", "http://localhost:8090"),
+		AuthServiceURL:       getEnv("AUTH_SERVICE_URL", "http://localhost:8091"),
+		AiServiceURL:         getEnv("AI_SERVICE_URL", "http://localhost:8092"),
+		LogLevel:             strings.ToLower(getEnv("LOG_LEVEL", "info")),
+		PublicKey:            publicKey,
+		JWKSURL:              jwksURL,
+		JWKSRefreshInterval:  time.Duration(jwksRefreshSec) * time.Second,
+		JWTIssuers:           splitList(getEnv("JWT_ISSUERS", "")),
+		JWTAudiences:         splitList(getEnv("JWT_AUDIENCES", "")),
+		JWTAlgorithms:        splitList(getEnv("JWT_ALGORITHMS", "RS256")),
+		JWTLeeway:            time.Duration(leewaySec) * time.Second,
+		RolesClaim:           getEnv("JWT_ROLES_CLAIM", "roles"),
+		ScopesClaim:          getEnv("JWT_SCOPES_CLAIM", "scope"),
+		EmailClaim:           getEnv("JWT_EMAIL_CLAIM", "email"),
+		TenantClaim:          getEnv("JWT_TENANT_CLAIM", "org_id"),
+		ClaimHeaders:         claimHeaders,
+		ClaimHeaderMaxBytes:  claimMax,
+		OwnedHeaders:         splitList(getEnv("GATEWAY_OWNED_HEADERS", "X-User-*,X-Real-IP")),
+		RevocationTTL:        time.Duration(revocationSec) * time.Second,
+		RevocationCacheTTL:   time.Duration(revocationCacheSec) * time.Second,
+		RevocationFailClosed: revocationFailClosed,
+		APIKeysEnabled:       apiKeysEnabled,
+		APIKeyHeader:         http.CanonicalHeaderKey(getEnv("API_KEY_HEADER", "X-API-Key")),
+		APIKeyQueryParam:     getEnv("API_KEY_QUERY_PARAM", "api_key"),
+		APIKeysFile:          getEnv("API_KEYS_FILE", ""),
+		AdminRole:            getEnv("ADMIN_ROLE", "admin"),
+		RedisURL:             getEnv("REDIS_URL", "redis://localhost:6379/0"),
+		RateLimitRPS:         rps,
+		RateLimitBurst:       burst,
+		RateLimitAnonRPS:     anonRPS,
+		RateLimitAnonBurst:   anonBurst,
+		RateLimitKey:         rateLimitKey,
+		RateLimitFailureMode: failureMode,
+		RateLimitInstances:   instances,
+		TrustedProxies:       trustedProxies,
+		TrustedProxyHeader:   http.CanonicalHeaderKey(getEnv("TRUSTED_PROXY_HEADER", "X-Forwarded-For")),
+		IPBanThreshold:       banThreshold,
+		IPBanWindow:          time.Duration(banWindowSec) * time.Second,
+		IPBanTTL:             time.Duration(banTTLSec) * time.Second,
+		DenyListRefresh:      time.Duration(denyListRefreshSec) * time.Second,
+		CacheTTL:             time.Duration(ttlSec) * time.Second,
+		CacheKeepStale:       time.Duration(keepStaleSec) * time.Second,
+		RoutesFile:           getEnv("ROUTES_FILE", ""),
+		WatchInterval:        time.Duration(watchSec) * time.Second,
 	}
 
+	var declaredPolicies map[string]RateLimitPolicy
+	if cfg.RoutesFile != "" {
+		f, err := loadRoutesFile(cfg.RoutesFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+		cfg.Routes = f.Routes
+		declaredPolicies = f.RateLimitPolicies
+		cfg.Quotas = f.Quotas
+		cfg.IPRules = f.IPRules
+	} else {
+		cfg.Routes = defaultRoutes(cfg)
+	}
+	cfg.RateLimitPolicies = rateLimitPolicies(cfg, declaredPolicies)
+
 	if err := cfg.validate(); err != nil {
 		return nil, fmt.Errorf("config: %w", err)
 	}
@@ -88,12 +340,148 @@ func (c *Config) validate() error {
 	if c.RateLimitRPS <= 0 {
 		return fmt.Errorf("RATE_LIMIT_RPS must be greater than 0")
 	}
+	if c.RateLimitBurst < 0 {
+		return fmt.Errorf("RATE_LIMIT_BURST must not be negative")
+	}
+	if c.RateLimitAnonRPS <= 0 {
+		return fmt.Errorf("RATE_LIMIT_ANON_RPS must be greater than 0")
+	}
+	if c.RateLimitAnonBurst < 0 {
+		return fmt.Errorf("RATE_LIMIT_ANON_BURST must not be negative")
+	}
+	if c.RateLimitInstances < 1 {
+		return fmt.Errorf("RATE_LIMIT_INSTANCES must be at least 1")
+	}
+	if c.TrustedProxyHeader != "X-Forwarded-For" && c.TrustedProxyHeader != "Forwarded" {
+		return fmt.Errorf("TRUSTED_PROXY_HEADER must be X-Forwarded-For or Forwarded")
+	}
+	if c.DenyListRefresh <= 0 {
+		return fmt.Errorf("IP_DENYLIST_REFRESH must be greater than 0")
+	}
+	if c.IPBanThreshold < 0 {
+		return fmt.Errorf("IP_BAN_THRESHOLD must not be negative")
+	}
+	if c.IPBanThreshold > 0 && (c.IPBanWindow <= 0 || c.IPBanTTL <= 0) {
+		return fmt.Errorf("IP_BAN_WINDOW and IP_BAN_TTL must be greater than 0")
+	}
+	if c.JWKSURL != "" {
+		if u, err := url.Parse(c.JWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("JWKS_URL must be an absolute http(s) URL")
+		}
+		if c.JWKSRefreshInterval <= 0 {
+			return fmt.Errorf("JWKS_REFRESH_INTERVAL must be greater than 0")
+		}
+	}
+	if len(c.JWTAlgorithms) == 0 {
+		return fmt.Errorf("JWT_ALGORITHMS must list at least one algorithm")
+	}
+	for _, alg := range c.JWTAlgorithms {
+		if !rsaAlgorithms[alg] {
+			return fmt.Errorf("JWT_ALGORITHMS: unsupported algorithm %q (RS256/384/512, PS256/384/512)", alg)
+		}
+	}
+	if c.JWTLeeway < 0 {
+		return fmt.Errorf("JWT_LEEWAY must not be negative")
+	}
+	if c.ClaimHeaderMaxBytes < 0 {
+		return fmt.Errorf("CLAIM_HEADER_MAX_BYTES must not be negative")
+	}
+	if c.RevocationTTL <= 0 {
+		return fmt.Errorf("REVOCATION_TTL must be greater than 0")
+	}
+	if c.CacheKeepStale < 0 {
+		return fmt.Errorf("CACHE_KEEP_STALE must not be negative")
+	}
+	if c.RevocationCacheTTL < 0 {
+		return fmt.Errorf("REVOCATION_CACHE_TTL must not be negative")
+	}
+	if c.APIKeysEnabled && c.APIKeyHeader == "" && c.APIKeyQueryParam == "" {
+		return fmt.Errorf("API_KEY_HEADER or API_KEY_QUERY_PARAM must be set when API_KEYS_ENABLED is true")
+	}
+	if strings.ContainsAny(c.APIKeyHeader, " \t:") {
+		return fmt.Errorf("API_KEY_HEADER: invalid header name %q", c.APIKeyHeader)
+	}
+	if c.WatchInterval < 0 {
+		return fmt.Errorf("CONFIG_WATCH_INTERVAL must not be negative")
+	}
+	if err := normalizeRoutes(c.Routes); err != nil {
+		return err
+	}
+	if err := normalizeRateLimits(c); err != nil {
+		return err
+	}
+	if err := normalizeQuotas(c); err != nil {
+		return err
+	}
+	if err := normalizeConcurrency(c); err != nil {
+		return err
+	}
+	if err := normalizeIPRules(c); err != nil {
+		return err
+	}
 	return nil
 }
 
-func getEnv(key, defaultVal string) string {
+// Sources returns the files the configuration was read from, for change
+// detection by the hot-reload watcher.
+func (c *Config) Sources() []string {
+	sources := []string{EnvFile}
+	if c.RoutesFile != "" {
+		sources = append(sources, c.RoutesFile)
+	}
+	if c.APIKeysEnabled && c.APIKeysFile != "" {
+		sources = append(sources, c.APIKeysFile)
+	}
+	return sources
+}
+
+// ClaimHeader maps a token claim path to the upstream header carrying it.
+type ClaimHeader struct {
+	Claim  string
+	Header string
+}
+
+// parseClaimHeaders parses "claim=Header" pairs, e.g. "org.id=X-User-Org".
+func parseClaimHeaders(s string) ([]ClaimHeader, error) {
+	var out []ClaimHeader
+	for _, pair := range splitList(s) {
+		claim, header, ok := strings.Cut(pair, "=")
+		claim, header = strings.TrimSpace(claim), strings.TrimSpace(header)
+		if !ok || claim == "" || header == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected claim=Header", pair)
+		}
+		if strings.ContainsAny(header, " \t:") {
+			return nil, fmt.Errorf("invalid header name %q", header)
+		}
+		out = append(out, ClaimHeader{Claim: claim, Header: http.CanonicalHeaderKey(header)})
+	}
+	return out, nil
+}
+
+var rsaAlgorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+}
+
+// splitList parses a comma separated value, dropping blank entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+type env map[string]string
+
+func (e env) get(key, defaultVal string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
+	if v := e[key]; v != "" {
+		return v
+	}
 	return defaultVal
 }
@@ -0,0 +1,634 @@
+package config_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/config"
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("PUBLIC_KEY", "dGVzdA==")
+}
+
+func writeRoutesFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad_NoRoutesFile_GeneratesDefaultRoutes(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("CORE_SERVICE_URL", "http://core:8080")
+	t.Setenv("AUTH_SERVICE_URL", "http://auth:8080")
+	t.Setenv("AI_SERVICE_URL", "http://ai:8080")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	require.Len(t, cfg.Routes, 3)
+	assert.Equal(t, "/api/core", cfg.Routes[0].Prefix)
+	assert.Equal(t, []string{"http://core:8080"}, cfg.Routes[0].Upstreams)
+	assert.Equal(t, "/api/auth", cfg.Routes[1].Prefix)
+	assert.Equal(t, "/api/ai", cfg.Routes[2].Prefix)
+	for _, rt := range cfg.Routes {
+		assert.True(t, rt.StripPrefix)
+		assert.True(t, rt.Cache.Enabled)
+		assert.Equal(t, config.AuthOptional, rt.Auth)
+	}
+}
+
+func TestLoad_YAMLRoutesFile_AppliesDefaultsAndNormalizes(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", `
+routes:
+  - name: judge
+    prefix: /api/judge/
+    methods: [get, post]
+    host: Judge.Example.com
+    upstreams:
+      - http://judge-1:8080
+      - http://judge-2:8080
+    authorize:
+      - methods: [post]
+        paths: ["/api/judge/{id:[0-9]+}/rejudge"]
+        roles: [admin]
+  - name: files
+    prefix: /files
+    auth: None
+    strip_prefix: false
+    upstreams: [http://files:9000]
+    cache:
+      enabled: false
+      ttl: 30s
+      keep_stale: 5m
+      stale_while_revalidate: 1m
+      stale_if_error: 1h
+      scope: User
+`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.Routes, 2)
+
+	judge := cfg.Routes[0]
+	assert.Equal(t, "/api/judge", judge.Prefix)
+	assert.Equal(t, []string{"GET", "POST"}, judge.Methods)
+	assert.Equal(t, "judge.example.com", judge.Host)
+	assert.Len(t, judge.Upstreams, 2)
+	assert.True(t, judge.StripPrefix)
+	assert.True(t, judge.Cache.Enabled)
+	assert.Equal(t, config.CacheScopePublic, judge.Cache.Scope)
+	assert.Equal(t, config.AuthRequired, judge.Auth, "file routes require auth by default")
+	require.Len(t, judge.Authorize, 1)
+	assert.Equal(t, []string{"POST"}, judge.Authorize[0].Methods)
+	assert.Equal(t, []string{"admin"}, judge.Authorize[0].Roles)
+
+	files := cfg.Routes[1]
+	assert.Equal(t, config.AuthNone, files.Auth)
+	assert.False(t, files.StripPrefix)
+	assert.False(t, files.Cache.Enabled)
+	assert.Equal(t, 30*time.Second, files.Cache.TTL)
+	assert.Equal(t, config.CacheScopeUser, files.Cache.Scope)
+	assert.Equal(t, 5*time.Minute, files.Cache.KeepStale)
+	assert.Equal(t, time.Minute, files.Cache.StaleWhileRevalidate)
+	assert.Equal(t, time.Hour, files.Cache.StaleIfError)
+	assert.Equal(t, 10*time.Minute, cfg.CacheKeepStale)
+}
+
+func TestLoad_JSONRoutesFile(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.json", `{
+  "routes": [
+    {"name": "core", "prefix": "/api/core", "upstreams": ["https://core.internal"]}
+  ]
+}`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.Routes, 1)
+	assert.Equal(t, "core", cfg.Routes[0].Name)
+	assert.True(t, cfg.Routes[0].StripPrefix)
+}
+
+func TestLoad_InvalidRoutes_ReturnsError(t *testing.T) {
+	cases := map[string]string{
+		"missing prefix slash": `
+routes:
+  - prefix: api
+    upstreams: [http://a]`,
+		"no upstreams": `
+routes:
+  - prefix: /api`,
+		"relative upstream": `
+routes:
+  - prefix: /api
+    upstreams: [a.internal:8080]`,
+		"unknown method": `
+routes:
+  - prefix: /api
+    methods: [FETCH]
+    upstreams: [http://a]`,
+		"duplicate route": `
+routes:
+  - prefix: /api
+    upstreams: [http://a]
+  - prefix: /api/
+    upstreams: [http://b]`,
+		"duplicate route name": `
+routes:
+  - name: api
+    prefix: /api
+    upstreams: [http://a]
+  - name: api
+    prefix: /other
+    upstreams: [http://b]`,
+		"empty file": `routes: []`,
+		"authorize on public route": `
+routes:
+  - prefix: /api
+    auth: none
+    authorize: [{roles: [admin]}]
+    upstreams: [http://a]`,
+		"unknown cache scope": `
+routes:
+  - prefix: /api
+    cache: {scope: everyone}
+    upstreams: [http://a]`,
+		"authorize rule without roles or scopes": `
+routes:
+  - prefix: /api
+    authorize: [{paths: [/api/admin]}]
+    upstreams: [http://a]`,
+		"authorize relative path": `
+routes:
+  - prefix: /api
+    authorize: [{paths: [api/admin], roles: [admin]}]
+    upstreams: [http://a]`,
+		"authorize bad regex": `
+routes:
+  - prefix: /api
+    authorize: [{paths: ["/api/{id:[}"], roles: [admin]}]
+    upstreams: [http://a]`,
+		"authorize inner wildcard": `
+routes:
+  - prefix: /api
+    authorize: [{paths: ["/api/*/x"], roles: [admin]}]
+    upstreams: [http://a]`,
+		"unknown auth mode": `
+routes:
+  - prefix: /api
+    auth: sometimes
+    upstreams: [http://a]`,
+	}
+
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", content))
+
+			_, err := config.Load()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoad_MissingRoutesFile_ReturnsError(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("ROUTES_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+
+	_, err := config.Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_EnvFile_IsReReadOnEveryLoad(t *testing.T) {
+	setRequiredEnv(t)
+	t.Chdir(t.TempDir())
+
+	require.NoError(t, os.WriteFile(config.EnvFile, []byte("RATE_LIMIT_RPS=7\n"), 0o600))
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 7, cfg.RateLimitRPS)
+
+	require.NoError(t, os.WriteFile(config.EnvFile, []byte("RATE_LIMIT_RPS=9\n"), 0o600))
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 9, cfg.RateLimitRPS)
+}
+
+func TestLoad_ProcessEnv_TakesPrecedenceOverEnvFile(t *testing.T) {
+	setRequiredEnv(t)
+	t.Chdir(t.TempDir())
+	t.Setenv("RATE_LIMIT_RPS", "3")
+
+	require.NoError(t, os.WriteFile(config.EnvFile, []byte("RATE_LIMIT_RPS=7\n"), 0o600))
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 3, cfg.RateLimitRPS)
+}
+
+func TestLoad_ClaimHeaders(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("CLAIM_HEADERS", "roles=x-user-roles, org.id=X-User-Org")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []config.ClaimHeader{
+		{Claim: "roles", Header: "X-User-Roles"},
+		{Claim: "org.id", Header: "X-User-Org"},
+	}, cfg.ClaimHeaders)
+}
+
+func TestLoad_InvalidClaimHeaders_ReturnsError(t *testing.T) {
+	for _, v := range []string{"roles", "=X-User-Roles", "roles=X User"} {
+		setRequiredEnv(t)
+		t.Setenv("CLAIM_HEADERS", v)
+
+		_, err := config.Load()
+		assert.Error(t, err, v)
+	}
+}
+
+func TestLoad_APIKeys(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("API_KEYS_ENABLED", "true")
+	t.Setenv("API_KEY_HEADER", "x-judge-key")
+	t.Setenv("API_KEYS_FILE", "/etc/gateway/api-keys.yaml")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	assert.True(t, cfg.APIKeysEnabled)
+	assert.Equal(t, "X-Judge-Key", cfg.APIKeyHeader)
+	assert.Equal(t, "api_key", cfg.APIKeyQueryParam)
+	assert.Contains(t, cfg.Sources(), "/etc/gateway/api-keys.yaml", "the key file is watched for changes")
+
+	t.Setenv("API_KEYS_ENABLED", "maybe")
+	_, err = config.Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_RateLimitKeyAndAnonymousLimits(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("RATE_LIMIT_RPS", "50")
+	t.Setenv("RATE_LIMIT_BURST", "10")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "user", cfg.RateLimitKey.String())
+	assert.Equal(t, 50, cfg.RateLimitAnonRPS, "anonymous limits default to the authenticated ones")
+	assert.Equal(t, 10, cfg.RateLimitAnonBurst)
+
+	t.Setenv("RATE_LIMIT_KEY", "user+header:X-Tenant")
+	t.Setenv("RATE_LIMIT_ANON_RPS", "5")
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "user+header:X-Tenant", cfg.RateLimitKey.String())
+	assert.Equal(t, 5, cfg.RateLimitAnonRPS)
+
+	t.Setenv("RATE_LIMIT_KEY", "session")
+	_, err = config.Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_RateLimitFailureMode(t *testing.T) {
+	setRequiredEnv(t)
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.FailOpen, cfg.RateLimitFailureMode)
+	assert.Equal(t, 1, cfg.RateLimitInstances)
+
+	t.Setenv("RATE_LIMIT_FAILURE_MODE", "Local")
+	t.Setenv("RATE_LIMIT_INSTANCES", "3")
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.FailLocal, cfg.RateLimitFailureMode)
+	assert.Equal(t, 3, cfg.RateLimitInstances)
+
+	t.Setenv("RATE_LIMIT_INSTANCES", "0")
+	_, err = config.Load()
+	assert.Error(t, err)
+
+	t.Setenv("RATE_LIMIT_INSTANCES", "1")
+	t.Setenv("RATE_LIMIT_FAILURE_MODE", "retry")
+	_, err = config.Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_RateLimitPolicies(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("RATE_LIMIT_RPS", "100")
+	t.Setenv("RATE_LIMIT_KEY", "user")
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", `
+rate_limit_policies:
+  login:
+    rps: 1
+    burst: 4
+    key: ip
+  ai:
+    rps: 2
+    anonymous_rps: 1
+    tiers:
+      internal: {rps: 20, burst: 10}
+routes:
+  - name: auth
+    prefix: /api/auth
+    auth: optional
+    upstreams: [http://auth:8080]
+    rate_limit_rules:
+      - methods: [post]
+        paths: [/api/auth/login]
+        policy: login
+  - name: ai
+    prefix: /api/ai
+    rate_limit: ai
+    upstreams: [http://ai:8080]
+`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	require.Len(t, cfg.RateLimitPolicies, 3)
+	def := cfg.RateLimitPolicies[config.DefaultRateLimitPolicy]
+	assert.Equal(t, 100, def.RPS, "the default policy comes from the environment")
+
+	login := cfg.RateLimitPolicies["login"]
+	assert.Equal(t, "ip", login.KeyStrategy.String())
+	assert.Equal(t, 1, login.AnonymousRPS, "anonymous limits default to the policy limits")
+	assert.Equal(t, 4, login.AnonymousBurst)
+
+	ai := cfg.RateLimitPolicies["ai"]
+	assert.Equal(t, "user", ai.KeyStrategy.String(), "the key defaults to RATE_LIMIT_KEY")
+	assert.Equal(t, config.RateLimitTier{RPS: 20, Burst: 10}, ai.Tiers["internal"])
+
+	assert.Equal(t, config.DefaultRateLimitPolicy, cfg.Routes[0].RateLimit)
+	assert.Equal(t, []string{"POST"}, cfg.Routes[0].RateLimitRules[0].Methods)
+	assert.Equal(t, "ai", cfg.Routes[1].RateLimit)
+}
+
+func TestLoad_InvalidRateLimitPolicies_ReturnsError(t *testing.T) {
+	cases := map[string]string{
+		"unknown route policy": `
+routes:
+  - prefix: /api
+    rate_limit: strict
+    upstreams: [http://a]`,
+		"unknown rule policy": `
+routes:
+  - prefix: /api
+    rate_limit_rules: [{paths: [/api/login], policy: strict}]
+    upstreams: [http://a]`,
+		"zero rps": `
+rate_limit_policies:
+  strict: {burst: 1}
+routes:
+  - prefix: /api
+    upstreams: [http://a]`,
+		"bad key": `
+rate_limit_policies:
+  strict: {rps: 1, key: session}
+routes:
+  - prefix: /api
+    upstreams: [http://a]`,
+		"bad name": `
+rate_limit_policies:
+  "Strict Login": {rps: 1}
+routes:
+  - prefix: /api
+    upstreams: [http://a]`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", content))
+			_, err := config.Load()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoad_Quotas(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("RATE_LIMIT_KEY", "user")
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", `
+quotas:
+  ai-daily: {limit: 200, window: day}
+  ai-monthly: {limit: 3000, window: month, key: api_key}
+routes:
+  - name: ai
+    prefix: /api/ai
+    quotas: [ai-daily, ai-monthly]
+    upstreams: [http://ai:8080]
+`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	require.Len(t, cfg.Quotas, 2)
+	daily := cfg.Quotas["ai-daily"]
+	assert.Equal(t, int64(200), daily.Limit)
+	assert.Equal(t, ratelimit.Day, daily.Period)
+	assert.Equal(t, "user", daily.KeyStrategy.String(), "the key defaults to RATE_LIMIT_KEY")
+	assert.Equal(t, "api_key", cfg.Quotas["ai-monthly"].KeyStrategy.String())
+	assert.Equal(t, []string{"ai-daily", "ai-monthly"}, cfg.Routes[0].Quotas)
+}
+
+func TestLoad_InvalidQuotas_ReturnsError(t *testing.T) {
+	cases := map[string]string{
+		"unknown quota": `
+routes:
+  - prefix: /api
+    quotas: [daily]
+    upstreams: [http://a]`,
+		"duplicate quota": `
+quotas:
+  daily: {limit: 1, window: day}
+routes:
+  - prefix: /api
+    quotas: [daily, daily]
+    upstreams: [http://a]`,
+		"zero limit": `
+quotas:
+  daily: {window: day}
+routes:
+  - prefix: /api
+    upstreams: [http://a]`,
+		"bad window": `
+quotas:
+  weekly: {limit: 1, window: week}
+routes:
+  - prefix: /api
+    upstreams: [http://a]`,
+		"bad key": `
+quotas:
+  daily: {limit: 1, window: day, key: session}
+routes:
+  - prefix: /api
+    upstreams: [http://a]`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", content))
+			_, err := config.Load()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoad_RouteConcurrency(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("RATE_LIMIT_KEY", "user")
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", `
+routes:
+  - name: ai
+    prefix: /api/ai
+    upstreams: [http://ai:8080]
+    concurrency:
+      per_key: 2
+      total: 50
+      queue: 10
+      queue_timeout: 5s
+  - name: core
+    prefix: /api/core
+    upstreams: [http://core:8080]
+`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	cc := cfg.Routes[0].Concurrency
+	assert.True(t, cc.Enabled())
+	assert.Equal(t, 2, cc.PerKey)
+	assert.Equal(t, 50, cc.Total)
+	assert.Equal(t, 10, cc.Queue)
+	assert.Equal(t, 5*time.Second, cc.QueueTimeout)
+	assert.Equal(t, "user", cc.KeyStrategy.String())
+	assert.False(t, cfg.Routes[1].Concurrency.Enabled())
+
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", `
+routes:
+  - prefix: /api
+    upstreams: [http://a]
+    concurrency: {total: -1}
+`))
+	_, err = config.Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_RateLimitCost(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", `
+routes:
+  - name: ai
+    prefix: /api/ai
+    upstreams: [http://ai:8080]
+    rate_limit_cost: {weight: 10, bytes_per_unit: 4096, header: x-request-cost}
+  - name: core
+    prefix: /api/core
+    upstreams: [http://core:8080]
+`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, config.RateLimitCost{Weight: 10, BytesPerUnit: 4096, Header: "X-Request-Cost"}, cfg.Routes[0].RateLimitCost)
+	assert.Equal(t, 1, cfg.Routes[1].RateLimitCost.Weight, "requests cost 1 by default")
+
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", `
+routes:
+  - prefix: /api
+    upstreams: [http://a]
+    rate_limit_cost: {weight: -1}
+`))
+	_, err = config.Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_IPRules(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("IP_BAN_THRESHOLD", "20")
+	t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", `
+ip_rules:
+  - action: deny
+    cidrs: [203.0.113.0/24, "2001:db8:bad::/48"]
+routes:
+  - name: admin
+    prefix: /api/admin
+    upstreams: [http://core:8080]
+    ip_rules:
+      - action: Allow
+        cidrs: [10.0.0.0/8, 192.0.2.7]
+      - action: deny
+        cidrs: [0.0.0.0/0, "::/0"]
+`))
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	require.Len(t, cfg.IPRules, 1)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24"), netip.MustParsePrefix("2001:db8:bad::/48")}, cfg.IPRules[0].Prefixes)
+
+	rules := cfg.Routes[0].IPRules
+	require.Len(t, rules, 2)
+	assert.Equal(t, config.IPAllow, rules[0].Action)
+	assert.Equal(t, netip.MustParsePrefix("192.0.2.7/32"), rules[0].Prefixes[1], "a bare address matches only itself")
+
+	assert.Equal(t, int64(20), cfg.IPBanThreshold)
+	assert.Equal(t, time.Minute, cfg.IPBanWindow)
+	assert.Equal(t, 15*time.Minute, cfg.IPBanTTL)
+	assert.Equal(t, 10*time.Second, cfg.DenyListRefresh)
+
+	for name, rules := range map[string]string{
+		"bad action": `[{action: block, cidrs: [10.0.0.0/8]}]`,
+		"bad cidr":   `[{action: deny, cidrs: [10.0.0.0/33]}]`,
+		"no cidrs":   `[{action: deny}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("ROUTES_FILE", writeRoutesFile(t, "routes.yaml", "ip_rules: "+rules+`
+routes:
+  - prefix: /api
+    upstreams: [http://a]
+`))
+			_, err := config.Load()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoad_TrustedProxies(t *testing.T) {
+	setRequiredEnv(t)
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+	assert.Empty(t, cfg.TrustedProxies)
+	assert.Equal(t, "X-Forwarded-For", cfg.TrustedProxyHeader)
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.7,2001:db8::/32")
+	t.Setenv("TRUSTED_PROXY_HEADER", "forwarded")
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.7/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, cfg.TrustedProxies)
+	assert.Equal(t, "Forwarded", cfg.TrustedProxyHeader)
+
+	t.Setenv("TRUSTED_PROXY_HEADER", "X-Real-IP")
+	_, err = config.Load()
+	assert.Error(t, err)
+
+	t.Setenv("TRUSTED_PROXY_HEADER", "")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/33")
+	_, err = config.Load()
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// IP rule actions.
+const (
+	IPAllow = "allow"
+	IPDeny  = "deny"
+)
+
+// IPRule allows or denies the client addresses in CIDRs. Rules are evaluated
+// in order and the first one containing the address decides.
+type IPRule struct {
+	Action string `yaml:"action"`
+	// CIDRs are IPv4 or IPv6 prefixes; a bare address matches only itself.
+	CIDRs []string `yaml:"cidrs"`
+
+	// Prefixes are the parsed CIDRs.
+	Prefixes []netip.Prefix `yaml:"-"`
+}
+
+func normalizeIPRules(c *Config) error {
+	if err := parseIPRules(c.IPRules); err != nil {
+		return fmt.Errorf("ip_rules: %w", err)
+	}
+	for i := range c.Routes {
+		if err := parseIPRules(c.Routes[i].IPRules); err != nil {
+			return fmt.Errorf("route %q: ip_rules: %w", c.Routes[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func parseIPRules(rules []IPRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		rule.Action = strings.ToLower(rule.Action)
+		if rule.Action != IPAllow && rule.Action != IPDeny {
+			return fmt.Errorf("rule %d: action must be %q or %q", i, IPAllow, IPDeny)
+		}
+		if len(rule.CIDRs) == 0 {
+			return fmt.Errorf("rule %d: no cidrs", i)
+		}
+		rule.Prefixes = make([]netip.Prefix, 0, len(rule.CIDRs))
+		for _, cidr := range rule.CIDRs {
+			prefix, err := ParsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+			rule.Prefixes = append(rule.Prefixes, prefix)
+		}
+	}
+	return nil
+}
+
+// ParsePrefix parses a CIDR prefix or a bare IP address, which becomes a
+// single-address prefix. IPv4-mapped IPv6 addresses are unmapped.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+	}
+	return prefix.Masked(), nil
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+)
+
+// Quota is a long-window request quota declared under "quotas" in
+// ROUTES_FILE, e.g. 200 requests per user per day. Routes opt in by name.
+type Quota struct {
+	Limit int64 `yaml:"limit"`
+	// Window is "hour", "day" or "month", aligned to UTC.
+	Window string `yaml:"window"`
+	// Key is the counter key strategy; it defaults to RATE_LIMIT_KEY.
+	Key string `yaml:"key"`
+
+	// Period and KeyStrategy are the parsed Window and Key.
+	Period      ratelimit.Window `yaml:"-"`
+	KeyStrategy ratelimit.Key    `yaml:"-"`
+}
+
+// normalizeQuotas validates the declared quotas and checks that every quota a
+// route refers to exists.
+func normalizeQuotas(c *Config) error {
+	for name, q := range c.Quotas {
+		if !policyName.MatchString(name) {
+			return fmt.Errorf("quota %q: names may only contain a-z, 0-9, '_' and '-'", name)
+		}
+		if q.Limit <= 0 {
+			return fmt.Errorf("quota %q: limit must be greater than 0", name)
+		}
+		window, err := ratelimit.ParseWindow(q.Window)
+		if err != nil {
+			return fmt.Errorf("quota %q: %w", name, err)
+		}
+		q.Period = window
+		q.KeyStrategy = c.RateLimitKey
+		if q.Key != "" {
+			key, err := ratelimit.ParseKey(q.Key)
+			if err != nil {
+				return fmt.Errorf("quota %q: %w", name, err)
+			}
+			q.KeyStrategy = key
+		}
+		c.Quotas[name] = q
+	}
+
+	for _, rt := range c.Routes {
+		seen := make(map[string]bool, len(rt.Quotas))
+		for _, name := range rt.Quotas {
+			if _, ok := c.Quotas[name]; !ok {
+				return fmt.Errorf("route %q: unknown quota %q", rt.Name, name)
+			}
+			if seen[name] {
+				return fmt.Errorf("route %q: quota %q listed twice", rt.Name, name)
+			}
+			seen[name] = true
+		}
+	}
+	return nil
+}
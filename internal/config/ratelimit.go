@@ -0,0 +1,153 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+)
+
+// DefaultRateLimitPolicy applies to routes that name no policy. It is built
+// from the RATE_LIMIT_* variables unless ROUTES_FILE declares it.
+const DefaultRateLimitPolicy = "default"
+
+// RateLimitPolicy is a named rate limit declared under "rate_limit_policies"
+// in ROUTES_FILE. Each policy counts requests separately.
+type RateLimitPolicy struct {
+	RPS   int `yaml:"rps"`
+	Burst int `yaml:"burst"`
+	// Anonymous limits default to RPS and Burst.
+	AnonymousRPS   int `yaml:"anonymous_rps"`
+	AnonymousBurst int `yaml:"anonymous_burst"`
+	// Key is the bucket key strategy; it defaults to RATE_LIMIT_KEY.
+	Key string `yaml:"key"`
+	// Tiers overrides RPS and Burst for API keys of the named tier.
+	Tiers map[string]RateLimitTier `yaml:"tiers"`
+
+	// KeyStrategy is the parsed Key.
+	KeyStrategy ratelimit.Key `yaml:"-"`
+}
+
+// RateLimitTier is the limit applied to API keys of one tier.
+type RateLimitTier struct {
+	RPS   int `yaml:"rps"`
+	Burst int `yaml:"burst"`
+}
+
+// RateLimitRule applies Policy to the requests of a route matching Methods
+// and Paths (chi-style patterns on the full request path).
+type RateLimitRule struct {
+	Methods []string `yaml:"methods"`
+	Paths   []string `yaml:"paths"`
+	Policy  string   `yaml:"policy"`
+}
+
+// RateLimitCost weighs the requests of a route against its rate limits.
+type RateLimitCost struct {
+	// Weight is what each request costs. Defaults to 1.
+	Weight int `yaml:"weight"`
+	// BytesPerUnit adds one unit per started BytesPerUnit of request body.
+	BytesPerUnit int64 `yaml:"bytes_per_unit"`
+	// Header is a response header in which the upstream reports the actual
+	// cost, e.g. "X-Request-Cost"; the excess is debited after the fact.
+	Header string `yaml:"header"`
+}
+
+var policyName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// rateLimitPolicies merges the policies declared in the routes file over the
+// default policy built from the environment.
+func rateLimitPolicies(c *Config, declared map[string]RateLimitPolicy) map[string]RateLimitPolicy {
+	policies := map[string]RateLimitPolicy{
+		DefaultRateLimitPolicy: {
+			RPS:            c.RateLimitRPS,
+			Burst:          c.RateLimitBurst,
+			AnonymousRPS:   c.RateLimitAnonRPS,
+			AnonymousBurst: c.RateLimitAnonBurst,
+			KeyStrategy:    c.RateLimitKey,
+		},
+	}
+	for name, p := range declared {
+		policies[name] = p
+	}
+	return policies
+}
+
+// normalizeRateLimits validates the policies, fills in their defaults and
+// checks that every policy a route refers to exists.
+func normalizeRateLimits(c *Config) error {
+	for name, p := range c.RateLimitPolicies {
+		if !policyName.MatchString(name) {
+			return fmt.Errorf("rate limit policy %q: names may only contain a-z, 0-9, '_' and '-'", name)
+		}
+		if p.RPS <= 0 {
+			return fmt.Errorf("rate limit policy %q: rps must be greater than 0", name)
+		}
+		if p.Burst < 0 || p.AnonymousRPS < 0 || p.AnonymousBurst < 0 {
+			return fmt.Errorf("rate limit policy %q: limits must not be negative", name)
+		}
+		if p.AnonymousRPS == 0 {
+			p.AnonymousRPS, p.AnonymousBurst = p.RPS, p.Burst
+		}
+		if p.KeyStrategy == nil {
+			p.KeyStrategy = c.RateLimitKey
+			if p.Key != "" {
+				key, err := ratelimit.ParseKey(p.Key)
+				if err != nil {
+					return fmt.Errorf("rate limit policy %q: %w", name, err)
+				}
+				p.KeyStrategy = key
+			}
+		}
+		for tier, t := range p.Tiers {
+			if t.RPS <= 0 || t.Burst < 0 {
+				return fmt.Errorf("rate limit policy %q: tier %q: rps must be greater than 0 and burst not negative", name, tier)
+			}
+		}
+		c.RateLimitPolicies[name] = p
+	}
+
+	for i := range c.Routes {
+		rt := &c.Routes[i]
+		if rt.RateLimit == "" {
+			rt.RateLimit = DefaultRateLimitPolicy
+		}
+		if _, ok := c.RateLimitPolicies[rt.RateLimit]; !ok {
+			return fmt.Errorf("route %q: unknown rate limit policy %q", rt.Name, rt.RateLimit)
+		}
+		cost := &rt.RateLimitCost
+		if cost.Weight < 0 || cost.BytesPerUnit < 0 {
+			return fmt.Errorf("route %q: rate limit cost must not be negative", rt.Name)
+		}
+		if cost.Weight == 0 {
+			cost.Weight = 1
+		}
+		if cost.Header != "" {
+			if strings.ContainsAny(cost.Header, " \t:") {
+				return fmt.Errorf("route %q: rate limit cost: invalid header name %q", rt.Name, cost.Header)
+			}
+			cost.Header = http.CanonicalHeaderKey(cost.Header)
+		}
+		for j := range rt.RateLimitRules {
+			rule := &rt.RateLimitRules[j]
+			if _, ok := c.RateLimitPolicies[rule.Policy]; !ok {
+				return fmt.Errorf("route %q: rate limit rule %d: unknown policy %q", rt.Name, j, rule.Policy)
+			}
+			for k, m := range rule.Methods {
+				m = strings.ToUpper(m)
+				if !validMethods[m] {
+					return fmt.Errorf("route %q: rate limit rule %d: unsupported method %q", rt.Name, j, rule.Methods[k])
+				}
+				rule.Methods[k] = m
+			}
+			for _, p := range rule.Paths {
+				if err := validatePathPattern(p); err != nil {
+					return fmt.Errorf("route %q: rate limit rule %d: %w", rt.Name, j, err)
+				}
+			}
+		}
+	}
+	return nil
+}
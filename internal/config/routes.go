@@ -0,0 +1,305 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Route describes a single upstream mount. Routes are declared in the file
+// named by ROUTES_FILE (YAML or JSON, which is a subset of YAML); when no file
+// is configured a default set is generated from the *_SERVICE_URL variables.
+type Route struct {
+	Name string `yaml:"name"`
+	// Prefix is the path prefix the route is mounted on, e.g. "/api/core".
+	Prefix string `yaml:"prefix"`
+	// Methods restricts the route to the listed HTTP methods. Empty means any.
+	Methods []string `yaml:"methods"`
+	// Host restricts the route to requests for the given host. A leading
+	// "*." matches any subdomain. Empty means any host.
+	Host string `yaml:"host"`
+	// Upstreams are the backend base URLs, balanced round-robin.
+	Upstreams []string `yaml:"upstreams"`
+	// StripPrefix removes Prefix from the path before proxying. Defaults to true.
+	StripPrefix bool `yaml:"strip_prefix"`
+	// Auth is one of "required" (default), "optional" or "none". Public
+	// sub-paths are declared as separate routes with a longer prefix.
+	Auth string `yaml:"auth"`
+	// IPRules are ordered allow/deny rules on the client address, evaluated
+	// after the global ones.
+	IPRules []IPRule `yaml:"ip_rules"`
+	// Authorize lists role/scope rules evaluated in order; the first rule
+	// matching the request decides.
+	Authorize []AuthzRule `yaml:"authorize"`
+
+	// RateLimit names the rate limit policy of the route; empty selects the
+	// default policy. RateLimitRules override it for matching requests, the
+	// first matching rule winning.
+	RateLimit      string          `yaml:"rate_limit"`
+	RateLimitRules []RateLimitRule `yaml:"rate_limit_rules"`
+	// RateLimitCost weighs the route's requests under every policy.
+	RateLimitCost RateLimitCost `yaml:"rate_limit_cost"`
+	// Quotas names the quotas every request to the route is charged to.
+	Quotas []string `yaml:"quotas"`
+	// Concurrency bounds the requests of the route in flight at once.
+	Concurrency RouteConcurrency `yaml:"concurrency"`
+
+	Cache RouteCache `yaml:"cache"`
+}
+
+// AuthzRule requires any of Roles and all of Scopes for the requests matching
+// Methods and Paths (chi-style patterns on the full request path).
+type AuthzRule struct {
+	Methods []string `yaml:"methods"`
+	Paths   []string `yaml:"paths"`
+	Roles   []string `yaml:"roles"`
+	Scopes  []string `yaml:"scopes"`
+}
+
+// RouteCache holds the per-route response cache settings.
+type RouteCache struct {
+	// Enabled defaults to true.
+	Enabled bool `yaml:"enabled"`
+	// TTL overrides CACHE_TTL for this route when non-zero. Either applies
+	// only to responses without Cache-Control max-age/s-maxage or Expires.
+	TTL time.Duration `yaml:"ttl"`
+	// KeepStale overrides CACHE_KEEP_STALE for this route when non-zero.
+	KeepStale time.Duration `yaml:"keep_stale"`
+	// StaleWhileRevalidate and StaleIfError let stale responses be served
+	// for that long past their freshness while they are refreshed in the
+	// background, and when the upstream fails. Upstream Cache-Control
+	// directives of the same names take precedence.
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"`
+	StaleIfError         time.Duration `yaml:"stale_if_error"`
+	// Scope decides who shares cached responses: "public" (default) skips
+	// requests carrying credentials, "user" and "tenant" partition entries
+	// by principal or tenant.
+	Scope string `yaml:"scope"`
+}
+
+// Cache scopes.
+const (
+	CacheScopePublic = "public"
+	CacheScopeUser   = "user"
+	CacheScopeTenant = "tenant"
+)
+
+// UnmarshalYAML applies route defaults before decoding so that omitted
+// boolean options keep their documented default values.
+func (r *Route) UnmarshalYAML(value *yaml.Node) error {
+	type plain Route
+	p := plain{
+		StripPrefix: true,
+		Auth:        AuthRequired,
+		Cache:       RouteCache{Enabled: true},
+	}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*r = Route(p)
+	return nil
+}
+
+// Route authentication modes.
+const (
+	AuthRequired = "required"
+	AuthOptional = "optional"
+	AuthNone     = "none"
+)
+
+// routesFile is the top-level layout of ROUTES_FILE.
+type routesFile struct {
+	RateLimitPolicies map[string]RateLimitPolicy `yaml:"rate_limit_policies"`
+	Quotas            map[string]Quota           `yaml:"quotas"`
+	IPRules           []IPRule                   `yaml:"ip_rules"`
+	Routes            []Route                    `yaml:"routes"`
+}
+
+func loadRoutesFile(path string) (*routesFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read routes file: %w", err)
+	}
+
+	var f routesFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse routes file %s: %w", path, err)
+	}
+	if len(f.Routes) == 0 {
+		return nil, fmt.Errorf("routes file %s declares no routes", path)
+	}
+	return &f, nil
+}
+
+// defaultRoutes reproduces the historical hard-coded service list from the
+// CORE/AUTH/AI service URL variables. Authentication is optional on these
+// routes, leaving public endpoints to the upstream services as before.
+func defaultRoutes(c *Config) []Route {
+	return []Route{
+		{Name: "core", Prefix: "/api/core", Upstreams: []string{c.CoreServiceURL}, StripPrefix: true, Auth: AuthOptional, Cache: RouteCache{Enabled: true}},
+		{Name: "auth", Prefix: "/api/auth", Upstreams: []string{c.AuthServiceURL}, StripPrefix: true, Auth: AuthOptional, Cache: RouteCache{Enabled: true}},
+		{Name: "ai", Prefix: "/api/ai", Upstreams: []string{c.AiServiceURL}, StripPrefix: true, Auth: AuthOptional, Cache: RouteCache{Enabled: true}},
+	}
+}
+
+var validMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// normalizeRoutes canonicalises prefixes, methods and hosts in place and
+// validates every route.
+func normalizeRoutes(routes []Route) error {
+	seen := make(map[string]string, len(routes))
+	names := make(map[string]bool, len(routes))
+
+	for i := range routes {
+		rt := &routes[i]
+		if rt.Name == "" {
+			rt.Name = fmt.Sprintf("route-%d", i)
+		}
+		// Names key per-route state: cache entries and concurrency slots.
+		if names[rt.Name] {
+			return fmt.Errorf("route %q: duplicate route name", rt.Name)
+		}
+		names[rt.Name] = true
+
+		if !strings.HasPrefix(rt.Prefix, "/") {
+			return fmt.Errorf("route %q: prefix must start with '/'", rt.Name)
+		}
+		if rt.Prefix != "/" {
+			rt.Prefix = strings.TrimRight(rt.Prefix, "/")
+		}
+
+		for j, m := range rt.Methods {
+			m = strings.ToUpper(m)
+			if !validMethods[m] {
+				return fmt.Errorf("route %q: unsupported method %q", rt.Name, rt.Methods[j])
+			}
+			rt.Methods[j] = m
+		}
+
+		rt.Host = strings.ToLower(rt.Host)
+
+		rt.Auth = strings.ToLower(rt.Auth)
+		switch rt.Auth {
+		case AuthRequired, AuthOptional, AuthNone:
+		default:
+			return fmt.Errorf("route %q: auth must be one of required, optional or none", rt.Name)
+		}
+
+		if err := normalizeAuthzRules(rt); err != nil {
+			return err
+		}
+
+		if len(rt.Upstreams) == 0 {
+			return fmt.Errorf("route %q: at least one upstream is required", rt.Name)
+		}
+		for _, raw := range rt.Upstreams {
+			u, err := url.Parse(raw)
+			if err != nil {
+				return fmt.Errorf("route %q: invalid upstream %q: %w", rt.Name, raw, err)
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("route %q: upstream %q must be an absolute http(s) URL", rt.Name, raw)
+			}
+		}
+
+		if rt.Cache.TTL < 0 || rt.Cache.KeepStale < 0 || rt.Cache.StaleWhileRevalidate < 0 || rt.Cache.StaleIfError < 0 {
+			return fmt.Errorf("route %q: cache ttl, keep_stale and stale windows must not be negative", rt.Name)
+		}
+		switch rt.Cache.Scope = strings.ToLower(rt.Cache.Scope); rt.Cache.Scope {
+		case "":
+			rt.Cache.Scope = CacheScopePublic
+		case CacheScopePublic, CacheScopeUser, CacheScopeTenant:
+		default:
+			return fmt.Errorf("route %q: cache scope must be %q, %q or %q", rt.Name, CacheScopePublic, CacheScopeUser, CacheScopeTenant)
+		}
+
+		for _, key := range routeKeys(rt) {
+			if other, ok := seen[key]; ok {
+				return fmt.Errorf("route %q overlaps route %q (same prefix, host and method)", rt.Name, other)
+			}
+			seen[key] = rt.Name
+		}
+	}
+	return nil
+}
+
+func normalizeAuthzRules(rt *Route) error {
+	if len(rt.Authorize) > 0 && rt.Auth == AuthNone {
+		return fmt.Errorf("route %q: authorize rules require auth to be required or optional", rt.Name)
+	}
+	for i := range rt.Authorize {
+		rule := &rt.Authorize[i]
+		if len(rule.Roles) == 0 && len(rule.Scopes) == 0 {
+			return fmt.Errorf("route %q: authorize rule %d must require roles or scopes", rt.Name, i)
+		}
+		for j, m := range rule.Methods {
+			m = strings.ToUpper(m)
+			if !validMethods[m] {
+				return fmt.Errorf("route %q: authorize rule %d: unsupported method %q", rt.Name, i, rule.Methods[j])
+			}
+			rule.Methods[j] = m
+		}
+		for _, p := range rule.Paths {
+			if err := validatePathPattern(p); err != nil {
+				return fmt.Errorf("route %q: authorize rule %d: %w", rt.Name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePathPattern checks a chi-style pattern: it must be absolute, "*" may
+// only be the last segment and "{name:regex}" parameters must compile.
+func validatePathPattern(p string) error {
+	if !strings.HasPrefix(p, "/") {
+		return fmt.Errorf("path pattern %q must start with '/'", p)
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for i, part := range parts {
+		if part == "*" {
+			if i != len(parts)-1 {
+				return fmt.Errorf("path pattern %q: '*' is only allowed as the last segment", p)
+			}
+			continue
+		}
+		if strings.HasPrefix(part, "{") != strings.HasSuffix(part, "}") {
+			return fmt.Errorf("path pattern %q: unbalanced braces in %q", p, part)
+		}
+		if strings.HasPrefix(part, "{") {
+			if _, expr, ok := strings.Cut(part[1:len(part)-1], ":"); ok {
+				if _, err := regexp.Compile(expr); err != nil {
+					return fmt.Errorf("path pattern %q: %w", p, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// routeKeys returns one key per (prefix, host, method) combination served by
+// the route, used to detect ambiguous declarations.
+func routeKeys(rt *Route) []string {
+	methods := rt.Methods
+	if len(methods) == 0 {
+		methods = []string{"*"}
+	}
+	keys := make([]string, 0, len(methods))
+	for _, m := range methods {
+		keys = append(keys, rt.Prefix+"|"+rt.Host+"|"+m)
+	}
+	return keys
+}
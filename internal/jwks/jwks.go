@@ -0,0 +1,251 @@
+// Package jwks resolves JWT verification keys from a JSON Web Key Set endpoint.
+package jwks
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type Config struct {
+	// URL of the JWKS document, e.g. http://auth:8080/.well-known/jwks.json.
+	URL string
+	// RefreshInterval is the maximum age of the cached key set. Once exceeded,
+	// the next lookup triggers a background refresh.
+	RefreshInterval time.Duration
+	// MinRefreshInterval throttles refreshes triggered by unknown key IDs so
+	// that tokens with random "kid" values cannot hammer the auth service. It
+	// applies to failed fetches too, so an outage is not probed per request.
+	MinRefreshInterval time.Duration
+	// RetainRotated is how long a key that disappeared from the document is
+	// still accepted, so tokens signed just before a rotation stay valid.
+	RetainRotated time.Duration
+	// HTTPClient defaults to a client with a 5 s timeout.
+	HTTPClient *http.Client
+}
+
+// Provider caches the keys of a JWKS document and refreshes them on a timer
+// and whenever a token references an unknown key ID.
+type Provider struct {
+	cfg Config
+	log zerolog.Logger
+
+	mu          sync.RWMutex
+	keys        map[string]*cachedKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	attemptErr  error
+	refreshing  bool
+	refreshLock sync.Mutex
+}
+
+type cachedKey struct {
+	key      *rsa.PublicKey
+	lastSeen time.Time
+}
+
+func New(cfg Config, log zerolog.Logger) *Provider {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &Provider{
+		cfg:  cfg,
+		log:  log,
+		keys: make(map[string]*cachedKey),
+	}
+}
+
+// PublicKey returns the RSA key with the given key ID. An empty kid is only
+// accepted when the key set contains exactly one key.
+func (p *Provider) PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.RLock()
+	empty := p.fetchedAt.IsZero()
+	stale := time.Since(p.fetchedAt) > p.cfg.RefreshInterval
+	p.mu.RUnlock()
+
+	if empty {
+		if err := p.refresh(ctx); err != nil {
+			return nil, err
+		}
+	} else if stale {
+		p.refreshInBackground()
+	}
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+
+	// Unknown kid: the signing key may have just been rotated.
+	if err := p.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("jwks: no key found for kid %q", kid)
+}
+
+func (p *Provider) lookup(kid string) (*rsa.PublicKey, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if kid == "" {
+		if len(p.keys) != 1 {
+			return nil, false
+		}
+		for _, k := range p.keys {
+			return k.key, true
+		}
+	}
+
+	k, ok := p.keys[kid]
+	if !ok {
+		return nil, false
+	}
+	return k.key, true
+}
+
+func (p *Provider) refreshInBackground() {
+	p.mu.Lock()
+	if p.refreshing {
+		p.mu.Unlock()
+		return
+	}
+	p.refreshing = true
+	p.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			p.refreshing = false
+			p.mu.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := p.refresh(ctx); err != nil {
+			p.log.Warn().Err(err).Msg("jwks: background refresh failed, keeping cached keys")
+		}
+	}()
+}
+
+// refresh fetches the key set and merges it into the cache. Keys missing from
+// the new document are dropped only after RetainRotated has elapsed. It is a
+// no-op, returning the previous outcome, if another refresh was attempted
+// less than MinRefreshInterval ago.
+func (p *Provider) refresh(ctx context.Context) error {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	p.mu.RLock()
+	recent := !p.attemptedAt.IsZero() && time.Since(p.attemptedAt) < p.cfg.MinRefreshInterval
+	lastErr := p.attemptErr
+	p.mu.RUnlock()
+	if recent {
+		return lastErr
+	}
+
+	keys, err := p.fetch(ctx)
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.attemptedAt, p.attemptErr = now, err
+	if err != nil {
+		return err
+	}
+
+	for kid, key := range keys {
+		p.keys[kid] = &cachedKey{key: key, lastSeen: now}
+	}
+	for kid, k := range p.keys {
+		if _, ok := keys[kid]; !ok && now.Sub(k.lastSeen) > p.cfg.RetainRotated {
+			delete(p.keys, kid)
+			p.log.Info().Str("kid", kid).Msg("jwks: rotated key expired")
+		}
+	}
+	p.fetchedAt = now
+
+	p.log.Debug().Int("keys", len(p.keys)).Msg("jwks: key set refreshed")
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (p *Provider) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: fetch %s: %w", p.cfg.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: fetch %s: unexpected status %d", p.cfg.URL, resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("jwks: decode document: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(doc.Keys))
+	for _, jwk := range doc.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := parseRSAKey(jwk)
+		if err != nil {
+			p.log.Warn().Err(err).Str("kid", jwk.Kid).Msg("jwks: skipping invalid key")
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks: document at %s contains no usable RSA signing keys", p.cfg.URL)
+	}
+	return keys, nil
+}
+
+func parseRSAKey(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("decode modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("decode exponent: %w", err)
+	}
+	if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("invalid modulus or exponent length")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
@@ -0,0 +1,229 @@
+package jwks_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/jwks"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jwksServer serves a mutable key set and counts how often it is fetched.
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetches atomic.Int32
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: make(map[string]*rsa.PublicKey)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		doc := map[string][]map[string]string{"keys": {}}
+		for kid, key := range s.keys {
+			doc["keys"] = append(doc["keys"], map[string]string{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) setKeys(keys map[string]*rsa.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func generateKey(t *testing.T) *rsa.PublicKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return &key.PublicKey
+}
+
+func newProvider(url string, cfg jwks.Config) *jwks.Provider {
+	cfg.URL = url
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = time.Hour
+	}
+	return jwks.New(cfg, zerolog.Nop())
+}
+
+func TestProvider_SelectsKeyByKid(t *testing.T) {
+	srv := newJWKSServer(t)
+	k1, k2 := generateKey(t), generateKey(t)
+	srv.setKeys(map[string]*rsa.PublicKey{"k1": k1, "k2": k2})
+
+	p := newProvider(srv.URL, jwks.Config{})
+
+	got, err := p.PublicKey(context.Background(), "k2")
+	require.NoError(t, err)
+	assert.True(t, k2.Equal(got))
+
+	got, err = p.PublicKey(context.Background(), "k1")
+	require.NoError(t, err)
+	assert.True(t, k1.Equal(got))
+
+	assert.Equal(t, int32(1), srv.fetches.Load(), "known kids must be served from cache")
+}
+
+func TestProvider_EmptyKid_SingleKey(t *testing.T) {
+	srv := newJWKSServer(t)
+	k1 := generateKey(t)
+	srv.setKeys(map[string]*rsa.PublicKey{"k1": k1})
+
+	p := newProvider(srv.URL, jwks.Config{})
+
+	got, err := p.PublicKey(context.Background(), "")
+	require.NoError(t, err)
+	assert.True(t, k1.Equal(got))
+}
+
+func TestProvider_EmptyKid_MultipleKeys_ReturnsError(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.setKeys(map[string]*rsa.PublicKey{"k1": generateKey(t), "k2": generateKey(t)})
+
+	p := newProvider(srv.URL, jwks.Config{})
+
+	_, err := p.PublicKey(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func TestProvider_UnknownKid_RefreshesKeySet(t *testing.T) {
+	srv := newJWKSServer(t)
+	oldKey, newKey := generateKey(t), generateKey(t)
+	srv.setKeys(map[string]*rsa.PublicKey{"old": oldKey})
+
+	p := newProvider(srv.URL, jwks.Config{})
+	_, err := p.PublicKey(context.Background(), "old")
+	require.NoError(t, err)
+
+	// The auth service rotates its signing key.
+	srv.setKeys(map[string]*rsa.PublicKey{"new": newKey})
+
+	got, err := p.PublicKey(context.Background(), "new")
+	require.NoError(t, err)
+	assert.True(t, newKey.Equal(got))
+	assert.Equal(t, int32(2), srv.fetches.Load())
+}
+
+func TestProvider_RotatedKey_AcceptedDuringRetention(t *testing.T) {
+	srv := newJWKSServer(t)
+	oldKey, newKey := generateKey(t), generateKey(t)
+	srv.setKeys(map[string]*rsa.PublicKey{"old": oldKey})
+
+	p := newProvider(srv.URL, jwks.Config{RetainRotated: time.Hour})
+	_, err := p.PublicKey(context.Background(), "old")
+	require.NoError(t, err)
+
+	srv.setKeys(map[string]*rsa.PublicKey{"new": newKey})
+	_, err = p.PublicKey(context.Background(), "new")
+	require.NoError(t, err)
+
+	got, err := p.PublicKey(context.Background(), "old")
+	require.NoError(t, err, "previous key must still verify tokens issued before rotation")
+	assert.True(t, oldKey.Equal(got))
+}
+
+func TestProvider_RotatedKey_DroppedAfterRetention(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.setKeys(map[string]*rsa.PublicKey{"old": generateKey(t)})
+
+	p := newProvider(srv.URL, jwks.Config{RetainRotated: 20 * time.Millisecond})
+	_, err := p.PublicKey(context.Background(), "old")
+	require.NoError(t, err)
+
+	srv.setKeys(map[string]*rsa.PublicKey{"new": generateKey(t)})
+	time.Sleep(40 * time.Millisecond)
+
+	_, err = p.PublicKey(context.Background(), "new")
+	require.NoError(t, err)
+
+	_, err = p.PublicKey(context.Background(), "old")
+	assert.Error(t, err)
+}
+
+func TestProvider_UnknownKid_ThrottledByMinRefreshInterval(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.setKeys(map[string]*rsa.PublicKey{"k1": generateKey(t)})
+
+	p := newProvider(srv.URL, jwks.Config{MinRefreshInterval: time.Hour})
+
+	for _, kid := range []string{"k1", "bogus-1", "bogus-2", "bogus-3"} {
+		_, _ = p.PublicKey(context.Background(), kid)
+	}
+
+	assert.Equal(t, int32(1), srv.fetches.Load(), "unknown kids must not trigger a fetch per request")
+}
+
+func TestProvider_StaleKeySet_RefreshesInBackground(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.setKeys(map[string]*rsa.PublicKey{"k1": generateKey(t)})
+
+	p := newProvider(srv.URL, jwks.Config{RefreshInterval: 10 * time.Millisecond})
+	_, err := p.PublicKey(context.Background(), "k1")
+	require.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	_, err = p.PublicKey(context.Background(), "k1")
+	require.NoError(t, err, "stale keys are served while the refresh runs")
+
+	assert.Eventually(t, func() bool { return srv.fetches.Load() == 2 }, time.Second, 5*time.Millisecond)
+}
+
+func TestProvider_ServerError_ReturnsError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	p := newProvider(srv.URL, jwks.Config{})
+
+	_, err := p.PublicKey(context.Background(), "k1")
+	assert.Error(t, err)
+}
+
+func TestProvider_FailingEndpoint_ThrottledByMinRefreshInterval(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	p := newProvider(srv.URL, jwks.Config{MinRefreshInterval: time.Hour})
+
+	for i := range 20 {
+		_, err := p.PublicKey(context.Background(), "kid-"+strconv.Itoa(i))
+		assert.Error(t, err)
+	}
+
+	assert.Equal(t, int32(1), fetches.Load(), "a failing endpoint must not be fetched per request")
+}
@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// APIKey is the identity attached to an API key.
+type APIKey struct {
+	// Owner becomes the principal's subject and the X-User-Id header.
+	Owner  string   `json:"owner" yaml:"owner"`
+	Roles  []string `json:"roles,omitempty" yaml:"roles"`
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes"`
+	// Tier names the rate-limit tier applied to requests made with the key.
+	Tier string `json:"tier,omitempty" yaml:"tier"`
+}
+
+// HashAPIKey returns the hex encoded SHA-256 of a raw key, the form under
+// which keys are stored. Raw keys are never persisted.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type APIKeyConfig struct {
+	// Mode AuthNone only strips the key from the request.
+	Mode AuthMode
+	// Header carrying the key, e.g. "X-API-Key". Empty disables it.
+	Header string
+	// QueryParam carrying the key, e.g. "api_key". Empty disables it.
+	QueryParam string
+
+	// Claims and ClaimHeaders mirror JWTConfig so that the upstream receives
+	// the same headers whichever method authenticated the request.
+	Claims              ClaimNames
+	ClaimHeaders        []ClaimHeader
+	MaxClaimHeaderBytes int
+}
+
+// APIKeyAuth returns a middleware that authenticates machine clients by API
+// key, read from the configured header or query parameter. It runs before
+// JWTAuth, which skips requests that already carry a Principal.
+//
+// Behavior:
+//   - The key is always removed from the request before it is proxied.
+//   - No key → the request continues to JWTAuth unchanged.
+//   - Unknown key → 401 invalid_api_key.
+//   - Known key → a Principal built from the key's owner, roles, scopes and
+//     tier is stored in the request context, and "X-User-Id" plus the
+//     configured claim headers are set as for a JWT.
+func APIKeyAuth(store APIKeyStore, cfg APIKeyConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := takeAPIKey(r, cfg.Header, cfg.QueryParam)
+			if key == "" || cfg.Mode == AuthNone {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+			defer cancel()
+
+			hash := HashAPIKey(key)
+			apiKey, found, err := store.LookupAPIKey(ctx, hash)
+			if err != nil {
+				log.Error().Err(err).Msg("api key: store error")
+				errors.WriteJSON(w, http.StatusServiceUnavailable, errors.ErrUnavailable)
+				return
+			}
+			if !found || apiKey.Owner == "" {
+				log.Warn().Str("path", r.URL.Path).Msg("api key: unknown key")
+				errors.WriteJSON(w, http.StatusUnauthorized, errors.ErrInvalidAPIKey)
+				return
+			}
+
+			claims := apiKeyClaims(apiKey, cfg.Claims)
+			principal := &Principal{
+				Subject: apiKey.Owner,
+				Roles:   apiKey.Roles,
+				Scopes:  apiKey.Scopes,
+				Method:  AuthMethodAPIKey,
+				Tier:    apiKey.Tier,
+				TokenID: hash,
+				Claims:  claims,
+			}
+			r = r.WithContext(withPrincipal(r.Context(), principal))
+
+			r.Header.Set("X-User-Id", apiKey.Owner)
+			setClaimHeaders(r, claims, cfg.ClaimHeaders, cfg.MaxClaimHeaderBytes, log)
+
+			log.Debug().Str("sub", apiKey.Owner).Msg("api key: successfully authenticated")
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// takeAPIKey returns the API key sent with r and removes it from the request.
+// The header takes precedence over the query parameter.
+func takeAPIKey(r *http.Request, header, param string) string {
+	var key string
+	if header != "" {
+		key = strings.TrimSpace(r.Header.Get(header))
+		r.Header.Del(header)
+	}
+	if param != "" {
+		if value, ok := removeQueryParam(r.URL, param); ok && key == "" {
+			key = value
+		}
+	}
+	return key
+}
+
+// removeQueryParam removes every occurrence of param from u's query and
+// returns the first one's value. The rest of the query is left byte for
+// byte, so that its order and escaping reach the upstream as sent.
+func removeQueryParam(u *url.URL, param string) (string, bool) {
+	if u.RawQuery == "" {
+		return "", false
+	}
+	var (
+		value string
+		found bool
+		kept  []string
+	)
+	for pair := range strings.SplitSeq(u.RawQuery, "&") {
+		name, v, _ := strings.Cut(pair, "=")
+		if n, err := url.QueryUnescape(name); err != nil || n != param {
+			kept = append(kept, pair)
+			continue
+		}
+		if !found {
+			value, _ = url.QueryUnescape(v)
+			found = true
+		}
+	}
+	if found {
+		u.RawQuery = strings.Join(kept, "&")
+	}
+	return value, found
+}
+
+// apiKeyClaims synthesises the claims a JWT for the key's owner would carry,
+// so that claim-to-header mappings apply unchanged.
+func apiKeyClaims(k APIKey, names ClaimNames) map[string]any {
+	claims := map[string]any{"sub": k.Owner}
+	if len(k.Roles) > 0 {
+		setClaim(claims, names.Roles, toAnySlice(k.Roles))
+	}
+	if len(k.Scopes) > 0 {
+		setClaim(claims, names.Scopes, strings.Join(k.Scopes, " "))
+	}
+	return claims
+}
+
+// setClaim stores v at a dot-separated path, creating intermediate objects.
+func setClaim(claims map[string]any, path string, v any) {
+	if path == "" {
+		return
+	}
+	parts := strings.Split(path, ".")
+	m := claims
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := m[part].(map[string]any)
+		if !ok {
+			child = make(map[string]any)
+			m[part] = child
+		}
+		m = child
+	}
+	m[parts[len(parts)-1]] = v
+}
+
+func toAnySlice(s []string) []any {
+	out := make([]any, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,175 @@
+package middleware_test
+
+import (
+	"context"
+	stderrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockAPIKeyStore struct {
+	keys map[string]mw.APIKey
+	err  error
+}
+
+func (m *mockAPIKeyStore) LookupAPIKey(_ context.Context, hash string) (mw.APIKey, bool, error) {
+	k, ok := m.keys[hash]
+	return k, ok, m.err
+}
+
+var testAPIKeyConfig = mw.APIKeyConfig{
+	Mode:         mw.AuthRequired,
+	Header:       "X-API-Key",
+	QueryParam:   "api_key",
+	Claims:       testClaimNames,
+	ClaimHeaders: []mw.ClaimHeader{{Claim: "scope", Header: "X-User-Scopes"}, {Claim: "roles", Header: "X-User-Roles"}},
+}
+
+func newAPIKeyStore() *mockAPIKeyStore {
+	return &mockAPIKeyStore{keys: map[string]mw.APIKey{
+		mw.HashAPIKey("secret-key"): {
+			Owner:  "judge-worker-1",
+			Roles:  []string{"worker"},
+			Scopes: []string{"submissions:read", "submissions:write"},
+			Tier:   "internal",
+		},
+	}}
+}
+
+func TestHashAPIKey(t *testing.T) {
+	assert.Equal(t, "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", mw.HashAPIKey("secret"))
+}
+
+func TestAPIKeyAuth_ValidKey(t *testing.T) {
+	for name, setKey := range map[string]func(*http.Request){
+		"header": func(r *http.Request) { r.Header.Set("X-API-Key", "secret-key") },
+		"query":  func(r *http.Request) { r.URL.RawQuery = "page=2&api_key=secret-key" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			var principal *mw.Principal
+			var got *http.Request
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				principal, _ = mw.PrincipalFrom(r.Context())
+				got = r
+				w.WriteHeader(http.StatusOK)
+			})
+			handler := mw.APIKeyAuth(newAPIKeyStore(), testAPIKeyConfig, zerolog.Nop())(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			setKey(req)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			require.NotNil(t, principal)
+			assert.Equal(t, "judge-worker-1", principal.Subject)
+			assert.Equal(t, mw.AuthMethodAPIKey, principal.Method)
+			assert.Equal(t, "internal", principal.Tier)
+			assert.Equal(t, []string{"submissions:read", "submissions:write"}, principal.Scopes)
+
+			assert.Equal(t, "judge-worker-1", got.Header.Get("X-User-Id"))
+			assert.Equal(t, "submissions:read submissions:write", got.Header.Get("X-User-Scopes"))
+			assert.Equal(t, "worker", got.Header.Get("X-User-Roles"))
+			assert.Empty(t, got.Header.Get("X-API-Key"), "the key must not reach the upstream")
+			assert.False(t, got.URL.Query().Has("api_key"), "the key must not reach the upstream")
+		})
+	}
+}
+
+func TestAPIKeyAuth_QueryKeyRemovedInPlace(t *testing.T) {
+	var got *http.Request
+	handler := mw.APIKeyAuth(newAPIKeyStore(), testAPIKeyConfig, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/?z=1&api_key=secret-key&a=%2F&b=2&api%5Fkey=other", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, got)
+	assert.Equal(t, "z=1&a=%2F&b=2", got.URL.RawQuery, "the rest of the query must reach the upstream as sent")
+	assert.Equal(t, "judge-worker-1", got.Header.Get("X-User-Id"))
+}
+
+func TestAPIKeyAuth_UnknownKey(t *testing.T) {
+	handler := mw.APIKeyAuth(newAPIKeyStore(), testAPIKeyConfig, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("next must not be called")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "wrong")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"invalid_api_key"`)
+}
+
+func TestAPIKeyAuth_NoKey_PassesThrough(t *testing.T) {
+	found := true
+	handler := mw.APIKeyAuth(newAPIKeyStore(), testAPIKeyConfig, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, found = mw.PrincipalFrom(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.False(t, found)
+}
+
+func TestAPIKeyAuth_ModeNone_StripsWithoutAuthenticating(t *testing.T) {
+	cfg := testAPIKeyConfig
+	cfg.Mode = mw.AuthNone
+
+	var got *http.Request
+	handler := mw.APIKeyAuth(newAPIKeyStore(), cfg, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/?api_key=wrong", nil)
+	req.Header.Set("X-API-Key", "wrong")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, got)
+	assert.Empty(t, got.Header.Get("X-API-Key"))
+	assert.Empty(t, got.URL.RawQuery)
+	assert.Empty(t, got.Header.Get("X-User-Id"))
+}
+
+func TestAPIKeyAuth_StoreError(t *testing.T) {
+	store := newAPIKeyStore()
+	store.err = stderrors.New("redis down")
+	handler := mw.APIKeyAuth(store, testAPIKeyConfig, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("next must not be called")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "secret-key")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestJWTAuth_SkipsWhenAlreadyAuthenticated(t *testing.T) {
+	key := generateRSAKey(t)
+	chain := mw.APIKeyAuth(newAPIKeyStore(), testAPIKeyConfig, zerolog.Nop())(
+		mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{Mode: mw.AuthRequired}, zerolog.Nop())(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "secret-key")
+	rr := httptest.NewRecorder()
+	chain.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "a required route accepts an API key instead of a token")
+}
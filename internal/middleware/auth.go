@@ -4,9 +4,14 @@ package middleware
 import (
 	"context"
 	"crypto/rsa"
+	stderrors "errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
+
+	"github.com/FPT-OJT/gateway/pkg/errors"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog"
@@ -15,28 +20,110 @@ import (
 // UserContextKey is used to store the authenticated user ID in the request context.
 type UserContextKey struct{}
 
-// JWTAuth returns a middleware that verifies RS256 JWTs in the Authorization
-// header using the provided RSA public key.
+// KeyProvider resolves the RSA public key that verifies a token, selected by
+// the "kid" header of the token (empty when the token carries none).
+type KeyProvider interface {
+	PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error)
+}
+
+type staticKey struct {
+	key *rsa.PublicKey
+}
+
+// StaticKey returns a KeyProvider that verifies every token with key,
+// regardless of its "kid" header.
+func StaticKey(key *rsa.PublicKey) KeyProvider {
+	return staticKey{key: key}
+}
+
+func (s staticKey) PublicKey(context.Context, string) (*rsa.PublicKey, error) {
+	return s.key, nil
+}
+
+// AuthMode controls whether a route requires a token.
+type AuthMode string
+
+const (
+	// AuthRequired rejects requests without a valid token.
+	AuthRequired AuthMode = "required"
+	// AuthOptional verifies a token when one is sent and lets anonymous
+	// requests through. This is the default for an empty mode.
+	AuthOptional AuthMode = "optional"
+	// AuthNone skips token verification entirely.
+	AuthNone AuthMode = "none"
+)
+
+// JWTConfig holds the token validation rules applied by JWTAuth.
+type JWTConfig struct {
+	Mode AuthMode
+
+	// Issuers lists the accepted "iss" values. Empty disables the check.
+	Issuers []string
+	// Audiences lists accepted "aud" values; a token must carry at least one.
+	// Empty disables the check.
+	Audiences []string
+	// Algorithms lists the accepted "alg" header values. Defaults to RS256.
+	Algorithms []string
+	// Leeway tolerates clock drift when checking exp, nbf and iat.
+	Leeway time.Duration
+
+	// Claims names the claims that populate the Principal.
+	Claims ClaimNames
+	// ClaimHeaders forwards additional claims to the upstream.
+	ClaimHeaders []ClaimHeader
+	// MaxClaimHeaderBytes drops forwarded claim values larger than this.
+	// Zero means no limit.
+	MaxClaimHeaderBytes int
+}
+
+// JWTAuth returns a middleware that verifies RSA-signed JWTs in the
+// Authorization header using keys resolved through the provided KeyProvider.
 //
 // Behavior:
-//   - If NO Authorization header is present, it allows the request through
-//     unauthenticated (upstream services handle public routes).
-//   - If a Bearer token IS present, it must be valid and unexpired.
-//   - If invalid, returns 401 Unauthorized immediately.
-//   - If valid, extracts the "sub" claim, injects it into the request context,
-//     and adds the "X-User-Id" HTTP header for upstream services.
-func JWTAuth(pubKey *rsa.PublicKey, log zerolog.Logger) func(http.Handler) http.Handler {
+//   - In AuthNone mode, or when the request already carries a Principal, it
+//     is passed through without inspection.
+//   - If NO Authorization header is present, AuthRequired returns 401 and
+//     AuthOptional allows the request through unauthenticated.
+//   - If a Bearer token IS present, it must be valid and unexpired, signed with
+//     an allowed algorithm, and match the configured issuers and audiences.
+//   - If invalid, returns 401 with a code describing the failure
+//     (token_expired, invalid_issuer, invalid_audience, invalid_signature or
+//     invalid_token).
+//   - If valid, stores a Principal built from the claims in the request
+//     context, and adds the "X-User-Id" header plus any configured claim
+//     headers for upstream services.
+func JWTAuth(keys KeyProvider, cfg JWTConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	algorithms := cfg.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{jwt.SigningMethodRS256.Alg()}
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(algorithms),
+		jwt.WithLeeway(cfg.Leeway),
+	)
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Skip authentication for public routes
-			if strings.Contains(r.URL.Path, "/public") {
-				log.Debug().Str("path", r.URL.Path).Msg("auth: public route, skipping authentication")
+			if cfg.Mode == AuthNone {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Already authenticated by an earlier method, e.g. an API key.
+			if _, ok := PrincipalFrom(r.Context()); ok {
 				next.ServeHTTP(w, r)
 				return
 			}
 
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
+				if cfg.Mode == AuthRequired {
+					log.Debug().Str("path", r.URL.Path).Msg("auth: no authorization header on protected route")
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					errors.WriteJSON(w, http.StatusUnauthorized, errors.ErrUnauthorized)
+					return
+				}
 				log.Debug().Msg("auth: no authorization header, proceeding unauthenticated")
 				next.ServeHTTP(w, r)
 				return
@@ -51,41 +138,69 @@ func JWTAuth(pubKey *rsa.PublicKey, log zerolog.Logger) func(http.Handler) http.
 				tokenStr = parts[0]
 			} else {
 				log.Warn().Str("header", authHeader).Msg("auth: malformed authorization header")
-				sendUnauthorized(w, "Malformed Authorization header. Expected 'Bearer <token>' or '<token>'")
+				sendUnauthorized(w, errors.ErrorResponse{
+					Code:    errors.ErrUnauthorized.Code,
+					Message: "Malformed Authorization header. Expected 'Bearer <token>' or '<token>'",
+				})
 				return
 			}
 
-			token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			token, err := parser.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+				switch token.Method.(type) {
+				case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+				default:
 					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 				}
-				return pubKey, nil
+				kid, _ := token.Header["kid"].(string)
+				return keys.PublicKey(r.Context(), kid)
 			})
 
 			if err != nil || !token.Valid {
 				log.Warn().Err(err).Msg("auth: invalid or expired token")
-				sendUnauthorized(w, "Invalid or expired token")
+				sendUnauthorized(w, tokenError(err))
 				return
 			}
 
 			claims, ok := token.Claims.(jwt.MapClaims)
 			if !ok {
 				log.Error().Msg("auth: failed to extract claims from valid token")
-				sendUnauthorized(w, "Invalid token claims")
+				sendUnauthorized(w, errors.ErrInvalidToken)
 				return
 			}
 
+			if len(cfg.Issuers) > 0 {
+				iss, _ := claims.GetIssuer()
+				if !slices.Contains(cfg.Issuers, iss) {
+					log.Warn().Str("iss", iss).Msg("auth: token issuer not accepted")
+					sendUnauthorized(w, errors.ErrInvalidIssuer)
+					return
+				}
+			}
+
+			if len(cfg.Audiences) > 0 {
+				aud, _ := claims.GetAudience()
+				if !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(cfg.Audiences, a) }) {
+					log.Warn().Strs("aud", aud).Msg("auth: token audience not accepted")
+					sendUnauthorized(w, errors.ErrInvalidAudience)
+					return
+				}
+			}
+
 			sub, err := claims.GetSubject()
 			if err != nil || sub == "" {
 				log.Warn().Msg("auth: token missing 'sub' claim")
-				sendUnauthorized(w, "Token is missing subject (sub) claim")
+				sendUnauthorized(w, errors.ErrorResponse{
+					Code:    errors.ErrInvalidToken.Code,
+					Message: "Token is missing subject (sub) claim",
+				})
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), UserContextKey{}, sub)
-			r = r.WithContext(ctx)
+			principal := newPrincipal(sub, claims, cfg.Claims)
+			r = r.WithContext(withPrincipal(r.Context(), principal))
 
 			r.Header.Set("X-User-Id", sub)
+			setClaimHeaders(r, claims, cfg.ClaimHeaders, cfg.MaxClaimHeaderBytes, log)
 
 			log.Debug().Str("sub", sub).Msg("auth: successfully authenticated")
 
@@ -94,9 +209,25 @@ func JWTAuth(pubKey *rsa.PublicKey, log zerolog.Logger) func(http.Handler) http.
 	}
 }
 
-// sendUnauthorized writes a 401 JSON response.
-func sendUnauthorized(w http.ResponseWriter, message string) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusUnauthorized)
-	fmt.Fprintf(w, `{"code":"unauthorized","message":%q}`, message)
+// tokenError maps a jwt validation error to the response sent to the client.
+// A token is unverifiable when no key could be resolved for it, e.g. an
+// unknown kid or an unreachable JWKS endpoint, which says nothing about its
+// signature.
+func tokenError(err error) errors.ErrorResponse {
+	switch {
+	case stderrors.Is(err, jwt.ErrTokenExpired):
+		return errors.ErrTokenExpired
+	case stderrors.Is(err, jwt.ErrTokenUnverifiable):
+		return errors.ErrUnverifiableToken
+	case stderrors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return errors.ErrInvalidSignature
+	default:
+		return errors.ErrInvalidToken
+	}
+}
+
+// sendUnauthorized writes a 401 JSON response with an RFC 6750 challenge.
+func sendUnauthorized(w http.ResponseWriter, resp errors.ErrorResponse) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, resp.Message))
+	errors.WriteJSON(w, http.StatusUnauthorized, resp)
 }
@@ -1,8 +1,10 @@
 package middleware_test
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -45,7 +47,7 @@ func TestJWTAuth_NoAuthHeader_PassesThrough(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	handler := mw.JWTAuth(&key.PublicKey, log)(next)
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{}, log)(next)
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, req)
@@ -64,7 +66,7 @@ func TestJWTAuth_ValidToken_SetsXUserIdHeader(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	handler := mw.JWTAuth(&key.PublicKey, log)(next)
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{}, log)(next)
 	tokenStr := signToken(t, key, "user-42", time.Now().Add(time.Hour))
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -88,7 +90,7 @@ func TestJWTAuth_ValidToken_InjectsSubjectIntoContext(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	handler := mw.JWTAuth(&key.PublicKey, log)(next)
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{}, log)(next)
 	tokenStr := signToken(t, key, "ctx-user", time.Now().Add(time.Hour))
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -107,7 +109,7 @@ func TestJWTAuth_ExpiredToken_Returns401(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	handler := mw.JWTAuth(&key.PublicKey, log)(next)
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{}, log)(next)
 	tokenStr := signToken(t, key, "user-expired", time.Now().Add(-time.Hour))
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -116,7 +118,7 @@ func TestJWTAuth_ExpiredToken_Returns401(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusUnauthorized, rr.Code)
-	assert.Contains(t, rr.Body.String(), "unauthorized")
+	assert.Contains(t, rr.Body.String(), "token_expired")
 }
 
 func TestJWTAuth_MalformedHeader_Returns401(t *testing.T) {
@@ -127,7 +129,7 @@ func TestJWTAuth_MalformedHeader_Returns401(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	handler := mw.JWTAuth(&key.PublicKey, log)(next)
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{}, log)(next)
 
 	for _, badHeader := range []string{"Bearer", "Token abc123", "justtoken"} {
 		req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -148,7 +150,7 @@ func TestJWTAuth_WrongSigningKey_Returns401(t *testing.T) {
 	})
 
 	// Token signed with wrongKey but verified against rightKey's public key
-	handler := mw.JWTAuth(&rightKey.PublicKey, log)(next)
+	handler := mw.JWTAuth(mw.StaticKey(&rightKey.PublicKey), mw.JWTConfig{}, log)(next)
 	tokenStr := signToken(t, wrongKey, "user-99", time.Now().Add(time.Hour))
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -169,7 +171,7 @@ func TestJWTAuth_BearerCaseInsensitive_Succeeds(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	handler := mw.JWTAuth(&key.PublicKey, log)(next)
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{}, log)(next)
 	tokenStr := signToken(t, key, "user-1", time.Now().Add(time.Hour))
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -180,3 +182,224 @@ func TestJWTAuth_BearerCaseInsensitive_Succeeds(t *testing.T) {
 	assert.True(t, nextCalled)
 	assert.Equal(t, http.StatusOK, rr.Code)
 }
+
+// keyMap is a KeyProvider that resolves keys by the token's "kid" header.
+type keyMap map[string]*rsa.PublicKey
+
+func (m keyMap) PublicKey(_ context.Context, kid string) (*rsa.PublicKey, error) {
+	if key, ok := m[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown kid")
+}
+
+func signTokenWithKid(t *testing.T, key *rsa.PrivateKey, kid, subject string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": subject,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestJWTAuth_KeyProvider_SelectsKeyByKid(t *testing.T) {
+	oldKey := generateRSAKey(t)
+	newKey := generateRSAKey(t)
+	log := zerolog.Nop()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := mw.JWTAuth(keyMap{"old": &oldKey.PublicKey, "new": &newKey.PublicKey}, mw.JWTConfig{}, log)(next)
+
+	for _, tc := range []struct {
+		kid  string
+		key  *rsa.PrivateKey
+		want int
+	}{
+		{"old", oldKey, http.StatusOK},
+		{"new", newKey, http.StatusOK},
+		{"old", newKey, http.StatusUnauthorized},
+		{"missing", newKey, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+signTokenWithKid(t, tc.key, tc.kid, "user-1"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, tc.want, rr.Code, "kid %s", tc.kid)
+	}
+}
+
+// failingKeys is a KeyProvider whose key source is unreachable.
+type failingKeys struct{}
+
+func (failingKeys) PublicKey(context.Context, string) (*rsa.PublicKey, error) {
+	return nil, errors.New("jwks: fetch: connection refused")
+}
+
+func TestJWTAuth_KeyProviderError_IsNotABadSignature(t *testing.T) {
+	key := generateRSAKey(t)
+	handler := mw.JWTAuth(failingKeys{}, mw.JWTConfig{}, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+signTokenWithKid(t, key, "k1", "user-1"))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"unverifiable_token"`)
+}
+
+func signClaims(t *testing.T, key *rsa.PrivateKey, method jwt.SigningMethod, claims jwt.MapClaims) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestJWTAuth_ValidationRules_DistinctErrorCodes(t *testing.T) {
+	key := generateRSAKey(t)
+	otherKey := generateRSAKey(t)
+	log := zerolog.Nop()
+
+	cfg := mw.JWTConfig{
+		Issuers:    []string{"https://auth.fpt-ojt.dev", "https://auth-legacy.fpt-ojt.dev"},
+		Audiences:  []string{"gateway"},
+		Algorithms: []string{"RS256", "PS256"},
+		Leeway:     30 * time.Second,
+	}
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "user-1",
+			"iss": "https://auth.fpt-ojt.dev",
+			"aud": []string{"gateway", "core"},
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	with := func(k string, v any) jwt.MapClaims {
+		c := valid()
+		c[k] = v
+		return c
+	}
+	without := func(k string) jwt.MapClaims {
+		c := valid()
+		delete(c, k)
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		key      *rsa.PrivateKey
+		method   jwt.SigningMethod
+		claims   jwt.MapClaims
+		wantCode int
+		wantBody string
+	}{
+		{"valid", key, jwt.SigningMethodRS256, valid(), http.StatusOK, ""},
+		{"second accepted issuer", key, jwt.SigningMethodRS256, with("iss", "https://auth-legacy.fpt-ojt.dev"), http.StatusOK, ""},
+		{"allowed PS256", key, jwt.SigningMethodPS256, valid(), http.StatusOK, ""},
+		{"expired within leeway", key, jwt.SigningMethodRS256, with("exp", time.Now().Add(-10*time.Second).Unix()), http.StatusOK, ""},
+		{"expired beyond leeway", key, jwt.SigningMethodRS256, with("exp", time.Now().Add(-time.Minute).Unix()), http.StatusUnauthorized, "token_expired"},
+		{"wrong audience", key, jwt.SigningMethodRS256, with("aud", "billing"), http.StatusUnauthorized, "invalid_audience"},
+		{"missing audience", key, jwt.SigningMethodRS256, without("aud"), http.StatusUnauthorized, "invalid_audience"},
+		{"wrong issuer", key, jwt.SigningMethodRS256, with("iss", "https://evil.example"), http.StatusUnauthorized, "invalid_issuer"},
+		{"bad signature", otherKey, jwt.SigningMethodRS256, valid(), http.StatusUnauthorized, "invalid_signature"},
+		{"disallowed algorithm", key, jwt.SigningMethodRS512, valid(), http.StatusUnauthorized, "invalid_signature"},
+		{"not yet valid", key, jwt.SigningMethodRS256, with("nbf", time.Now().Add(time.Hour).Unix()), http.StatusUnauthorized, "invalid_token"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), cfg, log)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+signClaims(t, tc.key, tc.method, tc.claims))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.wantCode, rr.Code)
+			if tc.wantBody != "" {
+				assert.Contains(t, rr.Body.String(), `"code":"`+tc.wantBody+`"`)
+				assert.Equal(t, "application/json; charset=utf-8", rr.Header().Get("Content-Type"))
+				assert.Contains(t, rr.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
+
+func TestJWTAuth_Modes(t *testing.T) {
+	key := generateRSAKey(t)
+	log := zerolog.Nop()
+	valid := signToken(t, key, "user-1", time.Now().Add(time.Hour))
+
+	tests := []struct {
+		mode  mw.AuthMode
+		token string
+		want  int
+	}{
+		{mw.AuthRequired, "", http.StatusUnauthorized},
+		{mw.AuthRequired, valid, http.StatusOK},
+		{mw.AuthRequired, "garbage", http.StatusUnauthorized},
+		{mw.AuthOptional, "", http.StatusOK},
+		{mw.AuthOptional, valid, http.StatusOK},
+		{mw.AuthOptional, "garbage", http.StatusUnauthorized},
+		{mw.AuthNone, "", http.StatusOK},
+		{mw.AuthNone, "garbage", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{Mode: tc.mode}, log)(next)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/core/problems", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, tc.want, rr.Code, "mode=%s token=%t", tc.mode, tc.token != "")
+	}
+}
+
+func TestJWTAuth_Required_NoToken_ReturnsUnauthorizedJSON(t *testing.T) {
+	key := generateRSAKey(t)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("next must not be called")
+	})
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{Mode: mw.AuthRequired}, zerolog.Nop())(next)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, rr.Body.String(), `"code":"unauthorized"`)
+}
+
+func TestJWTAuth_PublicSubstring_IsNotSpecial(t *testing.T) {
+	key := generateRSAKey(t)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{Mode: mw.AuthRequired}, zerolog.Nop())(next)
+
+	for _, path := range []string{"/api/core/publications", "/api/core/public/problems"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, path)
+	}
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// AuthzRule restricts the requests it matches to principals holding the
+// required roles and scopes.
+type AuthzRule struct {
+	// Methods the rule applies to. Empty matches every method.
+	Methods []string
+	// Paths are chi-style patterns matched against the full request path,
+	// e.g. "/api/core/problems/{id}" or "/api/core/admin/*". Empty matches
+	// every path.
+	Paths []string
+	// Roles: the principal must hold at least one of them.
+	Roles []string
+	// Scopes: the principal must hold all of them.
+	Scopes []string
+}
+
+// Authorize returns a middleware that evaluates rules against the Principal
+// stored by JWTAuth. The first rule matching the request's method and path
+// decides; requests matching no rule are allowed.
+//
+//   - No principal → 401 unauthorized.
+//   - Missing role or scope → 403 forbidden.
+func Authorize(rules []AuthzRule, log zerolog.Logger) func(http.Handler) http.Handler {
+	matchers := make([]requestMatcher, 0, len(rules))
+	for _, rule := range rules {
+		matchers = append(matchers, newRequestMatcher(rule.Methods, rule.Paths, "authorize", log))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			i := firstMatch(matchers, r)
+			if i < 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rule := rules[i]
+
+			principal, ok := PrincipalFrom(r.Context())
+			if !ok {
+				log.Debug().Str("path", r.URL.Path).Msg("authorize: anonymous request to protected path")
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				errors.WriteJSON(w, http.StatusUnauthorized, errors.ErrUnauthorized)
+				return
+			}
+
+			if len(rule.Roles) > 0 && !slices.ContainsFunc(rule.Roles, func(role string) bool {
+				return slices.Contains(principal.Roles, role)
+			}) {
+				log.Warn().Str("sub", principal.Subject).Str("path", r.URL.Path).Strs("required_roles", rule.Roles).Msg("authorize: missing role")
+				errors.WriteJSON(w, http.StatusForbidden, errors.ErrForbidden)
+				return
+			}
+
+			for _, scope := range rule.Scopes {
+				if !slices.Contains(principal.Scopes, scope) {
+					log.Warn().Str("sub", principal.Subject).Str("path", r.URL.Path).Str("required_scope", scope).Msg("authorize: missing scope")
+					errors.WriteJSON(w, http.StatusForbidden, errors.ErrForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestMatcher matches requests by method and chi-style path pattern.
+// Empty methods or paths match everything.
+type requestMatcher struct {
+	methods  []string
+	patterns []pathPattern
+}
+
+// newRequestMatcher compiles paths. A broken pattern fails closed: it is
+// logged and matches every path, so a rule never silently stops applying.
+func newRequestMatcher(methods, paths []string, component string, log zerolog.Logger) requestMatcher {
+	m := requestMatcher{methods: methods}
+	for _, p := range paths {
+		pat, err := compilePathPattern(p)
+		if err != nil {
+			log.Error().Err(err).Str("pattern", p).Msg(component + ": invalid path pattern, matching all paths")
+			pat = pathPattern{wildcard: true}
+		}
+		m.patterns = append(m.patterns, pat)
+	}
+	return m
+}
+
+func (m requestMatcher) match(method, cleanPath string) bool {
+	if len(m.methods) > 0 && !slices.Contains(m.methods, method) {
+		return false
+	}
+	if len(m.patterns) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(m.patterns, func(p pathPattern) bool { return p.match(cleanPath) })
+}
+
+// firstMatch returns the index of the first matcher matching r, or -1.
+func firstMatch(matchers []requestMatcher, r *http.Request) int {
+	// Clean the path so that "/a/../admin" cannot slip past an "/admin" rule
+	// only to be normalised by the upstream.
+	p := path.Clean("/" + r.URL.Path)
+	for i, m := range matchers {
+		if m.match(r.Method, p) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pathPattern is a compiled chi-style route pattern: "{name}" matches one
+// path segment, "{name:regex}" one segment matching regex, and a trailing "*"
+// the remainder of the path.
+type pathPattern struct {
+	segments []patternSegment
+	wildcard bool
+}
+
+type patternSegment struct {
+	literal string
+	param   bool
+	re      *regexp.Regexp
+}
+
+func compilePathPattern(pattern string) (pathPattern, error) {
+	var p pathPattern
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	for i, part := range parts {
+		switch {
+		case part == "*" && i == len(parts)-1:
+			p.wildcard = true
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			seg := patternSegment{param: true}
+			if _, expr, ok := strings.Cut(part[1:len(part)-1], ":"); ok {
+				re, err := regexp.Compile("^(?:" + expr + ")$")
+				if err != nil {
+					return pathPattern{}, err
+				}
+				seg.re = re
+			}
+			p.segments = append(p.segments, seg)
+		default:
+			p.segments = append(p.segments, patternSegment{literal: part})
+		}
+	}
+	return p, nil
+}
+
+func (p pathPattern) match(urlPath string) bool {
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(parts) < len(p.segments) || (!p.wildcard && len(parts) != len(p.segments)) {
+		return false
+	}
+	for i, seg := range p.segments {
+		part := parts[i]
+		switch {
+		case !seg.param:
+			if part != seg.literal {
+				return false
+			}
+		case part == "":
+			return false
+		case seg.re != nil && !seg.re.MatchString(part):
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func withPrincipal(r *http.Request, p *mw.Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), mw.PrincipalContextKey{}, p))
+}
+
+func TestAuthorize_Rules(t *testing.T) {
+	rules := []mw.AuthzRule{
+		{
+			Methods: []string{http.MethodPost, http.MethodPut, http.MethodDelete},
+			Paths:   []string{"/api/core/problems/{id:[0-9]+}", "/api/core/problems"},
+			Roles:   []string{"admin", "setter"},
+		},
+		{
+			Paths:  []string{"/api/core/admin/*"},
+			Roles:  []string{"admin"},
+			Scopes: []string{"admin:read"},
+		},
+		{
+			Methods: []string{http.MethodGet},
+			Paths:   []string{"/api/core/contests/{contestID}/submissions"},
+			Scopes:  []string{"submissions:read", "contests:read"},
+		},
+	}
+
+	student := &mw.Principal{Subject: "s1", Roles: []string{"student"}, Scopes: []string{"submissions:read", "contests:read"}}
+	setter := &mw.Principal{Subject: "p1", Roles: []string{"setter"}}
+	admin := &mw.Principal{Subject: "a1", Roles: []string{"admin"}, Scopes: []string{"admin:read"}}
+	adminNoScope := &mw.Principal{Subject: "a2", Roles: []string{"admin"}}
+	partialScopes := &mw.Principal{Subject: "s2", Scopes: []string{"submissions:read"}}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		principal *mw.Principal
+		want      int
+	}{
+		{"unprotected path, anonymous", http.MethodGet, "/api/core/problems", nil, http.StatusOK},
+		{"unprotected method, student", http.MethodGet, "/api/core/problems/12", student, http.StatusOK},
+		{"create problem, anonymous", http.MethodPost, "/api/core/problems", nil, http.StatusUnauthorized},
+		{"create problem, student", http.MethodPost, "/api/core/problems", student, http.StatusForbidden},
+		{"create problem, setter", http.MethodPost, "/api/core/problems", setter, http.StatusOK},
+		{"update problem, setter", http.MethodPut, "/api/core/problems/12", setter, http.StatusOK},
+		{"update problem, admin", http.MethodDelete, "/api/core/problems/12", admin, http.StatusOK},
+		{"regex param mismatch", http.MethodPut, "/api/core/problems/abc", student, http.StatusOK},
+		{"deeper path not matched by param", http.MethodPut, "/api/core/problems/12/tests", student, http.StatusOK},
+		{"admin wildcard, student", http.MethodGet, "/api/core/admin/users", student, http.StatusForbidden},
+		{"admin wildcard root, student", http.MethodGet, "/api/core/admin", student, http.StatusForbidden},
+		{"admin wildcard nested, admin", http.MethodGet, "/api/core/admin/users/1/ban", admin, http.StatusOK},
+		{"admin role without scope", http.MethodGet, "/api/core/admin/users", adminNoScope, http.StatusForbidden},
+		{"dot-dot traversal", http.MethodGet, "/api/core/public/../admin/users", student, http.StatusForbidden},
+		{"all scopes present", http.MethodGet, "/api/core/contests/7/submissions", student, http.StatusOK},
+		{"missing one scope", http.MethodGet, "/api/core/contests/7/submissions", partialScopes, http.StatusForbidden},
+		{"empty param segment", http.MethodGet, "/api/core/contests//submissions", partialScopes, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			handler := mw.Authorize(rules, zerolog.Nop())(next)
+
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.principal != nil {
+				req = withPrincipal(req, tc.principal)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.want, rr.Code)
+			switch tc.want {
+			case http.StatusForbidden:
+				assert.Contains(t, rr.Body.String(), `"code":"forbidden"`)
+			case http.StatusUnauthorized:
+				assert.Contains(t, rr.Body.String(), `"code":"unauthorized"`)
+			}
+		})
+	}
+}
+
+func TestAuthorize_FirstMatchingRuleWins(t *testing.T) {
+	rules := []mw.AuthzRule{
+		{Paths: []string{"/api/core/admin/health"}, Roles: []string{"monitor"}},
+		{Paths: []string{"/api/core/admin/*"}, Roles: []string{"admin"}},
+	}
+	monitor := &mw.Principal{Subject: "m1", Roles: []string{"monitor"}}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := mw.Authorize(rules, zerolog.Nop())(next)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, withPrincipal(httptest.NewRequest(http.MethodGet, "/api/core/admin/health", nil), monitor))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, withPrincipal(httptest.NewRequest(http.MethodGet, "/api/core/admin/users", nil), monitor))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestAuthorize_InvalidPattern_FailsClosed(t *testing.T) {
+	rules := []mw.AuthzRule{{Paths: []string{"/api/{id:[}"}, Roles: []string{"admin"}}}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := mw.Authorize(rules, zerolog.Nop())(next)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, withPrincipal(httptest.NewRequest(http.MethodGet, "/anything", nil), &mw.Principal{Subject: "u"}))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
@@ -4,27 +4,105 @@ package middleware
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/FPT-OJT/gateway/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
+// CacheScope decides who may share a cached response.
+type CacheScope string
+
+const (
+	// CacheScopePublic shares entries between all clients, so requests
+	// carrying credentials are never cached.
+	CacheScopePublic CacheScope = "public"
+	// CacheScopeUser partitions entries by authenticated principal.
+	CacheScopeUser CacheScope = "user"
+	// CacheScopeTenant partitions entries by the principal's tenant;
+	// authenticated requests without one are not cached.
+	CacheScopeTenant CacheScope = "tenant"
+)
+
 type CacheConfig struct {
+	// Route names the route, whose entries are kept apart from other routes'
+	// even where their paths are the same, e.g. routes told apart by host.
+	Route string
+	// TTL is the freshness lifetime of responses whose upstream sets no
+	// Cache-Control max-age, s-maxage or Expires.
 	TTL time.Duration
+	// KeepStale is how long responses carrying an upstream ETag or
+	// Last-Modified are kept once stale, to be revalidated rather than
+	// fetched again.
+	KeepStale time.Duration
+	// StaleWhileRevalidate and StaleIfError are how long past its freshness
+	// a response may be served while it is refreshed in the background, and
+	// in place of an upstream 5xx or connection error. Upstream directives
+	// of the same names take precedence.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// CostHeader is the header in which the upstream reports a request's
+	// rate limit cost (RateLimitCost.Header). It is never stored, so that
+	// cached responses are not charged again on every hit.
+	CostHeader string
+	// Scope defaults to CacheScopePublic.
+	Scope CacheScope
 }
 
 // Cache returns a middleware that caches upstream GET responses using a CacheStore.
+// It runs after authentication so that it can partition entries by principal,
+// and follows the shared-cache rules of RFC 9111.
 //
 // Rules:
 //   - Only GET requests are cached.
-//   - Responses with non-2xx status are never cached.
-//   - Requests with "Cache-Control: no-cache" bypass the cache entirely.
-//   - Cache key: "rc:{path}?{rawquery}"
-//   - X-Cache: HIT  → served from cache.
+//   - Only 2xx responses other than 206 are stored: status, body and the
+//     headers the upstream set (minus hop-by-hop ones), replayed as is.
+//   - Responses stay fresh for s-maxage, max-age or until Expires; TTL
+//     applies only when the upstream sets none of them. "no-cache" responses
+//     are stale at once. Responses with "no-store" or "Vary: *" are not
+//     stored.
+//   - Entries always carry an ETag and Last-Modified, generated if the
+//     upstream sent none, and answer If-None-Match / If-Modified-Since
+//     with 304.
+//   - Stale entries with upstream validators are kept for KeepStale and
+//     revalidated with a conditional request; a 304 refreshes the entry
+//     (X-Cache: REVALIDATED).
+//   - Stale entries within StaleWhileRevalidate are served at once while a
+//     single background request per instance refreshes them; within
+//     StaleIfError they replace upstream 5xx responses (X-Cache: STALE, with
+//     a Warning header). Entries stay stored for the longest window.
+//   - Requests with "no-cache" or "max-age=0" (or "Pragma: no-cache") do not
+//     accept a stored response without revalidation; "max-age" and
+//     "min-fresh" bound the age of the entry served; "no-store" keeps the
+//     response out of the cache; "only-if-cached" gets 504 not_cached
+//     instead of a fetch.
+//   - Requests with a principal, an Authorization header or cookies are
+//     only cached under the user or tenant scope, in their partition;
+//     otherwise they bypass the cache (X-Cache: BYPASS).
+//   - Responses setting cookies are never stored, nor are responses with
+//     "Cache-Control: private" outside a user's partition.
+//   - Cache key: "rc:{path}?{rawquery}", or "rc:{partition}:{path}?{rawquery}"
+//     for credentialed requests, e.g. "rc:user=jwt/42:/me". Responses with
+//     Vary are stored under the key plus a digest of the named request
+//     headers; the plain key then holds the header names.
+//   - X-Cache: HIT  → served from cache, with an Age header.
+//   - X-Cache: REVALIDATED → confirmed by the upstream, served from cache.
+//   - X-Cache: STALE → served from cache past its freshness.
 //   - X-Cache: MISS → fetched from upstream, then stored.
 func Cache(store CacheStore, cfg CacheConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	if cfg.Scope == "" {
+		cfg.Scope = CacheScopePublic
+	}
+	c := &responseCache{store: store, cfg: cfg, log: log}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.Method != http.MethodGet {
@@ -32,63 +110,305 @@ func Cache(store CacheStore, cfg CacheConfig, log zerolog.Logger) func(http.Hand
 				return
 			}
 
-			if r.Header.Get("Cache-Control") == "no-cache" {
-				w.Header().Set("X-Cache", "MISS")
+			partition, ok := cachePartition(r, cfg.Scope)
+			if !ok {
+				w.Header().Set("X-Cache", "BYPASS")
 				next.ServeHTTP(w, r)
 				return
 			}
+			key := cacheKey(r, cfg.Route, partition)
+			reqCC := parseCacheControl(r.Header)
 
-			key := cacheKey(r)
-
-			ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
-			defer cancel()
-
-			cached, found, err := store.Get(ctx, key)
-			if found {
-				w.Header().Set("X-Cache", "HIT")
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
-				_, _ = w.Write(cached)
+			perUser := cfg.Scope == CacheScopeUser && partition != ""
+			store := !reqCC.has("no-store")
 
+			now := time.Now()
+			entry, entryKey := c.lookup(r, key)
+			if entry != nil && acceptable(entry, reqCC, now) {
+				serveCacheEntry(w, r, entry, now, "HIT")
 				log.Debug().Str("key", key).Msg("cache: HIT")
 				return
 			}
 
-			if err != nil {
-				log.Warn().Err(err).Str("key", key).Msg("cache: store read error, failing open")
+			if entry != nil && c.staleWhileRevalidate(entry, reqCC, now) {
+				serveStale(w, r, entry, now, warnResponseStale)
+				c.refreshInBackground(r, next, key, entryKey, entry, perUser)
+				log.Debug().Str("key", key).Msg("cache: STALE")
+				return
+			}
+
+			if reqCC.has("only-if-cached") {
 				w.Header().Set("X-Cache", "MISS")
-				next.ServeHTTP(w, r)
+				errors.WriteJSON(w, http.StatusGatewayTimeout, errors.ErrNotCached)
 				return
 			}
 
-			rec := &responseRecorder{
-				ResponseWriter: w,
-				buf:            &bytes.Buffer{},
-				status:         http.StatusOK,
+			if entry != nil {
+				c.revalidate(w, r, next, key, entry, perUser, store, now)
+				return
 			}
 
 			w.Header().Set("X-Cache", "MISS")
+			rec := newResponseRecorder(w)
 			next.ServeHTTP(rec, r)
 
-			if rec.status >= 200 && rec.status < 300 && rec.buf.Len() > 0 {
-				storeCtx, storeCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
-				defer storeCancel()
-
-				if setErr := store.Set(storeCtx, key, rec.buf.Bytes(), cfg.TTL); setErr != nil {
-					log.Warn().Err(setErr).Str("key", key).Msg("cache: store write error")
-				} else {
-					log.Debug().Str("key", key).Dur("ttl", cfg.TTL).Msg("cache: stored")
-				}
+			if store {
+				c.save(r, key, perUser, rec)
 			}
 		})
 	}
 }
 
-// cacheKey builds a stable cache key from the request path and query string.
-func cacheKey(r *http.Request) string {
+type responseCache struct {
+	store CacheStore
+	cfg   CacheConfig
+	log   zerolog.Logger
+
+	// refreshing holds the keys of entries being refreshed in the background.
+	refreshing sync.Map
+}
+
+// lookup returns the response stored for r under key, following a Vary
+// index to the variant matching r, and the key it is stored under. Store
+// errors read as misses.
+func (c *responseCache) lookup(r *http.Request, key string) (*cacheEntry, string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+	defer cancel()
+
+	entry := c.get(ctx, key)
+	if entry != nil && entry.isVaryIndex() {
+		key = variantKey(key, r, entry.Vary)
+		entry = c.get(ctx, key)
+		if entry != nil && entry.isVaryIndex() {
+			return nil, ""
+		}
+	}
+	return entry, key
+}
+
+func (c *responseCache) get(ctx context.Context, key string) *cacheEntry {
+	data, found, err := c.store.Get(ctx, key)
+	if err != nil {
+		c.log.Warn().Err(err).Str("key", key).Msg("cache: store read error, failing open")
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	entry, err := decodeCacheEntry(data)
+	if err != nil {
+		c.log.Debug().Err(err).Str("key", key).Msg("cache: unreadable entry, refetching")
+		return nil
+	}
+	return entry
+}
+
+// save stores the recorded response if the upstream allows it.
+func (c *responseCache) save(r *http.Request, key string, perUser bool, rec *responseRecorder) {
+	sent := rec.sentHeader()
+	cc := parseCacheControl(sent)
+	if !cacheableStatus(rec.status) || cc.has("no-store") || !storable(sent, cc, perUser) {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		Status:     rec.status,
+		Header:     c.storedHeader(sent, rec.before),
+		Body:       rec.buf.Bytes(),
+		StoredAt:   now,
+		Lifetime:   c.lifetime(sent, cc, now),
+		InitialAge: initialAge(sent),
+	}
+	addValidators(entry)
+	c.put(r, key, entry)
+}
+
+// storedHeader is upstreamHeader without the upstream's cost report.
+func (c *responseCache) storedHeader(sent, before http.Header) http.Header {
+	h := upstreamHeader(sent, before)
+	if c.cfg.CostHeader != "" {
+		h.Del(c.cfg.CostHeader)
+	}
+	return h
+}
+
+// put stores entry for as long as it stays fresh, plus the longest of
+// KeepStale (if it can be revalidated) and its stale windows. A response with
+// Vary goes under its variant's key, with an index of the Vary headers under
+// key.
+func (c *responseCache) put(r *http.Request, key string, entry *cacheEntry) {
+	vary := varyHeaders(entry.Header)
+	if slices.Contains(vary, "*") {
+		return
+	}
+	var keep time.Duration
+	if entry.revalidatable() {
+		keep = c.cfg.KeepStale
+	}
+	staleWhileRevalidate, staleIfError := c.staleWindows(entry)
+	ttl := max(entry.Lifetime-entry.InitialAge, 0) + max(keep, staleWhileRevalidate, staleIfError)
+	if ttl <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if len(vary) > 0 {
+		if !c.set(ctx, key, &cacheEntry{StoredAt: entry.StoredAt, Vary: vary}, ttl) {
+			return
+		}
+		key = variantKey(key, r, vary)
+	}
+	if c.set(ctx, key, entry, ttl) {
+		c.log.Debug().Str("key", key).Dur("ttl", ttl).Msg("cache: stored")
+	}
+}
+
+// lifetime returns the freshness lifetime of a response with header h and
+// directives cc, or TTL when the upstream gives no guidance.
+func (c *responseCache) lifetime(h http.Header, cc cacheControl, now time.Time) time.Duration {
+	if cc.has("no-cache") {
+		return 0
+	}
+	if lifetime, ok := freshnessLifetime(h, cc, now); ok {
+		return lifetime
+	}
+	return c.cfg.TTL
+}
+
+func (c *responseCache) set(ctx context.Context, key string, entry *cacheEntry, ttl time.Duration) bool {
+	data, err := entry.encode()
+	if err != nil {
+		c.log.Warn().Err(err).Str("key", key).Msg("cache: encode error")
+		return false
+	}
+	if err := c.store.Set(ctx, key, data, ttl); err != nil {
+		c.log.Warn().Err(err).Str("key", key).Msg("cache: store write error")
+		return false
+	}
+	return true
+}
+
+// acceptable reports whether entry may answer a request with directives cc
+// without revalidation: it must be fresh, and satisfy the request's no-cache,
+// max-age and min-fresh.
+func acceptable(entry *cacheEntry, cc cacheControl, now time.Time) bool {
+	age := entry.age(now)
+	if age >= entry.Lifetime || cc.has("no-cache") {
+		return false
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok && (maxAge == 0 || age > maxAge) {
+		return false
+	}
+	if minFresh, ok := cc.seconds("min-fresh"); ok && entry.Lifetime-age < minFresh {
+		return false
+	}
+	return true
+}
+
+// serveCacheEntry replays a stored response, or 304 if r's conditions say
+// the client has it already. Its headers replace those the middleware in
+// front of the cache set under the same names. status goes into X-Cache.
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, now time.Time, status string) {
+	if notModified(r, e.Header) {
+		writeNotModified(w, e, now, status)
+		return
+	}
+	h := w.Header()
+	for k, v := range e.Header {
+		h[k] = v
+	}
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Set("X-Cache", status)
+	w.WriteHeader(e.Status)
+	_, _ = w.Write(e.Body)
+}
+
+// cacheableStatus reports whether responses with the status are stored.
+// Partial content answers a Range request and is not the full resource.
+func cacheableStatus(status int) bool {
+	return status >= 200 && status < 300 && status != http.StatusPartialContent
+}
+
+// varyHeaders returns the sorted, canonical request header names listed in
+// the Vary fields of h, or "*".
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return []string{"*"}
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// variantKey extends key with a digest of r's values of the vary headers.
+// Keys never contain spaces otherwise, so variants cannot collide with them.
+func variantKey(key string, r *http.Request, vary []string) string {
+	h := sha256.New()
+	for _, name := range vary {
+		fmt.Fprintf(h, "%s:%s\n", name, strings.Join(r.Header.Values(name), ","))
+	}
+	return key + " vary=" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// cachePartition returns the partition a request's response is cached in,
+// empty for the shared one, or false when it must not be cached at all.
+func cachePartition(r *http.Request, scope CacheScope) (string, bool) {
+	p, authenticated := PrincipalFrom(r.Context())
+	if !authenticated {
+		credentialed := r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+		return "", !credentialed
+	}
+	switch scope {
+	case CacheScopeUser:
+		return "user=" + p.Method + "/" + url.PathEscape(p.Subject), true
+	case CacheScopeTenant:
+		if p.Tenant == "" {
+			return "", false
+		}
+		return "tenant=" + url.PathEscape(p.Tenant), true
+	default:
+		return "", false
+	}
+}
+
+// storable reports whether a response with header h and directives cc may
+// be stored; private responses only in a single user's partition. Responses
+// setting cookies are specific to their recipient.
+func storable(h http.Header, cc cacheControl, perUser bool) bool {
+	if len(h.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	return perUser || !cc.has("private")
+}
+
+// cacheKey builds a stable cache key from the route, partition, escaped
+// request path and query string. Neither the route nor the partition starts
+// with "/", and they are told apart by their "route=", "user=" or "tenant="
+// prefix, so keys cannot collide.
+func cacheKey(r *http.Request, route, partition string) string {
 	var sb strings.Builder
 	sb.WriteString("rc:")
-	sb.WriteString(r.URL.Path)
+	if route != "" {
+		sb.WriteString("route=")
+		sb.WriteString(url.PathEscape(route))
+		sb.WriteByte(':')
+	}
+	if partition != "" {
+		sb.WriteString(partition)
+		sb.WriteByte(':')
+	}
+	sb.WriteString(r.URL.EscapedPath())
 	if q := r.URL.RawQuery; q != "" {
 		sb.WriteByte('?')
 		sb.WriteString(q)
@@ -96,18 +416,70 @@ func cacheKey(r *http.Request) string {
 	return sb.String()
 }
 
+// responseRecorder tees the response body into buf and snapshots the header
+// when the status is written, as later changes never reach the client.
 type responseRecorder struct {
 	http.ResponseWriter
 	buf    *bytes.Buffer
 	status int
+
+	before http.Header
+	header http.Header
+
+	// hold, if set, keeps responses with the statuses it accepts from the
+	// client, for the cache to answer instead.
+	hold func(status int) bool
+	held bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriter: w,
+		buf:            &bytes.Buffer{},
+		status:         http.StatusOK,
+		before:         w.Header().Clone(),
+	}
 }
 
 func (r *responseRecorder) WriteHeader(status int) {
-	r.status = status
-	r.ResponseWriter.WriteHeader(status)
+	if r.header == nil {
+		r.status = status
+		r.header = r.ResponseWriter.Header().Clone()
+		r.held = r.hold != nil && r.hold(status)
+	}
+	if !r.held {
+		r.ResponseWriter.WriteHeader(status)
+	}
 }
 
 func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.header == nil {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.held {
+		return len(b), nil
+	}
 	r.buf.Write(b)
 	return r.ResponseWriter.Write(b)
 }
+
+func (r *responseRecorder) Flush() {
+	if r.header == nil {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.held {
+		_ = http.NewResponseController(r.ResponseWriter).Flush()
+	}
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// sentHeader returns the header the client received.
+func (r *responseRecorder) sentHeader() http.Header {
+	if r.header == nil {
+		return r.ResponseWriter.Header()
+	}
+	return r.header
+}
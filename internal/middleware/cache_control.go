@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FPT-OJT/gateway/pkg/utils"
+)
+
+// cacheControl holds parsed Cache-Control directives, keyed by lowercased
+// name. Directives without an argument map to "".
+type cacheControl map[string]string
+
+// parseCacheControl parses every Cache-Control field of h. Arguments may be
+// quoted; commas inside quotes do not split directives. A request without
+// Cache-Control but with "Pragma: no-cache" reads as no-cache.
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	values := h.Values("Cache-Control")
+	for _, v := range values {
+		for _, directive := range utils.SplitQuoted(v, ',') {
+			name, arg, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, dup := cc[name]; !dup {
+				cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	if len(values) == 0 {
+		for _, v := range h.Values("Pragma") {
+			if strings.EqualFold(strings.TrimSpace(v), "no-cache") {
+				cc["no-cache"] = ""
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns a delta-seconds argument. Malformed values report ok with
+// zero, so that a garbled max-age errs on the side of staleness.
+func (cc cacheControl) seconds(name string) (d time.Duration, ok bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(min(n, int64(maxCacheDelta/time.Second))) * time.Second, true
+}
+
+// maxCacheDelta caps delta-seconds, as RFC 9111 allows, to keep durations
+// from overflowing.
+const maxCacheDelta = 1 << 31 * time.Second
+
+// freshnessLifetime returns how long a response with header h stays fresh
+// in a shared cache: s-maxage, then max-age, then Expires relative to Date.
+// ok is false when the upstream gives none of them; an invalid Expires means
+// the response is already stale.
+func freshnessLifetime(h http.Header, cc cacheControl, now time.Time) (time.Duration, bool) {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0, true
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		return max(expires.Sub(date), 0), true
+	}
+	return 0, false
+}
+
+// initialAge is the age a response already had when it arrived, as reported
+// by an upstream cache in the Age header.
+func initialAge(h http.Header) time.Duration {
+	n, err := strconv.ParseInt(strings.TrimSpace(h.Get("Age")), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(min(n, int64(maxCacheDelta/time.Second))) * time.Second
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// cacheEntryVersion is the first byte of every encoded cache entry. Bump it
+// whenever the layout changes; entries of another version read as misses
+// and are replaced, so no migration is needed.
+const cacheEntryVersion byte = 1
+
+// cacheEntry is a stored upstream response.
+//
+// Encoded layout:
+//
+//	version (1 byte) | meta length (4 bytes, big endian) | meta (JSON) | body
+//
+// The body is stored raw after the metadata so that it is neither escaped
+// nor base64 encoded.
+type cacheEntry struct {
+	Status   int
+	Header   http.Header
+	Body     []byte
+	StoredAt time.Time
+	// Lifetime is how long the response is fresh, counted from when the
+	// origin generated it, i.e. InitialAge before StoredAt.
+	Lifetime   time.Duration
+	InitialAge time.Duration
+
+	// Synthetic names the validators (ETag, Last-Modified) the gateway
+	// generated because the upstream sent none. They answer conditional
+	// requests from clients but are never sent upstream.
+	Synthetic []string
+
+	// Vary, when set on an entry without a status, makes it the index of a
+	// response's variants: the request headers they are keyed by.
+	Vary []string
+}
+
+type cacheEntryMeta struct {
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	StoredAt   int64       `json:"stored_at"`
+	Lifetime   int64       `json:"lifetime_ms,omitempty"`
+	InitialAge int64       `json:"initial_age_ms,omitempty"`
+	Synthetic  []string    `json:"synthetic,omitempty"`
+	Vary       []string    `json:"vary,omitempty"`
+}
+
+// age returns the entry's current age, as sent in the Age header.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + max(now.Sub(e.StoredAt), 0)
+}
+
+// validator returns the upstream's ETag or Last-Modified, empty if the
+// upstream sent none.
+func (e *cacheEntry) validator(name string) string {
+	if slices.Contains(e.Synthetic, name) {
+		return ""
+	}
+	return e.Header.Get(name)
+}
+
+// revalidatable reports whether the upstream can confirm that a stale entry
+// is still current.
+func (e *cacheEntry) revalidatable() bool {
+	return e.validator("ETag") != "" || e.validator("Last-Modified") != ""
+}
+
+// isVaryIndex reports whether the entry points at variants rather than
+// holding a response.
+func (e *cacheEntry) isVaryIndex() bool {
+	return e.Status == 0 && len(e.Vary) > 0
+}
+
+func (e *cacheEntry) encode() ([]byte, error) {
+	meta, err := json.Marshal(cacheEntryMeta{
+		Status:     e.Status,
+		Header:     e.Header,
+		StoredAt:   e.StoredAt.UnixMilli(),
+		Lifetime:   e.Lifetime.Milliseconds(),
+		InitialAge: e.InitialAge.Milliseconds(),
+		Synthetic:  e.Synthetic,
+		Vary:       e.Vary,
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, 5+len(meta)+len(e.Body))
+	buf = append(buf, cacheEntryVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(meta)))
+	buf = append(buf, meta...)
+	return append(buf, e.Body...), nil
+}
+
+func decodeCacheEntry(data []byte) (*cacheEntry, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("cache entry: truncated")
+	}
+	if data[0] != cacheEntryVersion {
+		return nil, fmt.Errorf("cache entry: unsupported version %d", data[0])
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint64(n) > uint64(len(data)-5) {
+		return nil, fmt.Errorf("cache entry: truncated")
+	}
+	var meta cacheEntryMeta
+	if err := json.Unmarshal(data[5:5+n], &meta); err != nil {
+		return nil, fmt.Errorf("cache entry: %w", err)
+	}
+	return &cacheEntry{
+		Status:     meta.Status,
+		Header:     meta.Header,
+		Body:       data[5+n:],
+		StoredAt:   time.UnixMilli(meta.StoredAt),
+		Lifetime:   time.Duration(meta.Lifetime) * time.Millisecond,
+		InitialAge: time.Duration(meta.InitialAge) * time.Millisecond,
+		Synthetic:  meta.Synthetic,
+		Vary:       meta.Vary,
+	}, nil
+}
+
+// uncachedHeaders are never stored: hop-by-hop fields, which describe one
+// connection, and fields specific to a single exchange.
+var uncachedHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Set-Cookie":          true,
+	"Date":                true,
+	"Age":                 true,
+	"X-Cache":             true,
+}
+
+// upstreamHeader returns the fields of h that differ from before, i.e. those
+// set below the cache rather than by the middleware in front of it, minus
+// uncachedHeaders. Replaying only these on a hit keeps the outer middleware's
+// headers (rate limits, quotas, request id) current.
+func upstreamHeader(h, before http.Header) http.Header {
+	out := make(http.Header)
+	for k, v := range h {
+		if uncachedHeaders[k] || slices.Equal(v, before[k]) {
+			continue
+		}
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
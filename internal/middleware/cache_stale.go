@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Warning header values sent with stale responses (RFC 7234 §5.5).
+const (
+	warnResponseStale      = `110 - "Response is Stale"`
+	warnRevalidationFailed = `111 - "Revalidation Failed"`
+)
+
+// backgroundRefreshTimeout bounds a refresh no client is waiting for.
+const backgroundRefreshTimeout = 30 * time.Second
+
+// staleWindows returns how long past its freshness entry may be served
+// while it is refreshed, and in place of an upstream error: the upstream's
+// stale-while-revalidate and stale-if-error directives (RFC 5861), else the
+// route's settings. Responses that must be revalidated get neither; in a
+// shared cache s-maxage implies proxy-revalidate.
+func (c *responseCache) staleWindows(entry *cacheEntry) (whileRevalidate, ifError time.Duration) {
+	cc := parseCacheControl(entry.Header)
+	for _, directive := range []string{"must-revalidate", "proxy-revalidate", "no-cache", "s-maxage"} {
+		if cc.has(directive) {
+			return 0, 0
+		}
+	}
+	whileRevalidate, ifError = c.cfg.StaleWhileRevalidate, c.cfg.StaleIfError
+	if d, ok := cc.seconds("stale-while-revalidate"); ok {
+		whileRevalidate = d
+	}
+	if d, ok := cc.seconds("stale-if-error"); ok {
+		ifError = d
+	}
+	return whileRevalidate, ifError
+}
+
+// staleWhileRevalidate reports whether a stale entry may answer a request
+// with directives cc while it is refreshed. Requests asking for fresh or
+// validated responses wait for the upstream instead.
+func (c *responseCache) staleWhileRevalidate(entry *cacheEntry, cc cacheControl, now time.Time) bool {
+	if cc.has("no-cache") || cc.has("max-age") || cc.has("min-fresh") {
+		return false
+	}
+	window, _ := c.staleWindows(entry)
+	return entry.age(now)-entry.Lifetime < window
+}
+
+// serveStale serves an entry past its freshness, marked as such.
+func serveStale(w http.ResponseWriter, r *http.Request, entry *cacheEntry, now time.Time, warning string) {
+	w.Header().Set("Warning", warning)
+	serveCacheEntry(w, r, entry, now, "STALE")
+}
+
+// refreshInBackground fetches a fresh copy of the entry stored under
+// entryKey, unless this instance is refreshing it already. The refresh
+// outlives the client's request; upstream errors leave the entry in place.
+func (c *responseCache) refreshInBackground(r *http.Request, next http.Handler, key, entryKey string, entry *cacheEntry, perUser bool) {
+	if _, busy := c.refreshing.LoadOrStore(entryKey, struct{}{}); busy {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), backgroundRefreshTimeout)
+	req := r.Clone(ctx)
+
+	go func() {
+		defer c.refreshing.Delete(entryKey)
+		defer cancel()
+		defer func() {
+			// The proxy panics with http.ErrAbortHandler when an upstream
+			// body fails midway; there is no server here to recover it.
+			if v := recover(); v != nil {
+				c.log.Warn().Interface("panic", v).Str("key", key).Msg("cache: background refresh aborted")
+			}
+		}()
+
+		rec := newResponseRecorder(discardWriter{header: make(http.Header)})
+		c.fetch(rec, req, next, entry, true)
+
+		switch {
+		case !rec.held:
+			c.save(req, key, perUser, rec)
+		case rec.status == http.StatusNotModified:
+			c.put(req, key, c.refresh(entry, rec.sentHeader(), rec.before, time.Now()))
+		default:
+			c.log.Warn().Int("status", rec.status).Str("key", key).Msg("cache: background refresh failed")
+		}
+	}()
+}
+
+// discardWriter is the ResponseWriter of background refreshes.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardWriter) WriteHeader(int)             {}
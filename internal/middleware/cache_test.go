@@ -5,6 +5,9 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,28 +18,35 @@ import (
 
 // mockCacheStore is an in-memory implementation of middleware.CacheStore for testing.
 type mockCacheStore struct {
+	mu     sync.Mutex
 	data   map[string][]byte
+	ttls   map[string]time.Duration
 	getErr error
 	setErr error
 }
 
 func newMockCacheStore() *mockCacheStore {
-	return &mockCacheStore{data: make(map[string][]byte)}
+	return &mockCacheStore{data: make(map[string][]byte), ttls: make(map[string]time.Duration)}
 }
 
 func (m *mockCacheStore) Get(_ context.Context, key string) ([]byte, bool, error) {
 	if m.getErr != nil {
 		return nil, false, m.getErr
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	v, ok := m.data[key]
 	return v, ok, nil
 }
 
-func (m *mockCacheStore) Set(_ context.Context, key string, value []byte, _ time.Duration) error {
+func (m *mockCacheStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
 	if m.setErr != nil {
 		return m.setErr
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.data[key] = value
+	m.ttls[key] = ttl
 	return nil
 }
 
@@ -179,3 +189,650 @@ func TestCache_NonSuccessResponse_NotCached(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, rr.Code)
 	assert.Empty(t, store.data, "404 responses should not be cached")
 }
+
+// serveAs sends a GET for path as principal p (anonymous when nil) and
+// returns the response.
+func serveAs(handler http.Handler, path string, p *mw.Principal) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if p != nil {
+		req = withPrincipal(req, p)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// whoAmI answers with the subject of the request's principal.
+var whoAmI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	sub := "anonymous"
+	if p, ok := mw.PrincipalFrom(r.Context()); ok {
+		sub = p.Subject
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"sub":"` + sub + `"}`))
+})
+
+func TestCache_PublicScope_NeverSharesCredentialedResponses(t *testing.T) {
+	store := newMockCacheStore()
+	handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute}, zerolog.Nop())(whoAmI)
+
+	alice := &mw.Principal{Method: mw.AuthMethodJWT, Subject: "alice"}
+	bob := &mw.Principal{Method: mw.AuthMethodJWT, Subject: "bob"}
+
+	rr := serveAs(handler, "/api/core/me", alice)
+	assert.Equal(t, "BYPASS", rr.Header().Get("X-Cache"))
+	rr = serveAs(handler, "/api/core/me", bob)
+	assert.Equal(t, "BYPASS", rr.Header().Get("X-Cache"))
+	assert.Equal(t, `{"sub":"bob"}`, rr.Body.String())
+	assert.Empty(t, store.data)
+
+	for _, header := range []string{"Authorization", "Cookie"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/core/me", nil)
+		req.Header.Set(header, "secret")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, "BYPASS", rr.Header().Get("X-Cache"), header)
+	}
+	assert.Empty(t, store.data)
+
+	// Anonymous requests are still shared, and never served to a principal.
+	serveAs(handler, "/api/core/me", nil)
+	assert.Equal(t, "HIT", serveAs(handler, "/api/core/me", nil).Header().Get("X-Cache"))
+	assert.Equal(t, `{"sub":"alice"}`, serveAs(handler, "/api/core/me", alice).Body.String())
+}
+
+func TestCache_UserScope_PartitionsByPrincipal(t *testing.T) {
+	store := newMockCacheStore()
+	handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute, Scope: mw.CacheScopeUser}, zerolog.Nop())(whoAmI)
+
+	alice := &mw.Principal{Method: mw.AuthMethodJWT, Subject: "alice"}
+	bob := &mw.Principal{Method: mw.AuthMethodJWT, Subject: "bob"}
+	aliceKey := &mw.Principal{Method: mw.AuthMethodAPIKey, Subject: "alice"}
+
+	assert.Equal(t, "MISS", serveAs(handler, "/api/core/me", alice).Header().Get("X-Cache"))
+
+	rr := serveAs(handler, "/api/core/me", bob)
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	assert.Equal(t, `{"sub":"bob"}`, rr.Body.String())
+
+	rr = serveAs(handler, "/api/core/me", alice)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+	assert.Equal(t, `{"sub":"alice"}`, rr.Body.String())
+
+	assert.Equal(t, "MISS", serveAs(handler, "/api/core/me", aliceKey).Header().Get("X-Cache"),
+		"an API key owner does not share a JWT subject's partition")
+	assert.Equal(t, `{"sub":"anonymous"}`, serveAs(handler, "/api/core/me", nil).Body.String())
+
+	assert.Contains(t, store.data, "rc:user=jwt/alice:/api/core/me")
+	assert.Contains(t, store.data, "rc:/api/core/me")
+}
+
+func TestCache_TenantScope_PartitionsByTenant(t *testing.T) {
+	store := newMockCacheStore()
+	handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute, Scope: mw.CacheScopeTenant}, zerolog.Nop())(whoAmI)
+
+	serveAs(handler, "/api/core/org", &mw.Principal{Subject: "alice", Tenant: "acme"})
+
+	rr := serveAs(handler, "/api/core/org", &mw.Principal{Subject: "bob", Tenant: "acme"})
+	assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+	assert.Equal(t, `{"sub":"alice"}`, rr.Body.String())
+
+	rr = serveAs(handler, "/api/core/org", &mw.Principal{Subject: "carol", Tenant: "globex"})
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	assert.Equal(t, `{"sub":"carol"}`, rr.Body.String())
+
+	rr = serveAs(handler, "/api/core/org", &mw.Principal{Subject: "dave"})
+	assert.Equal(t, "BYPASS", rr.Header().Get("X-Cache"), "no tenant, no partition")
+}
+
+func TestCache_RoutesNeverShareEntries(t *testing.T) {
+	store := newMockCacheStore()
+	serve := func(route string) *httptest.ResponseRecorder {
+		handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute, Route: route}, zerolog.Nop())(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(route))
+			}))
+		return serveAs(handler, "/api/x", nil)
+	}
+
+	assert.Equal(t, "MISS", serve("a").Header().Get("X-Cache"))
+	rr := serve("b")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	assert.Equal(t, "b", rr.Body.String())
+	assert.Equal(t, "a", serve("a").Body.String())
+
+	assert.Contains(t, store.data, "rc:route=a:/api/x")
+	assert.Contains(t, store.data, "rc:route=b:/api/x")
+}
+
+func TestCache_PrivateAndCookieResponses(t *testing.T) {
+	for name, tc := range map[string]struct {
+		scope     mw.CacheScope
+		principal *mw.Principal
+		header    http.Header
+		stored    bool
+	}{
+		"private, shared":           {mw.CacheScopePublic, nil, http.Header{"Cache-Control": {"max-age=60, Private"}}, false},
+		"private, tenant partition": {mw.CacheScopeTenant, &mw.Principal{Subject: "a", Tenant: "t"}, http.Header{"Cache-Control": {"private"}}, false},
+		"private, user partition":   {mw.CacheScopeUser, &mw.Principal{Subject: "a"}, http.Header{"Cache-Control": {"private"}}, true},
+		"private, anonymous user":   {mw.CacheScopeUser, nil, http.Header{"Cache-Control": {`private="X-Foo"`}}, false},
+		"set-cookie":                {mw.CacheScopeUser, &mw.Principal{Subject: "a"}, http.Header{"Set-Cookie": {"session=1"}}, false},
+		"public":                    {mw.CacheScopePublic, nil, http.Header{"Cache-Control": {"public"}}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newMockCacheStore()
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tc.header {
+					w.Header()[k] = v
+				}
+				_, _ = w.Write([]byte(`{}`))
+			})
+			handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute, Scope: tc.scope}, zerolog.Nop())(next)
+
+			serveAs(handler, "/res", tc.principal)
+			assert.Equal(t, tc.stored, len(store.data) > 0)
+		})
+	}
+}
+
+func TestCache_Hit_ReplaysFullResponse(t *testing.T) {
+	store := newMockCacheStore()
+	body := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Connection", "close")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.WriteHeader(http.StatusNonAuthoritativeInfo)
+		_, _ = w.Write(body)
+		w.Header().Set("X-Late", "ignored")
+	})
+	// The outer handler stands in for middleware in front of the cache.
+	cache := mw.Cache(store, mw.CacheConfig{TTL: time.Minute}, zerolog.Nop())(next)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", r.URL.Query().Get("remaining"))
+		w.Header().Set("X-Request-Id", "fresh")
+		cache.ServeHTTP(w, r)
+	})
+
+	miss := httptest.NewRecorder()
+	handler.ServeHTTP(miss, httptest.NewRequest(http.MethodGet, "/report", nil))
+
+	hit := httptest.NewRecorder()
+	handler.ServeHTTP(hit, httptest.NewRequest(http.MethodGet, "/report", nil))
+
+	assert.Equal(t, "HIT", hit.Header().Get("X-Cache"))
+	assert.Equal(t, http.StatusNonAuthoritativeInfo, hit.Code)
+	assert.Equal(t, body, hit.Body.Bytes())
+	for _, h := range []string{"Content-Type", "Content-Encoding", "ETag", "Last-Modified"} {
+		assert.Equal(t, miss.Header().Get(h), hit.Header().Get(h), h)
+	}
+	assert.Equal(t, "0", hit.Header().Get("Age"))
+	assert.Empty(t, hit.Header().Get("Connection"), "hop-by-hop headers are not stored")
+	assert.Empty(t, hit.Header().Get("X-Late"), "headers set after the status never reached the client")
+	assert.Equal(t, "fresh", hit.Header().Get("X-Request-Id"))
+	assert.Equal(t, "0", hit.Header().Get("X-RateLimit-Remaining"), "the upstream's value replaces the outer one")
+}
+
+func TestCache_EmptyAndPartialResponses(t *testing.T) {
+	for status, stored := range map[int]bool{
+		http.StatusNoContent:      true,
+		http.StatusPartialContent: false,
+	} {
+		store := newMockCacheStore()
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute}, zerolog.Nop())(next)
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/res", nil))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/res", nil))
+
+		assert.Equal(t, stored, len(store.data) > 0, "status %d", status)
+		assert.Equal(t, status, rr.Code)
+	}
+}
+
+func TestCache_UnreadableEntry_IsRefetched(t *testing.T) {
+	store := newMockCacheStore()
+	// An entry in the format used before responses carried their headers.
+	store.data["rc:/legacy"] = []byte(`{"cached":true}`)
+
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = w.Write([]byte(`{"fresh":true}`))
+	})
+	handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute}, zerolog.Nop())(next)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/legacy", nil))
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	assert.Equal(t, `{"fresh":true}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/legacy", nil))
+	assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+	assert.Equal(t, 1, calls)
+}
+
+func TestCache_ResponseFreshness(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name   string
+		header http.Header
+		ttl    time.Duration // zero: not stored
+	}{
+		{"no guidance uses the configured TTL", http.Header{}, time.Minute},
+		{"max-age", http.Header{"Cache-Control": {"max-age=30"}}, 30 * time.Second},
+		{"s-maxage wins over max-age", http.Header{"Cache-Control": {"max-age=0, s-maxage=90"}}, 90 * time.Second},
+		{"quoted argument", http.Header{"Cache-Control": {`public, max-age="15"`}}, 15 * time.Second},
+		{"Age is deducted", http.Header{"Cache-Control": {"max-age=30"}, "Age": {"10"}}, 20 * time.Second},
+		{"Expires relative to Date", http.Header{"Expires": {now.Add(2 * time.Hour).Format(http.TimeFormat)}, "Date": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"max-age wins over Expires", http.Header{"Cache-Control": {"max-age=5"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 5 * time.Second},
+		{"max-age=0", http.Header{"Cache-Control": {"max-age=0"}}, 0},
+		{"malformed max-age", http.Header{"Cache-Control": {"max-age=soon"}}, 0},
+		{"past Expires", http.Header{"Expires": {now.Add(-time.Hour).Format(http.TimeFormat)}}, 0},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, 0},
+		{"outlived by Age", http.Header{"Cache-Control": {"max-age=30"}, "Age": {"30"}}, 0},
+		{"no-store", http.Header{"Cache-Control": {"max-age=60, No-Store"}}, 0},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, 0},
+		{"Vary: *", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newMockCacheStore()
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tc.header {
+					w.Header()[k] = v
+				}
+				_, _ = w.Write([]byte(`{}`))
+			})
+			handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute}, zerolog.Nop())(next)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/res", nil))
+
+			if tc.ttl == 0 {
+				assert.Empty(t, store.data)
+				return
+			}
+			assert.InDelta(t, tc.ttl, store.ttls["rc:/res"], float64(time.Second))
+		})
+	}
+}
+
+func TestCache_RequestDirectives(t *testing.T) {
+	newHandler := func() (http.Handler, *mockCacheStore, *int) {
+		store := newMockCacheStore()
+		calls := 0
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Age", "20")
+			_, _ = w.Write([]byte(`{}`))
+		})
+		return mw.Cache(store, mw.CacheConfig{TTL: time.Minute}, zerolog.Nop())(next), store, &calls
+	}
+	get := func(h http.Handler, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/res", nil)
+		req.Header = header
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		hit    bool
+	}{
+		{"none", http.Header{}, true},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, false},
+		{"max-age=0", http.Header{"Cache-Control": {"Max-Age=0"}}, false},
+		{"pragma", http.Header{"Pragma": {"no-cache"}}, false},
+		{"pragma overridden", http.Header{"Pragma": {"no-cache"}, "Cache-Control": {"max-age=60"}}, true},
+		{"max-age above the age", http.Header{"Cache-Control": {"max-age=30"}}, true},
+		{"max-age below the age", http.Header{"Cache-Control": {"max-age=10"}}, false},
+		{"min-fresh met", http.Header{"Cache-Control": {"min-fresh=30"}}, true},
+		{"min-fresh unmet", http.Header{"Cache-Control": {"min-fresh=50"}}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, _, calls := newHandler()
+			get(h, http.Header{})
+
+			rr := get(h, tc.header)
+			if tc.hit {
+				assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+				assert.Equal(t, "20", rr.Header().Get("Age"))
+				assert.Equal(t, 1, *calls)
+			} else {
+				assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+				assert.Equal(t, 2, *calls)
+			}
+		})
+	}
+
+	t.Run("only-if-cached", func(t *testing.T) {
+		h, _, calls := newHandler()
+
+		rr := get(h, http.Header{"Cache-Control": {"only-if-cached"}})
+		assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"code":"not_cached"`)
+		assert.Equal(t, 0, *calls)
+
+		get(h, http.Header{})
+		rr = get(h, http.Header{"Cache-Control": {"only-if-cached"}})
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+	})
+
+	t.Run("no-store", func(t *testing.T) {
+		h, store, _ := newHandler()
+		get(h, http.Header{"Cache-Control": {"no-store"}})
+		assert.Empty(t, store.data)
+	})
+}
+
+func TestCache_Vary(t *testing.T) {
+	store := newMockCacheStore()
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Vary", "accept-language, Accept-Encoding")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+	handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute}, zerolog.Nop())(next)
+
+	get := func(lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/greeting", nil)
+		req.Header.Set("Accept-Language", lang)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, "en", get("en").Body.String())
+	assert.Equal(t, "vi", get("vi").Body.String())
+
+	rr := get("en")
+	assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+	assert.Equal(t, "en", rr.Body.String())
+	rr = get("vi")
+	assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+	assert.Equal(t, "vi", rr.Body.String())
+
+	assert.Equal(t, 2, calls)
+	assert.Len(t, store.data, 3, "an index and one entry per variant")
+}
+
+func TestCache_ConditionalRequests(t *testing.T) {
+	lastModified := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/validated" {
+			w.Header().Set("ETag", `W/"v1"`)
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		}
+		_, _ = w.Write([]byte(`{"items":[]}`))
+	})
+	handler := mw.Cache(newMockCacheStore(), mw.CacheConfig{TTL: time.Minute}, zerolog.Nop())(next)
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	get("/generated", nil)
+	hit := get("/generated", nil)
+	etag := hit.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag, "a strong ETag is generated from the body")
+	assert.NotEmpty(t, hit.Header().Get("Last-Modified"))
+
+	rr := get("/generated", http.Header{"If-None-Match": {`"other", ` + etag}})
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+	assert.Equal(t, etag, rr.Header().Get("ETag"))
+	assert.Empty(t, rr.Header().Get("Content-Type"))
+	assert.Empty(t, rr.Body.String())
+
+	get("/validated", nil)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"weak comparison", http.Header{"If-None-Match": {`"v1"`}}, http.StatusNotModified},
+		{"any", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{"changed", http.Header{"If-None-Match": {`"v2"`}}, http.StatusOK},
+		{"not modified since", http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, http.StatusNotModified},
+		{"modified since", http.Header{"If-Modified-Since": {lastModified.Add(-time.Second).Format(http.TimeFormat)}}, http.StatusOK},
+		{"If-None-Match takes precedence", http.Header{"If-None-Match": {`"v2"`}, "If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, http.StatusOK},
+		{"unparseable date", http.Header{"If-Modified-Since": {"yesterday"}}, http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := get("/validated", tc.header)
+			assert.Equal(t, tc.want, rr.Code)
+			assert.Equal(t, `W/"v1"`, rr.Header().Get("ETag"))
+		})
+	}
+}
+
+// versionedUpstream serves version as ETag and body, answering matching
+// conditional requests with 304.
+type versionedUpstream struct {
+	version     string
+	calls       int
+	conditional []string
+}
+
+func (u *versionedUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.calls++
+	u.conditional = append(u.conditional, r.Header.Get("If-None-Match"))
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("ETag", `"`+u.version+`"`)
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == `"`+u.version+`"` {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = w.Write([]byte(u.version))
+}
+
+func TestCache_RevalidatesStaleEntries(t *testing.T) {
+	store := newMockCacheStore()
+	upstream := &versionedUpstream{version: "v1"}
+	handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute, KeepStale: time.Hour}, zerolog.Nop())(upstream)
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/submissions", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get(nil)
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	assert.Equal(t, time.Hour, store.ttls["rc:/submissions"], "kept stale for revalidation")
+
+	// Stale at once: confirmed by a conditional request, body from the cache.
+	rr = get(nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "REVALIDATED", rr.Header().Get("X-Cache"))
+	assert.Equal(t, "v1", rr.Body.String())
+	assert.Equal(t, "max-age=60", rr.Header().Get("Cache-Control"), "updated from the 304")
+	assert.Equal(t, []string{"", `"v1"`}, upstream.conditional)
+
+	// The 304's max-age made the entry fresh again.
+	assert.Equal(t, "HIT", get(nil).Header().Get("X-Cache"))
+	assert.Equal(t, 2, upstream.calls)
+
+	// no-cache revalidates rather than refetching; the client's own validator
+	// then gets a 304 from the gateway.
+	rr = get(http.Header{"Cache-Control": {"no-cache"}, "If-None-Match": {`"v1"`}})
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Equal(t, "REVALIDATED", rr.Header().Get("X-Cache"))
+	assert.Equal(t, `"v1"`, upstream.conditional[2], "the gateway's validator, not the client's")
+
+	// A changed resource replaces the entry.
+	upstream.version = "v2"
+	rr = get(http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	assert.Equal(t, "v2", rr.Body.String())
+	rr = get(http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, "REVALIDATED", rr.Header().Get("X-Cache"))
+	assert.Equal(t, "v2", rr.Body.String())
+}
+
+func TestCache_GeneratedValidatorsStayLocal(t *testing.T) {
+	var conditional http.Header
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = r.Header.Clone()
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Last-Modified", lastModified)
+		_, _ = w.Write([]byte(`{}`))
+	})
+	handler := mw.Cache(newMockCacheStore(), mw.CacheConfig{TTL: time.Minute, KeepStale: time.Hour}, zerolog.Nop())(next)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/res", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/res", nil))
+
+	assert.Equal(t, lastModified, conditional.Get("If-Modified-Since"))
+	assert.Empty(t, conditional.Get("If-None-Match"), "the generated ETag means nothing to the upstream")
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if n > 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		_, _ = w.Write([]byte("v" + strconv.Itoa(int(n))))
+	})
+	store := newMockCacheStore()
+	handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute, StaleWhileRevalidate: time.Minute}, zerolog.Nop())(next)
+
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/problems", nil))
+		return rr
+	}
+
+	assert.Equal(t, "MISS", get().Header().Get("X-Cache"))
+
+	// The upstream is blocked: stale copies are served without waiting, and
+	// only one refresh goes out however many requests find the entry stale.
+	for range 3 {
+		rr := get()
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "STALE", rr.Header().Get("X-Cache"))
+		assert.Equal(t, `110 - "Response is Stale"`, rr.Header().Get("Warning"))
+		assert.Equal(t, "v1", rr.Body.String())
+	}
+	assert.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, 5*time.Millisecond)
+	assert.Never(t, func() bool { return calls.Load() > 2 }, 50*time.Millisecond, 5*time.Millisecond)
+
+	close(release)
+	assert.Eventually(t, func() bool { return get().Body.String() != "v1" }, time.Second, 5*time.Millisecond,
+		"the background refresh replaces the entry")
+
+	// Clients asking for a fresh response wait for the upstream.
+	req := httptest.NewRequest(http.MethodGet, "/problems", nil)
+	req.Header.Set("Cache-Control", "max-age=0")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	assert.Empty(t, rr.Header().Get("Warning"))
+}
+
+func TestCache_StaleIfError(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantStale    bool
+		wantKept     time.Duration
+	}{
+		{"route window", "max-age=0", true, time.Minute},
+		{"upstream window", "max-age=0, stale-if-error=3600", true, time.Hour},
+		{"upstream disables", "max-age=0, stale-if-error=0", false, 0},
+		{"must-revalidate", "max-age=0, must-revalidate", false, 0},
+		{"s-maxage implies proxy-revalidate", "s-maxage=0", false, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status := http.StatusOK
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tc.cacheControl)
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(http.StatusText(status)))
+			})
+			store := newMockCacheStore()
+			handler := mw.Cache(store, mw.CacheConfig{TTL: time.Minute, StaleIfError: time.Minute}, zerolog.Nop())(next)
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/problems", nil))
+
+			status = http.StatusBadGateway
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/problems", nil))
+
+			if !tc.wantStale {
+				assert.Equal(t, http.StatusBadGateway, rr.Code)
+				assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+				return
+			}
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "STALE", rr.Header().Get("X-Cache"))
+			assert.Equal(t, `111 - "Revalidation Failed"`, rr.Header().Get("Warning"))
+			assert.Equal(t, "OK", rr.Body.String())
+			assert.Equal(t, tc.wantKept, store.ttls["rc:/problems"], "kept for the stale-if-error window")
+		})
+	}
+}
+
+func TestCache_CostHeaderNotReplayed(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-Request-Cost", "5")
+		_, _ = w.Write([]byte("ok"))
+	})
+	cost := mw.RateLimitCost{Header: "X-Request-Cost"}
+	handler := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{RPS: 1, Burst: 19, Cost: cost}, zerolog.Nop())(
+		mw.Cache(newMockCacheStore(), mw.CacheConfig{TTL: time.Minute, CostHeader: cost.Header}, zerolog.Nop())(next))
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/report", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	serve()
+	for _, want := range []string{"14", "13", "12"} {
+		rr := serve()
+		assert.Equal(t, "HIT", rr.Header().Get("X-Cache"))
+		assert.Equal(t, want, rr.Header().Get("X-RateLimit-Remaining"), "a hit costs one request, not the upstream's report")
+		assert.Empty(t, rr.Header().Get("X-Request-Cost"))
+	}
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// addValidators gives an entry a strong ETag (a digest of its body) and a
+// Last-Modified (when it was stored) if the upstream sent none, so that
+// clients can always revalidate against the gateway.
+func addValidators(e *cacheEntry) {
+	if e.Header.Get("ETag") == "" {
+		sum := sha256.Sum256(e.Body)
+		e.Header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		e.Synthetic = append(e.Synthetic, "ETag")
+	}
+	if e.Header.Get("Last-Modified") == "" {
+		e.Header.Set("Last-Modified", e.StoredAt.UTC().Format(http.TimeFormat))
+		e.Synthetic = append(e.Synthetic, "Last-Modified")
+	}
+}
+
+// revalidate fetches a fresh response for a stale entry, conditionally if
+// the upstream gave the entry validators. A 304 refreshes the entry, which
+// then answers the client; within the entry's stale-if-error window a 5xx
+// is kept from the client, who gets the stale entry instead. Any other
+// response goes to the client as on a miss and replaces the entry.
+func (c *responseCache) revalidate(w http.ResponseWriter, r *http.Request, next http.Handler, key string, entry *cacheEntry, perUser, store bool, now time.Time) {
+	_, staleIfError := c.staleWindows(entry)
+	holdErrors := entry.age(now)-entry.Lifetime < staleIfError
+
+	w.Header().Set("X-Cache", "MISS")
+	rec := newResponseRecorder(w)
+	c.fetch(rec, r, next, entry, holdErrors)
+
+	if !rec.held {
+		if store {
+			c.save(r, key, perUser, rec)
+		}
+		return
+	}
+
+	// The held response never reached the client: drop the headers it left
+	// behind.
+	h := w.Header()
+	clear(h)
+	for k, v := range rec.before {
+		h[k] = v
+	}
+
+	now = time.Now()
+	if rec.status != http.StatusNotModified {
+		c.log.Warn().Int("status", rec.status).Str("key", key).Msg("cache: upstream error, serving stale")
+		serveStale(w, r, entry, now, warnRevalidationFailed)
+		return
+	}
+	refreshed := c.refresh(entry, rec.sentHeader(), rec.before, now)
+	if store {
+		c.put(r, key, refreshed)
+	}
+	c.log.Debug().Str("key", key).Msg("cache: REVALIDATED")
+	serveCacheEntry(w, r, refreshed, now, "REVALIDATED")
+}
+
+// fetch sends r upstream through rec, with entry's validators in place of
+// the client's. rec holds back a 304, and 5xx responses if holdErrors.
+func (c *responseCache) fetch(rec *responseRecorder, r *http.Request, next http.Handler, entry *cacheEntry, holdErrors bool) {
+	req := r
+	if entry.revalidatable() {
+		req = r.Clone(r.Context())
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		if etag := entry.validator("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.validator("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	rec.hold = func(status int) bool {
+		return (status == http.StatusNotModified && entry.revalidatable()) ||
+			(status >= http.StatusInternalServerError && holdErrors)
+	}
+	next.ServeHTTP(rec, req)
+}
+
+// refresh returns entry updated with the header of a 304 response to its
+// revalidation, fresh again from now.
+func (c *responseCache) refresh(entry *cacheEntry, sent, before http.Header, now time.Time) *cacheEntry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for k, v := range c.storedHeader(sent, before) {
+		if k == "Content-Length" {
+			continue
+		}
+		updated.Header[k] = v
+		updated.Synthetic = slices.DeleteFunc(slices.Clone(updated.Synthetic), func(s string) bool { return s == k })
+	}
+
+	cc := parseCacheControl(updated.Header)
+	updated.StoredAt = now
+	updated.Lifetime = c.lifetime(updated.Header, cc, now)
+	updated.InitialAge = initialAge(sent)
+	return &updated
+}
+
+// notModified evaluates the client's If-None-Match, or failing that its
+// If-Modified-Since, against the validators in header (RFC 9110 §13.2.2).
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for candidate := range strings.SplitSeq(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETagMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+// weakETagMatch compares entity tags ignoring the weakness indicator, as
+// If-None-Match requires.
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// writeNotModified answers a conditional request with the entry's metadata
+// but none of the fields describing its body.
+func writeNotModified(w http.ResponseWriter, e *cacheEntry, now time.Time, status string) {
+	h := w.Header()
+	for k, v := range e.Header {
+		switch k {
+		case "Content-Type", "Content-Length", "Content-Encoding":
+		default:
+			h[k] = v
+		}
+	}
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Set("X-Cache", status)
+	w.WriteHeader(http.StatusNotModified)
+}
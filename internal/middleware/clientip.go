@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/FPT-OJT/gateway/pkg/utils"
+)
+
+// ClientIP returns a middleware that resolves the client address once, with
+// the trusted-proxy rules of resolver, and stores it in the request context.
+// Everything after it that calls utils.ClientIp — rate limits, IP rules,
+// logging and the proxy's forwarding headers — sees the same address.
+func ClientIP(resolver *utils.ClientIPResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := utils.WithClientIP(r.Context(), resolver.Resolve(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/FPT-OJT/gateway/pkg/utils"
+	"github.com/rs/zerolog"
+)
+
+type ConcurrencyConfig struct {
+	// Name namespaces the slots, usually the route name.
+	Name string
+
+	// PerKey bounds the requests in flight per client, chosen by Key as for
+	// rate limits. Zero disables the per-client limit.
+	PerKey int
+	Key    ratelimit.Key
+	// Total bounds the requests in flight across all clients. Zero disables
+	// the global limit.
+	Total int
+
+	// MaxQueue is how many requests each instance holds waiting for a slot;
+	// zero rejects them at once. Queued requests give up after QueueTimeout,
+	// five seconds by default.
+	MaxQueue     int
+	QueueTimeout time.Duration
+
+	// LeaseTTL is how long a slot outlives an instance that crashed while
+	// holding it, 30 seconds by default. Leases of running requests are
+	// renewed every third of it.
+	LeaseTTL time.Duration
+}
+
+// concurrencyPoll is how often queued requests retry slots released by
+// other instances. Releases on the same instance wake them at once.
+const concurrencyPoll = 100 * time.Millisecond
+
+// Concurrency returns a middleware that bounds the number of requests in
+// flight, per client and in total, using leases from a ConcurrencyStore.
+//
+//   - A slot is held from the time the request is let through until the
+//     handler returns.
+//   - No slot free → the request waits in a bounded queue, if configured,
+//     then is rejected with 429 too_many_in_flight.
+//   - Store error → the request is let through.
+func Concurrency(store ConcurrencyStore, cfg ConcurrencyConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = 5 * time.Second
+	}
+	if cfg.LeaseTTL <= 0 {
+		cfg.LeaseTTL = 30 * time.Second
+	}
+	l := &concurrencyLimiter{store: store, cfg: cfg, log: log, wake: make(chan struct{})}
+
+	return func(next http.Handler) http.Handler {
+		if cfg.PerKey <= 0 && cfg.Total <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			slots := l.slots(r)
+			lease := newLeaseID()
+
+			ok, err := l.acquire(r.Context(), slots, lease)
+			if err == nil && !ok {
+				ok, err = l.wait(r.Context(), slots, lease)
+			}
+			switch {
+			case r.Context().Err() != nil:
+				// The client went away while queued.
+				return
+			case err != nil:
+				log.Warn().Err(err).Str("name", cfg.Name).Msg("concurrency: store error, failing open")
+				next.ServeHTTP(w, r)
+				return
+			case !ok:
+				log.Warn().Str("name", cfg.Name).Msg("concurrency limit exceeded")
+				w.Header().Set("Retry-After", "1")
+				errors.WriteJSON(w, http.StatusTooManyRequests, errors.ErrTooManyInFlight)
+				return
+			}
+
+			stop := l.renew(slots, lease)
+			defer func() {
+				stop()
+				l.release(slots, lease)
+				l.notify()
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type concurrencySlot struct {
+	key   string
+	limit int
+}
+
+type concurrencyLimiter struct {
+	store ConcurrencyStore
+	cfg   ConcurrencyConfig
+	log   zerolog.Logger
+
+	waiting atomic.Int64
+
+	// wake is closed and replaced whenever this instance releases a slot.
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+// slots lists the slots r needs: its client's first, then the global one.
+func (l *concurrencyLimiter) slots(r *http.Request) []concurrencySlot {
+	var slots []concurrencySlot
+	if l.cfg.PerKey > 0 {
+		id, ok := rateLimitKey(r, l.cfg.Key)
+		if !ok {
+			id = "ip=" + utils.ClientIp(r)
+		}
+		slots = append(slots, concurrencySlot{key: "cc:" + l.cfg.Name + ":" + id, limit: l.cfg.PerKey})
+	}
+	if l.cfg.Total > 0 {
+		slots = append(slots, concurrencySlot{key: "cc:" + l.cfg.Name + ":total", limit: l.cfg.Total})
+	}
+	return slots
+}
+
+// acquire takes every slot or none.
+func (l *concurrencyLimiter) acquire(ctx context.Context, slots []concurrencySlot, lease string) (bool, error) {
+	for i, s := range slots {
+		ok, err := l.acquireOne(ctx, s, lease)
+		if err != nil || !ok {
+			l.release(slots[:i], lease)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (l *concurrencyLimiter) acquireOne(ctx context.Context, s concurrencySlot, lease string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	return l.store.Acquire(ctx, s.key, lease, s.limit, l.cfg.LeaseTTL)
+}
+
+// wait queues the request until it gets its slots, the queue timeout passes
+// or the client goes away. It reports false at once when the queue is full.
+func (l *concurrencyLimiter) wait(ctx context.Context, slots []concurrencySlot, lease string) (bool, error) {
+	if l.waiting.Add(1) > int64(l.cfg.MaxQueue) {
+		l.waiting.Add(-1)
+		return false, nil
+	}
+	defer l.waiting.Add(-1)
+
+	timeout := time.NewTimer(l.cfg.QueueTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(concurrencyPoll)
+	defer poll.Stop()
+
+	for {
+		l.mu.Lock()
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case <-timeout.C:
+			return false, nil
+		case <-wake:
+		case <-poll.C:
+		}
+
+		if ok, err := l.acquire(ctx, slots, lease); err != nil || ok {
+			return ok, err
+		}
+	}
+}
+
+// renew keeps the leases alive until the returned function is called.
+func (l *concurrencyLimiter) renew(slots []concurrencySlot, lease string) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(l.cfg.LeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, s := range slots {
+					if _, err := l.acquireOne(context.Background(), s, lease); err != nil {
+						l.log.Debug().Err(err).Str("key", s.key).Msg("concurrency: failed to renew lease")
+					}
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (l *concurrencyLimiter) release(slots []concurrencySlot, lease string) {
+	if len(slots) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	for _, s := range slots {
+		if err := l.store.Release(ctx, s.key, lease); err != nil {
+			l.log.Debug().Err(err).Str("key", s.key).Msg("concurrency: failed to release lease")
+		}
+	}
+}
+
+// notify wakes the requests queued on this instance. It is not called when
+// a partial acquisition is rolled back, or queued requests would keep
+// waking each other.
+func (l *concurrencyLimiter) notify() {
+	l.mu.Lock()
+	close(l.wake)
+	l.wake = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// newLeaseID returns a random lease id, unique across instances.
+func newLeaseID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,126 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockConcurrencyStore wraps the in-memory lease store with error injection.
+type mockConcurrencyStore struct {
+	*ratelimit.MemoryStore
+	err error
+}
+
+func (m *mockConcurrencyStore) Acquire(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+	return m.MemoryStore.Acquire(ctx, key, id, limit, ttl)
+}
+
+// blockingHandler holds every request until release is closed.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func serveConcurrency(handler http.Handler, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = ip + ":1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestConcurrency_PerKeyAndTotal(t *testing.T) {
+	store := &mockConcurrencyStore{MemoryStore: ratelimit.NewMemoryStore()}
+	started, release := make(chan struct{}, 3), make(chan struct{})
+	handler := mw.Concurrency(store, mw.ConcurrencyConfig{Name: "ai", PerKey: 1, Total: 2}, zerolog.Nop())(blockingHandler(started, release))
+
+	done := make(chan int, 2)
+	go func() { done <- serveConcurrency(handler, "10.0.0.1").Code }()
+	<-started
+
+	rr := serveConcurrency(handler, "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "one request in flight per client")
+	assert.Contains(t, rr.Body.String(), `"code":"too_many_in_flight"`)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	go func() { done <- serveConcurrency(handler, "10.0.0.2").Code }()
+	<-started
+
+	assert.Equal(t, http.StatusTooManyRequests, serveConcurrency(handler, "10.0.0.3").Code, "two requests in flight in total")
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	go func() { <-started }()
+	assert.Equal(t, http.StatusOK, serveConcurrency(handler, "10.0.0.1").Code, "slots are released when the request ends")
+}
+
+func TestConcurrency_Queue(t *testing.T) {
+	store := &mockConcurrencyStore{MemoryStore: ratelimit.NewMemoryStore()}
+	started, release := make(chan struct{}, 3), make(chan struct{})
+	handler := mw.Concurrency(store, mw.ConcurrencyConfig{
+		Name:         "ai",
+		Total:        1,
+		MaxQueue:     1,
+		QueueTimeout: 2 * time.Second,
+	}, zerolog.Nop())(blockingHandler(started, release))
+
+	first := make(chan int, 1)
+	go func() { first <- serveConcurrency(handler, "10.0.0.1").Code }()
+	<-started
+
+	queued := make(chan int, 1)
+	go func() { queued <- serveConcurrency(handler, "10.0.0.2").Code }()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, http.StatusTooManyRequests, serveConcurrency(handler, "10.0.0.3").Code, "the queue is full")
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-first)
+	<-started
+	assert.Equal(t, http.StatusOK, <-queued, "the queued request takes the released slot")
+}
+
+func TestConcurrency_QueueTimeout(t *testing.T) {
+	store := &mockConcurrencyStore{MemoryStore: ratelimit.NewMemoryStore()}
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	handler := mw.Concurrency(store, mw.ConcurrencyConfig{
+		Name:         "ai",
+		Total:        1,
+		MaxQueue:     5,
+		QueueTimeout: 50 * time.Millisecond,
+	}, zerolog.Nop())(blockingHandler(started, release))
+
+	go serveConcurrency(handler, "10.0.0.1")
+	<-started
+
+	begin := time.Now()
+	assert.Equal(t, http.StatusTooManyRequests, serveConcurrency(handler, "10.0.0.2").Code)
+	assert.GreaterOrEqual(t, time.Since(begin), 50*time.Millisecond)
+}
+
+func TestConcurrency_StoreError_FailsOpen(t *testing.T) {
+	store := &mockConcurrencyStore{MemoryStore: ratelimit.NewMemoryStore(), err: errors.New("redis down")}
+	handler := mw.Concurrency(store, mw.ConcurrencyConfig{Name: "ai", Total: 1}, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	assert.Equal(t, http.StatusOK, serveConcurrency(handler, "10.0.0.1").Code)
+}
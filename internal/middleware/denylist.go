@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+)
+
+type DenyListConfig struct {
+	// Refresh is how often the list is reloaded from the store, and so how
+	// long runtime changes take to reach every instance. Defaults to 10s.
+	Refresh time.Duration
+
+	// BanThreshold 401 or 429 responses to one client within BanWindow ban
+	// its address for BanTTL. Zero disables automatic bans.
+	BanThreshold int64
+	BanWindow    time.Duration
+	BanTTL       time.Duration
+}
+
+// DenyList returns a middleware that rejects clients on the dynamic denylist
+// kept in a DenyListStore, and bans clients that keep failing
+// authentication or hitting rate limits. It must run outside the route
+// chains so that it sees their responses.
+//
+// The list is held in memory and reloaded in the background every Refresh,
+// so lookups cost no store round trip. A store error keeps the last list.
+// Strikes are recorded in the background, at most maxStrikeWorkers at a
+// time, so that responses never wait on the store; strikes beyond that are
+// dropped rather than piling up goroutines or store calls.
+//
+// Clients are told apart by utils.ClientIp: behind a load balancer, its
+// address must be listed in TRUSTED_PROXIES, or every client shares it.
+//
+//   - Listed address → 403 ip_denied.
+//   - BanThreshold 401/429 responses within BanWindow → the address is
+//     denied for BanTTL on every instance.
+func DenyList(store DenyListStore, cfg DenyListConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = 10 * time.Second
+	}
+	d := &denyList{store: store, cfg: cfg, log: log, workers: make(chan struct{}, maxStrikeWorkers)}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, ok := clientAddr(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			d.refresh()
+			if d.denied(addr) {
+				log.Debug().Str("ip", addr.String()).Msg("denylist: address denied")
+				errors.WriteJSON(w, http.StatusForbidden, errors.ErrIPDenied)
+				return
+			}
+
+			if cfg.BanThreshold <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			if s := ww.Status(); s == http.StatusUnauthorized || s == http.StatusTooManyRequests {
+				d.strikeInBackground(addr)
+			}
+		})
+	}
+}
+
+// maxStrikeWorkers bounds the strikes being recorded at once.
+const maxStrikeWorkers = 16
+
+type denyList struct {
+	store   DenyListStore
+	cfg     DenyListConfig
+	log     zerolog.Logger
+	workers chan struct{}
+
+	mu       sync.RWMutex
+	entries  map[netip.Prefix]time.Time
+	loadedAt time.Time
+
+	loading atomic.Bool
+}
+
+// refresh reloads the list when it is stale: synchronously the first time,
+// in the background afterwards.
+func (d *denyList) refresh() {
+	d.mu.RLock()
+	loadedAt := d.loadedAt
+	d.mu.RUnlock()
+
+	if time.Since(loadedAt) < d.cfg.Refresh || !d.loading.CompareAndSwap(false, true) {
+		return
+	}
+	if loadedAt.IsZero() {
+		d.load()
+		return
+	}
+	go d.load()
+}
+
+func (d *denyList) load() {
+	defer d.loading.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	entries, err := d.store.DenyList(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Retried after the next interval either way.
+	d.loadedAt = time.Now()
+	if err != nil {
+		d.log.Warn().Err(err).Msg("denylist: failed to load, keeping the previous list")
+		return
+	}
+	d.entries = entries
+}
+
+func (d *denyList) denied(addr netip.Addr) bool {
+	now := time.Now()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for prefix, until := range d.entries {
+		if prefix.Contains(addr) && (until.IsZero() || now.Before(until)) {
+			return true
+		}
+	}
+	return false
+}
+
+// strikeInBackground records a strike against addr without holding up the
+// response, or drops it when every worker is busy.
+func (d *denyList) strikeInBackground(addr netip.Addr) {
+	select {
+	case d.workers <- struct{}{}:
+	default:
+		d.log.Debug().Str("ip", addr.String()).Msg("denylist: strike dropped, store busy")
+		return
+	}
+	go func() {
+		defer func() { <-d.workers }()
+		d.strike(addr)
+	}()
+}
+
+// strike counts a failed request against addr and bans it from the
+// threshold on; a repeated ban only renews it.
+func (d *denyList) strike(addr netip.Addr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	n, err := d.store.Strike(ctx, "ipstrike:"+addr.String(), d.cfg.BanWindow)
+	if err != nil {
+		d.log.Debug().Err(err).Msg("denylist: failed to record strike")
+		return
+	}
+	if n < d.cfg.BanThreshold {
+		return
+	}
+
+	prefix := netip.PrefixFrom(addr, addr.BitLen())
+	until := time.Now().Add(d.cfg.BanTTL)
+	if err := d.store.Deny(ctx, prefix, until); err != nil {
+		d.log.Error().Err(err).Str("ip", addr.String()).Msg("denylist: failed to store ban")
+	}
+
+	// Applied locally at once; other instances pick it up on refresh.
+	d.mu.Lock()
+	entries := maps.Clone(d.entries)
+	if entries == nil {
+		entries = make(map[netip.Prefix]time.Time, 1)
+	}
+	entries[prefix] = until
+	d.entries = entries
+	d.mu.Unlock()
+
+	d.log.Warn().
+		Str("ip", addr.String()).
+		Int64("strikes", n).
+		Dur("ttl", d.cfg.BanTTL).
+		Msg("denylist: address banned")
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// StripHeaders returns a middleware that removes gateway-owned headers from
+// every inbound request, so that values such as X-User-Id can only ever be set
+// by the gateway itself. It must run before any authentication middleware.
+//
+// Names are case-insensitive; a trailing "*" matches any header with that
+// prefix (e.g. "X-User-*").
+func StripHeaders(names []string) func(http.Handler) http.Handler {
+	var exact, prefixes []string
+	for _, n := range names {
+		if p, ok := strings.CutSuffix(n, "*"); ok {
+			prefixes = append(prefixes, http.CanonicalHeaderKey(p))
+		} else {
+			exact = append(exact, n)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, n := range exact {
+				r.Header.Del(n)
+			}
+			if len(prefixes) > 0 {
+				for k := range r.Header {
+					for _, p := range prefixes {
+						if strings.HasPrefix(k, p) {
+							delete(r.Header, k)
+							break
+						}
+					}
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/FPT-OJT/gateway/internal/proxy"
+	"github.com/FPT-OJT/gateway/pkg/utils"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ownedHeaders = []string{"X-User-*", "X-Real-IP"}
+
+func TestStripHeaders_RemovesExactAndPrefixMatches(t *testing.T) {
+	var got http.Header
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User-Id", "admin")
+	req.Header.Set("x-user-roles", "admin")
+	req.Header.Set("X-Real-IP", "10.0.0.1")
+	req.Header.Set("X-Request-ID", "keep-me")
+	req.Header.Set("Accept", "application/json")
+
+	mw.StripHeaders(ownedHeaders)(next).ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Empty(t, got.Values("X-User-Id"))
+	assert.Empty(t, got.Values("X-User-Roles"))
+	assert.Empty(t, got.Values("X-Real-IP"))
+	assert.Equal(t, "keep-me", got.Get("X-Request-ID"))
+	assert.Equal(t, "application/json", got.Get("Accept"))
+}
+
+func TestStripHeaders_EmptyList_IsNoop(t *testing.T) {
+	var got string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-User-Id")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User-Id", "someone")
+	mw.StripHeaders(nil)(next).ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "someone", got)
+}
+
+// newSpoofTarget builds StripHeaders → ClientIP → JWTAuth → proxy in front of an upstream
+// that records the headers it receives.
+func newSpoofTarget(t *testing.T) (http.Handler, *http.Header, func() string) {
+	t.Helper()
+	key := generateRSAKey(t)
+
+	received := &http.Header{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	target, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	log := zerolog.Nop()
+	var h http.Handler = proxy.New(proxy.Config{Prefix: "/api/core", StripPrefix: true, Targets: []*url.URL{target}}, log)
+	h = mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{}, log)(h)
+	h = mw.ClientIP(utils.NewClientIPResolver([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, ""))(h)
+	h = mw.StripHeaders(ownedHeaders)(h)
+
+	token := func() string { return signToken(t, key, "real-user", time.Now().Add(time.Hour)) }
+	return h, received, token
+}
+
+func TestStripHeaders_SpoofedIdentity_NeverReachesUpstream(t *testing.T) {
+	spoofed := map[string]string{
+		"X-User-Id":    "admin",
+		"X-User-Roles": "admin,superuser",
+		"X-User-Email": "root@fpt-ojt.dev",
+		"x-user-id":    "admin-lowercase",
+	}
+
+	t.Run("anonymous request", func(t *testing.T) {
+		h, received, _ := newSpoofTarget(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/core/submissions", nil)
+		for k, v := range spoofed {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		for k := range spoofed {
+			assert.Empty(t, received.Values(k), "spoofed %s reached upstream", k)
+		}
+	})
+
+	t.Run("authenticated request", func(t *testing.T) {
+		h, received, token := newSpoofTarget(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/core/submissions", nil)
+		for k, v := range spoofed {
+			req.Header.Add(k, v)
+		}
+		req.Header.Set("Authorization", "Bearer "+token())
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"real-user"}, received.Values("X-User-Id"))
+		assert.Empty(t, received.Values("X-User-Roles"))
+		assert.Empty(t, received.Values("X-User-Email"))
+	})
+
+	t.Run("forged X-Real-IP is replaced by the gateway", func(t *testing.T) {
+		h, received, _ := newSpoofTarget(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/core/submissions", nil)
+		req.RemoteAddr = "198.51.100.7:4321"
+		req.Header.Set("X-Real-IP", "127.0.0.1")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "198.51.100.7", received.Get("X-Real-IP"))
+	})
+
+	t.Run("forged forwarding headers are replaced by the gateway", func(t *testing.T) {
+		h, received, _ := newSpoofTarget(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/core/submissions", nil)
+		req.RemoteAddr = "198.51.100.7:4321"
+		req.Header.Set("X-Forwarded-For", "127.0.0.1")
+		req.Header.Set("Forwarded", "for=127.0.0.1")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "198.51.100.7", received.Get("X-Forwarded-For"))
+		assert.Equal(t, "198.51.100.7", received.Get("X-Real-IP"))
+		assert.Empty(t, received.Get("Forwarded"))
+	})
+
+	t.Run("client behind a trusted proxy", func(t *testing.T) {
+		h, received, _ := newSpoofTarget(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/core/submissions", nil)
+		req.RemoteAddr = "10.0.0.2:4321"
+		req.Header.Set("X-Forwarded-For", "127.0.0.1, 198.51.100.7")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "198.51.100.7", received.Get("X-Real-IP"))
+		assert.Equal(t, "198.51.100.7, 10.0.0.2", received.Get("X-Forwarded-For"))
+	})
+}
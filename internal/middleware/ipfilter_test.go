@@ -0,0 +1,176 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func servedFrom(handler http.Handler, remoteAddr string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestIPAccess_OrderedRules(t *testing.T) {
+	rules := []mw.IPRule{
+		{Allow: false, Prefixes: []netip.Prefix{netip.MustParsePrefix("10.1.2.0/24")}},
+		{Allow: true, Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}},
+		{Allow: false, Prefixes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}},
+	}
+	handler := mw.IPAccess(rules, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		addr string
+		want int
+	}{
+		{"10.9.9.9:1234", http.StatusOK},
+		{"10.1.2.3:1234", http.StatusForbidden},
+		{"192.0.2.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"[2001:db9::1]:1234", http.StatusForbidden},
+		{"[::ffff:10.9.9.9]:1234", http.StatusOK},
+		{"not-an-ip", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, servedFrom(handler, tc.addr), tc.addr)
+	}
+}
+
+func TestIPAccess_NoRulesAllowsEverything(t *testing.T) {
+	handler := mw.IPAccess(nil, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	assert.Equal(t, http.StatusOK, servedFrom(handler, "not-an-ip"))
+}
+
+// mockDenyListStore is an in-memory DenyListStore.
+type mockDenyListStore struct {
+	mu      sync.Mutex
+	entries map[netip.Prefix]time.Time
+	strikes map[string]int64
+}
+
+func newMockDenyListStore() *mockDenyListStore {
+	return &mockDenyListStore{entries: make(map[netip.Prefix]time.Time), strikes: make(map[string]int64)}
+}
+
+func (m *mockDenyListStore) DenyList(context.Context) (map[netip.Prefix]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[netip.Prefix]time.Time, len(m.entries))
+	for p, t := range m.entries {
+		out[p] = t
+	}
+	return out, nil
+}
+
+func (m *mockDenyListStore) Deny(_ context.Context, prefix netip.Prefix, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[prefix] = until
+	return nil
+}
+
+func (m *mockDenyListStore) Undeny(_ context.Context, prefix netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, prefix)
+	return nil
+}
+
+func (m *mockDenyListStore) Strike(_ context.Context, key string, _ time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.strikes[key]++
+	return m.strikes[key], nil
+}
+
+func TestDenyList_DeniesListedAddresses(t *testing.T) {
+	store := newMockDenyListStore()
+	store.entries[netip.MustParsePrefix("203.0.113.0/24")] = time.Time{}
+	store.entries[netip.MustParsePrefix("198.51.100.7/32")] = time.Now().Add(-time.Minute)
+
+	handler := mw.DenyList(store, mw.DenyListConfig{Refresh: 20 * time.Millisecond}, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	assert.Equal(t, http.StatusForbidden, servedFrom(handler, "203.0.113.9:1234"))
+	assert.Equal(t, http.StatusOK, servedFrom(handler, "198.51.100.7:1234"), "lapsed entries are ignored")
+	assert.Equal(t, http.StatusOK, servedFrom(handler, "192.0.2.1:1234"))
+
+	// Runtime changes are picked up on the next refresh.
+	_ = store.Deny(context.Background(), netip.MustParsePrefix("192.0.2.0/24"), time.Time{})
+	time.Sleep(30 * time.Millisecond)
+	servedFrom(handler, "192.0.2.1:1234") // triggers the background reload
+	assert.Eventually(t, func() bool {
+		return servedFrom(handler, "192.0.2.1:1234") == http.StatusForbidden
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDenyList_BansRepeatedFailures(t *testing.T) {
+	store := newMockDenyListStore()
+	status := http.StatusUnauthorized
+	handler := mw.DenyList(store, mw.DenyListConfig{
+		BanThreshold: 3,
+		BanWindow:    time.Minute,
+		BanTTL:       time.Hour,
+	}, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+
+	for range 3 {
+		assert.Equal(t, http.StatusUnauthorized, servedFrom(handler, "192.0.2.1:1234"))
+	}
+	assert.Eventually(t, func() bool {
+		return servedFrom(handler, "192.0.2.1:1234") == http.StatusForbidden
+	}, time.Second, 10*time.Millisecond, "the third 401 bans the address")
+
+	store.mu.Lock()
+	until, ok := store.entries[netip.MustParsePrefix("192.0.2.1/32")]
+	store.mu.Unlock()
+	assert.True(t, ok, "the ban is shared through the store")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), until, time.Minute)
+
+	status = http.StatusOK
+	assert.Equal(t, http.StatusOK, servedFrom(handler, "192.0.2.2:1234"), "other clients are unaffected")
+}
+
+// stallingDenyListStore records strikes only once the caller gives up.
+type stallingDenyListStore struct {
+	*mockDenyListStore
+}
+
+func (s stallingDenyListStore) Strike(ctx context.Context, _ string, _ time.Duration) (int64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestDenyList_StrikesDoNotHoldUpResponses(t *testing.T) {
+	handler := mw.DenyList(stallingDenyListStore{newMockDenyListStore()}, mw.DenyListConfig{
+		BanThreshold: 1,
+		BanWindow:    time.Minute,
+		BanTTL:       time.Hour,
+	}, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	start := time.Now()
+	for range 50 {
+		assert.Equal(t, http.StatusUnauthorized, servedFrom(handler, "192.0.2.1:1234"))
+	}
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "responses must not wait for the store")
+	assert.Equal(t, http.StatusUnauthorized, servedFrom(handler, "192.0.2.1:1234"), "failed strikes ban nobody")
+}
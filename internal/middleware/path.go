@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/FPT-OJT/gateway/pkg/errors"
+)
+
+// RejectDotSegments answers 400 to requests whose path contains "." or ".."
+// segments, percent-encoded or not. Routes, auth modes and cache keys are
+// chosen by path prefix and the path is proxied as is, so "/public/../admin"
+// would pass as public while a normalising upstream serves "/admin".
+func RejectDotSegments(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasDotSegment(r.URL.Path) {
+			errors.WriteJSON(w, http.StatusBadRequest, errors.ErrBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasDotSegment reports whether the decoded path p has a "." or ".."
+// segment.
+func hasDotSegment(p string) bool {
+	for seg := range strings.SplitSeq(p, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectDotSegments(t *testing.T) {
+	handler := mw.RejectDotSegments(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/api/core/problems", http.StatusOK},
+		{"/api/core/v1.2/..data", http.StatusOK},
+		{"/api/core/public/../secret", http.StatusBadRequest},
+		{"/api/core/public/%2e%2e/secret", http.StatusBadRequest},
+		{"/api/core/public%2f..%2fsecret", http.StatusBadRequest},
+		{"/api/core/./secret", http.StatusBadRequest},
+		{"/api/core/..", http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			assert.Equal(t, tc.want, rr.Code)
+		})
+	}
+}
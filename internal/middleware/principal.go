@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Principal is the verified identity behind a request. It is stored in the
+// request context by the authentication middleware so that later middleware
+// (rate limiting, caching, authorization) can key off it.
+type Principal struct {
+	Subject string
+	Roles   []string
+	Scopes  []string
+	Email   string
+	Tenant  string
+	// TokenID and IssuedAt come from the "jti" and "iat" claims and are zero
+	// when the token does not carry them. For API keys TokenID is the key's
+	// HashAPIKey digest.
+	TokenID  string
+	IssuedAt time.Time
+	// Method records how the request was authenticated.
+	Method string
+	// Tier is the rate-limit tier of an API key; empty for JWTs.
+	Tier string
+	// Claims holds the raw token claims.
+	Claims map[string]any
+}
+
+// Authentication methods recorded in Principal.Method.
+const (
+	AuthMethodJWT    = "jwt"
+	AuthMethodAPIKey = "api_key"
+)
+
+// PrincipalContextKey is used to store the *Principal in the request context.
+type PrincipalContextKey struct{}
+
+// PrincipalFrom returns the authenticated principal of the request, if any.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(PrincipalContextKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// withPrincipal stores p in the context under both PrincipalContextKey and the
+// legacy UserContextKey.
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	ctx = context.WithValue(ctx, UserContextKey{}, p.Subject)
+	return context.WithValue(ctx, PrincipalContextKey{}, p)
+}
+
+// ClaimHeader forwards a token claim to the upstream as a request header.
+type ClaimHeader struct {
+	// Claim is a dot-separated path into the claims, e.g. "org.id".
+	Claim  string
+	Header string
+}
+
+// ClaimNames tells JWTAuth which claims populate the Principal fields.
+// Claim names may be dot-separated paths.
+type ClaimNames struct {
+	Roles  string
+	Scopes string
+	Email  string
+	Tenant string
+}
+
+// newPrincipal builds a Principal from verified token claims.
+func newPrincipal(sub string, claims map[string]any, names ClaimNames) *Principal {
+	p := &Principal{Subject: sub, Method: AuthMethodJWT, Claims: claims}
+	p.TokenID, _ = claims["jti"].(string)
+	if iat, ok := claims["iat"].(float64); ok {
+		p.IssuedAt = time.Unix(int64(iat), 0)
+	}
+	if v, ok := lookupClaim(claims, names.Roles); ok {
+		p.Roles = claimStrings(v)
+	}
+	if v, ok := lookupClaim(claims, names.Scopes); ok {
+		p.Scopes = claimStrings(v)
+	}
+	if v, ok := lookupClaim(claims, names.Email); ok {
+		p.Email, _ = claimString(v)
+	}
+	if v, ok := lookupClaim(claims, names.Tenant); ok {
+		p.Tenant, _ = claimString(v)
+	}
+	return p
+}
+
+// setClaimHeaders copies the mapped claims onto the request headers. Arrays
+// are joined with commas; values longer than maxBytes or containing control
+// characters are dropped rather than truncated.
+func setClaimHeaders(r *http.Request, claims map[string]any, mapping []ClaimHeader, maxBytes int, log zerolog.Logger) {
+	for _, m := range mapping {
+		v, ok := lookupClaim(claims, m.Claim)
+		if !ok {
+			continue
+		}
+		s, ok := claimString(v)
+		if !ok || s == "" {
+			continue
+		}
+		if maxBytes > 0 && len(s) > maxBytes {
+			log.Warn().Str("claim", m.Claim).Int("bytes", len(s)).Msg("auth: claim too large to forward, dropping header")
+			continue
+		}
+		if strings.ContainsFunc(s, func(c rune) bool { return c < 0x20 || c == 0x7f }) {
+			log.Warn().Str("claim", m.Claim).Msg("auth: claim contains control characters, dropping header")
+			continue
+		}
+		r.Header.Set(m.Header, s)
+	}
+}
+
+func lookupClaim(claims map[string]any, path string) (any, bool) {
+	if path == "" {
+		return nil, false
+	}
+	var cur any = claims
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, cur != nil
+}
+
+// claimString renders a claim value as a single header-friendly string.
+func claimString(v any) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	case []any:
+		parts := make([]string, 0, len(t))
+		for _, e := range t {
+			s, ok := claimString(e)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), true
+	default:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+}
+
+// claimStrings reads a list claim: either a JSON array or a space separated
+// string (the OAuth "scope" format).
+func claimStrings(v any) []string {
+	switch t := v.(type) {
+	case string:
+		return strings.Fields(t)
+	case []any:
+		out := make([]string, 0, len(t))
+		for _, e := range t {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
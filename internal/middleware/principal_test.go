@@ -0,0 +1,120 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testClaimNames = mw.ClaimNames{
+	Roles:  "roles",
+	Scopes: "scope",
+	Email:  "email",
+	Tenant: "org.id",
+}
+
+func TestJWTAuth_StoresPrincipalInContext(t *testing.T) {
+	key := generateRSAKey(t)
+
+	var principal *mw.Principal
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = mw.PrincipalFrom(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{Claims: testClaimNames}, zerolog.Nop())(next)
+	token := signClaims(t, key, jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":   "user-7",
+		"roles": []string{"student", "ta"},
+		"scope": "submissions:read submissions:write",
+		"email": "user7@fpt.edu.vn",
+		"org":   map[string]any{"id": "fpt-hcm"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, principal)
+	assert.Equal(t, "user-7", principal.Subject)
+	assert.Equal(t, []string{"student", "ta"}, principal.Roles)
+	assert.Equal(t, []string{"submissions:read", "submissions:write"}, principal.Scopes)
+	assert.Equal(t, "user7@fpt.edu.vn", principal.Email)
+	assert.Equal(t, "fpt-hcm", principal.Tenant)
+}
+
+func TestJWTAuth_NoToken_NoPrincipal(t *testing.T) {
+	key := generateRSAKey(t)
+
+	found := true
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, found = mw.PrincipalFrom(r.Context())
+	})
+
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), mw.JWTConfig{}, zerolog.Nop())(next)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.False(t, found)
+}
+
+func TestJWTAuth_ClaimHeaders(t *testing.T) {
+	key := generateRSAKey(t)
+
+	var got http.Header
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	})
+
+	cfg := mw.JWTConfig{
+		ClaimHeaders: []mw.ClaimHeader{
+			{Claim: "roles", Header: "X-User-Roles"},
+			{Claim: "email", Header: "X-User-Email"},
+			{Claim: "org.id", Header: "X-User-Org"},
+			{Claim: "org.plan", Header: "X-User-Plan"},
+			{Claim: "verified", Header: "X-User-Verified"},
+			{Claim: "level", Header: "X-User-Level"},
+			{Claim: "bio", Header: "X-User-Bio"},
+			{Claim: "groups", Header: "X-User-Groups"},
+			{Claim: "missing", Header: "X-User-Missing"},
+		},
+		MaxClaimHeaderBytes: 64,
+	}
+	handler := mw.JWTAuth(mw.StaticKey(&key.PublicKey), cfg, zerolog.Nop())(next)
+
+	token := signClaims(t, key, jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":      "user-7",
+		"roles":    []string{"student", "ta"},
+		"email":    "user7@fpt.edu.vn",
+		"org":      map[string]any{"id": "fpt-hcm"},
+		"verified": true,
+		"level":    3,
+		"bio":      strings.Repeat("x", 65),
+		"groups":   []string{"line\r\nInjected: yes"},
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "user-7", got.Get("X-User-Id"))
+	assert.Equal(t, "student,ta", got.Get("X-User-Roles"))
+	assert.Equal(t, "user7@fpt.edu.vn", got.Get("X-User-Email"))
+	assert.Equal(t, "fpt-hcm", got.Get("X-User-Org"))
+	assert.Equal(t, "true", got.Get("X-User-Verified"))
+	assert.Equal(t, "3", got.Get("X-User-Level"))
+	assert.Empty(t, got.Values("X-User-Plan"), "absent nested claim")
+	assert.Empty(t, got.Values("X-User-Missing"), "absent claim")
+	assert.Empty(t, got.Values("X-User-Bio"), "values above the size limit are dropped")
+	assert.Empty(t, got.Values("X-User-Groups"), "values with control characters are dropped")
+	assert.Empty(t, got.Values("Injected"))
+}
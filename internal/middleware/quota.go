@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/FPT-OJT/gateway/pkg/utils"
+	"github.com/rs/zerolog"
+)
+
+// QuotaConfig is a long-window quota, e.g. 200 requests per user per day.
+type QuotaConfig struct {
+	Name   string
+	Limit  int64
+	Window ratelimit.Window
+	// Key selects whose usage is counted. Requests the key cannot be built
+	// for are counted against the client IP.
+	Key ratelimit.Key
+}
+
+// QuotaStatus is a caller's usage of one quota.
+type QuotaStatus struct {
+	Name      string           `json:"name"`
+	Window    ratelimit.Window `json:"window"`
+	Limit     int64            `json:"limit"`
+	Used      int64            `json:"used"`
+	Remaining int64            `json:"remaining"`
+	ResetAt   time.Time        `json:"reset_at"`
+}
+
+// Quota returns a middleware that charges each request to every quota in
+// quotas. Counters live in the QuotaStore, one per quota, caller and window,
+// and expire when the window resets.
+//
+//   - Allowed → X-Quota-Name, X-Quota-Limit, X-Quota-Remaining and
+//     X-Quota-Reset (Unix seconds) describe the quota closest to exhaustion.
+//   - Any quota exhausted → 429 quota_exceeded naming the quota, with
+//     Retry-After set to its reset. Nothing is charged.
+//   - Store error → the request is let through, whatever the rate limit
+//     failure mode: quotas bound usage over hours or days, which a short
+//     outage barely affects, and cannot be kept per instance the way rate
+//     limits are.
+func Quota(store QuotaStore, quotas []QuotaConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(quotas) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			counters := quotaCounters(r, quotas, now)
+
+			ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+			defer cancel()
+
+			used, allowed, err := store.ConsumeQuota(ctx, counters, 1)
+			if err != nil {
+				log.Warn().Err(err).Msg("quota: store error, failing open")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			statuses := quotaStatuses(quotas, counters, used)
+
+			if !allowed {
+				var exhausted QuotaStatus
+				for _, st := range statuses {
+					if st.Used+1 > st.Limit {
+						exhausted = st
+						break
+					}
+				}
+				exhausted.Remaining = 0
+				setQuotaHeaders(w, exhausted)
+
+				log.Warn().Str("quota", exhausted.Name).Int64("limit", exhausted.Limit).Msg("quota exceeded")
+
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(exhausted.ResetAt.Sub(now))))
+				errors.WriteJSON(w, http.StatusTooManyRequests, errors.ErrorResponse{
+					Code:    errors.ErrQuotaExceeded.Code,
+					Message: errors.ErrQuotaExceeded.Message,
+					Detail:  exhausted,
+				})
+				return
+			}
+
+			tightest := statuses[0]
+			for _, st := range statuses[1:] {
+				if st.Remaining < tightest.Remaining {
+					tightest = st
+				}
+			}
+			setQuotaHeaders(w, tightest)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// QuotaUsage reports the caller's current usage of each quota without
+// charging it.
+func QuotaUsage(ctx context.Context, store QuotaStore, quotas []QuotaConfig, r *http.Request) ([]QuotaStatus, error) {
+	counters := quotaCounters(r, quotas, time.Now())
+	keys := make([]string, len(counters))
+	for i, c := range counters {
+		keys[i] = c.Key
+	}
+	used, err := store.QuotaUsage(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	return quotaStatuses(quotas, counters, used), nil
+}
+
+// quotaCounters builds the counter of each quota for r in the window
+// containing now. The key embeds the window start so that a new window
+// always starts from zero, whatever the counter's expiry.
+func quotaCounters(r *http.Request, quotas []QuotaConfig, now time.Time) []ratelimit.QuotaCounter {
+	counters := make([]ratelimit.QuotaCounter, len(quotas))
+	for i, q := range quotas {
+		id, ok := rateLimitKey(r, q.Key)
+		if !ok {
+			id = "ip=" + utils.ClientIp(r)
+		}
+		start, reset := q.Window.Bounds(now)
+		counters[i] = ratelimit.QuotaCounter{
+			Key:     "quota:" + q.Name + ":" + id + ":" + strconv.FormatInt(start.Unix(), 10),
+			Limit:   q.Limit,
+			ResetAt: reset,
+		}
+	}
+	return counters
+}
+
+func quotaStatuses(quotas []QuotaConfig, counters []ratelimit.QuotaCounter, used []int64) []QuotaStatus {
+	statuses := make([]QuotaStatus, len(quotas))
+	for i, q := range quotas {
+		statuses[i] = QuotaStatus{
+			Name:      q.Name,
+			Window:    q.Window,
+			Limit:     q.Limit,
+			Used:      used[i],
+			Remaining: max(0, q.Limit-used[i]),
+			ResetAt:   counters[i].ResetAt,
+		}
+	}
+	return statuses
+}
+
+func setQuotaHeaders(w http.ResponseWriter, st QuotaStatus) {
+	w.Header().Set("X-Quota-Name", st.Name)
+	w.Header().Set("X-Quota-Limit", strconv.FormatInt(st.Limit, 10))
+	w.Header().Set("X-Quota-Remaining", strconv.FormatInt(st.Remaining, 10))
+	w.Header().Set("X-Quota-Reset", strconv.FormatInt(st.ResetAt.Unix(), 10))
+}
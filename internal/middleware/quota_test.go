@@ -0,0 +1,96 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockQuotaStore wraps the in-memory quota store with error injection.
+type mockQuotaStore struct {
+	*ratelimit.MemoryStore
+	err error
+}
+
+func (m *mockQuotaStore) ConsumeQuota(ctx context.Context, counters []ratelimit.QuotaCounter, n int64) ([]int64, bool, error) {
+	if m.err != nil {
+		return nil, false, m.err
+	}
+	return m.MemoryStore.ConsumeQuota(ctx, counters, n)
+}
+
+var testQuotas = []mw.QuotaConfig{
+	{Name: "daily", Limit: 3, Window: ratelimit.Day, Key: ratelimit.Key{{Source: ratelimit.SourceUser}}},
+	{Name: "hourly", Limit: 2, Window: ratelimit.Hour, Key: ratelimit.Key{{Source: ratelimit.SourceUser}}},
+}
+
+func quotaRequest(sub string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if sub != "" {
+		req = withPrincipal(req, &mw.Principal{Subject: sub})
+		req = req.WithContext(context.WithValue(req.Context(), mw.UserContextKey{}, sub))
+	}
+	return req
+}
+
+func serveQuota(handler http.Handler, sub string) *httptest.ResponseRecorder {
+	req := quotaRequest(sub)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestQuota_ExhaustsTightestQuota(t *testing.T) {
+	store := &mockQuotaStore{MemoryStore: ratelimit.NewMemoryStore()}
+	handler := mw.Quota(store, testQuotas, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := serveQuota(handler, "alice")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "hourly", rr.Header().Get("X-Quota-Name"))
+	assert.Equal(t, "2", rr.Header().Get("X-Quota-Limit"))
+	assert.Equal(t, "1", rr.Header().Get("X-Quota-Remaining"))
+	_, reset := ratelimit.Hour.Bounds(time.Now())
+	assert.Equal(t, strconv.FormatInt(reset.Unix(), 10), rr.Header().Get("X-Quota-Reset"))
+
+	assert.Equal(t, http.StatusOK, serveQuota(handler, "alice").Code)
+
+	rr = serveQuota(handler, "alice")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"quota_exceeded"`)
+	assert.Contains(t, rr.Body.String(), `"name":"hourly"`)
+	assert.Equal(t, "0", rr.Header().Get("X-Quota-Remaining"))
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, serveQuota(handler, "bob").Code, "quotas are counted per user")
+	assert.Equal(t, http.StatusOK, serveQuota(handler, "").Code, "anonymous callers are counted by IP")
+
+	usage, err := mw.QuotaUsage(context.Background(), store, testQuotas, quotaRequest("alice"))
+	require.NoError(t, err)
+	require.Len(t, usage, 2)
+	assert.Equal(t, mw.QuotaStatus{Name: "daily", Window: ratelimit.Day, Limit: 3, Used: 2, Remaining: 1, ResetAt: usage[0].ResetAt}, usage[0])
+	assert.Equal(t, int64(0), usage[1].Remaining)
+}
+
+func TestQuota_StoreError_FailsOpen(t *testing.T) {
+	store := &mockQuotaStore{MemoryStore: ratelimit.NewMemoryStore(), err: errors.New("redis down")}
+	handler := mw.Quota(store, testQuotas, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := serveQuota(handler, "alice")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("X-Quota-Name"))
+}
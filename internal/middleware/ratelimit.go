@@ -4,67 +4,326 @@ package middleware
 import (
 	"context"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/FPT-OJT/gateway/pkg/errors"
 	"github.com/FPT-OJT/gateway/pkg/utils"
 	"github.com/rs/zerolog"
 )
 
 type RateLimitConfig struct {
+	// Policy names the limit. Each policy counts requests separately and its
+	// name is reported in headers and 429 responses. Defaults to "default".
+	Policy string
+
+	// RPS is the sustained request rate per client.
+	RPS int
+	// Burst is the number of requests allowed on top of RPS when a client
+	// has been idle, so an idle client may send RPS+Burst at once.
+	Burst int
+
+	// AnonymousRPS and AnonymousBurst apply to requests without a Principal.
+	// A zero AnonymousRPS applies RPS and Burst to them as well.
+	AnonymousRPS   int
+	AnonymousBurst int
+
+	// Key selects the bucket a request is counted against. Empty keys on the
+	// client IP.
+	Key ratelimit.Key
+
+	// Tiers overrides RPS and Burst for API keys of the named tier.
+	Tiers map[string]RateLimitTier
+
+	// Cost is what a request takes from the bucket.
+	Cost RateLimitCost
+
+	// FailClosed rejects requests with 503 when the store returns an error
+	// instead of letting them through.
+	FailClosed bool
+}
+
+// RateLimitCost weighs requests by how expensive they are to serve.
+type RateLimitCost struct {
+	// Weight is taken from the bucket per request. Defaults to 1.
+	Weight int
+	// BytesPerUnit adds one unit per started BytesPerUnit of request body,
+	// as declared by Content-Length. Bodies of unknown length (chunked) are
+	// charged the whole bucket. Zero disables it.
+	BytesPerUnit int64
+	// Header names a response header in which the upstream reports the
+	// request's actual cost. Any excess over what was charged up front is
+	// debited once the response starts, up to maxReportedCostBursts bucket
+	// sizes; the header is not forwarded.
+	Header string
+}
+
+// RateLimitTier is the limit applied to API keys of one tier.
+type RateLimitTier struct {
 	RPS   int
 	Burst int
 }
 
-// RateLimit returns a middleware that enforces a per-IP sliding-window rate
-// limit backed by a RateLimiterStore.
-//
-// Algorithm: Store INCR + EXPIRE per (IP, second) key.
-//   - First request in a window: INCR → 1, then EXPIRE sets TTL to 2 s.
-//   - Subsequent requests: INCR increments the counter.
-//   - If counter > RPS+Burst → 429 Too Many Requests.
+// RateLimitRule applies a policy to the requests matching Methods and Paths
+// (chi-style patterns on the full request path).
+type RateLimitRule struct {
+	Methods []string
+	Paths   []string
+	Policy  RateLimitConfig
+}
+
+// RateLimitRules returns a middleware that applies the policy of the first
+// rule matching the request, or fallback when none does.
+func RateLimitRules(store RateLimiterStore, rules []RateLimitRule, fallback RateLimitConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	matchers := make([]requestMatcher, 0, len(rules))
+	for _, rule := range rules {
+		matchers = append(matchers, newRequestMatcher(rule.Methods, rule.Paths, "rate limit", log))
+	}
+
+	return func(next http.Handler) http.Handler {
+		limited := make([]http.Handler, 0, len(rules))
+		for _, rule := range rules {
+			limited = append(limited, RateLimit(store, rule.Policy, log)(next))
+		}
+		def := RateLimit(store, fallback, log)(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if i := firstMatch(matchers, r); i >= 0 {
+				limited[i].ServeHTTP(w, r)
+				return
+			}
+			def.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimit returns a middleware that enforces a GCRA (token bucket) rate
+// limit backed by a RateLimiterStore. To key on the user or API key it must
+// run after authentication.
 //
-// The 2-second TTL gives a small grace window across second boundaries while
-// keeping memory use bounded.
+// Each client owns a bucket of RPS+Burst requests refilled at RPS requests
+// per second. The bucket is updated atomically by the store, so there are no
+// window boundaries to game and no partially written state.
+//   - The bucket is chosen by Key. When the key cannot be built, e.g. "user"
+//     for an anonymous request, the client IP is used instead.
+//   - Anonymous and authenticated requests use separate buckets and limits;
+//     API keys whose tier is listed in Tiers get that tier's limit.
+//   - Buckets are namespaced by Policy, so policies never share counters.
+//   - A request takes its Cost from the bucket, capped at the bucket size
+//     so that expensive requests remain possible.
+//   - Every response carries the RateLimit-Policy and RateLimit fields of
+//     the IETF RateLimit header draft, and the legacy X-RateLimit-Limit,
+//     X-RateLimit-Remaining and X-RateLimit-Reset (Unix seconds) headers.
+//   - Empty bucket → 429 rate_limited with Retry-After set to the seconds
+//     until the next request would be allowed, repeated in the detail.
+//   - Store error → the request is let through, or rejected with 503 when
+//     FailClosed is set. Wrap the store in a FallbackLimiter to count
+//     requests locally instead.
 func RateLimit(store RateLimiterStore, cfg RateLimitConfig, log zerolog.Logger) func(http.Handler) http.Handler {
-	limit := cfg.RPS + cfg.Burst
+	if cfg.Policy == "" {
+		cfg.Policy = "default"
+	}
+	authenticated := ratelimit.PerSecond(cfg.RPS, cfg.RPS+cfg.Burst)
+	anonymous := authenticated
+	if cfg.AnonymousRPS > 0 {
+		anonymous = ratelimit.PerSecond(cfg.AnonymousRPS, cfg.AnonymousRPS+cfg.AnonymousBurst)
+	}
+
+	tiers := make(map[string]ratelimit.Limit, len(cfg.Tiers))
+	for name, t := range cfg.Tiers {
+		tiers[name] = ratelimit.PerSecond(t.RPS, t.RPS+t.Burst)
+	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := utils.ClientIp(r)
-			key := fmt.Sprintf("rl:%s:%d", ip, time.Now().UTC().Unix())
+			limit, prefix := anonymous, "rl:"+cfg.Policy+":anon:"
+			if principal, ok := PrincipalFrom(r.Context()); ok {
+				limit, prefix = authenticated, "rl:"+cfg.Policy+":"
+				if tier, ok := tiers[principal.Tier]; ok && principal.Method == AuthMethodAPIKey {
+					limit, prefix = tier, "rl:"+cfg.Policy+":tier="+principal.Tier+":"
+				}
+			}
+
+			id, ok := rateLimitKey(r, cfg.Key)
+			if !ok {
+				id = "ip=" + utils.ClientIp(r)
+			}
+			key := prefix + id
 
 			ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
 			defer cancel()
 
-			count, err := store.Incr(ctx, key)
+			cost := requestCost(r, cfg.Cost, limit.Burst)
+			res, err := store.AllowN(ctx, key, limit, cost)
 			if err != nil {
-				log.Warn().Err(err).Str("ip", ip).Msg("rate limit: store error, failing open")
+				if cfg.FailClosed {
+					log.Debug().Err(err).Str("policy", cfg.Policy).Msg("rate limit: store error, failing closed")
+					errors.WriteJSON(w, http.StatusServiceUnavailable, errors.ErrUnavailable)
+					return
+				}
+				log.Debug().Err(err).Str("policy", cfg.Policy).Msg("rate limit: store error, failing open")
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			if count == 1 {
-				_ = store.Expire(ctx, key, 2*time.Second)
-			}
+			setRateLimitHeaders(w, cfg.Policy, limit, res)
 
-			if int(count) > limit {
+			if !res.Allowed {
 				log.Warn().
-					Str("ip", ip).
-					Int64("count", count).
-					Int("limit", limit).
+					Str("policy", cfg.Policy).
+					Str("key", key).
+					Int("limit", res.Limit).
+					Dur("retry_after", res.RetryAfter).
 					Msg("rate limit exceeded")
+				writeRateLimited(w, cfg.Policy, res)
+				return
+			}
 
-				w.Header().Set("Retry-After", "1")
-				w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", limit))
-				w.Header().Set("X-RateLimit-Remaining", "0")
-				http.Error(w, `{"code":"rate_limited","message":"Too many requests"}`, http.StatusTooManyRequests)
+			if cfg.Cost.Header == "" {
+				next.ServeHTTP(w, r)
 				return
 			}
 
-			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", limit))
-			w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", limit-int(count)))
-			next.ServeHTTP(w, r)
+			cw := &costWriter{ResponseWriter: w, header: cfg.Cost.Header}
+			next.ServeHTTP(cw, r)
+
+			if extra := min(cw.cost, maxReportedCostBursts*limit.Burst) - cost; extra > 0 {
+				debitCtx, debitCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				defer debitCancel()
+				if err := store.DebitN(debitCtx, key, limit, extra); err != nil {
+					log.Warn().Err(err).Str("policy", cfg.Policy).Msg("rate limit: failed to debit reported cost")
+				}
+			}
 		})
 	}
 }
+
+// RateLimitDetail is the detail of a rate_limited error response.
+type RateLimitDetail struct {
+	Policy string `json:"policy"`
+	Limit  int    `json:"limit"`
+	// RetryAfter is the number of seconds to wait, as in Retry-After.
+	RetryAfter int `json:"retry_after"`
+}
+
+// writeRateLimited writes the 429 response for a request denied by res.
+func writeRateLimited(w http.ResponseWriter, policy string, res ratelimit.Result) {
+	retryAfter := retryAfterSeconds(res.RetryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	errors.WriteJSON(w, http.StatusTooManyRequests, errors.ErrorResponse{
+		Code:    errors.ErrRateLimited.Code,
+		Message: errors.ErrRateLimited.Message,
+		Detail:  RateLimitDetail{Policy: policy, Limit: res.Limit, RetryAfter: retryAfter},
+	})
+}
+
+// setRateLimitHeaders describes the bucket in both the draft standard and the
+// legacy headers. A GCRA bucket maps onto the draft's quota as its capacity,
+// and its window as the time an empty bucket takes to refill.
+func setRateLimitHeaders(w http.ResponseWriter, policy string, limit ratelimit.Limit, res ratelimit.Result) {
+	window := retryAfterSeconds(time.Duration(limit.Tolerance()) * time.Microsecond)
+	reset := retryAfterSeconds(res.ResetAfter)
+	if !res.Allowed {
+		reset = retryAfterSeconds(res.RetryAfter)
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Policy", fmt.Sprintf("%q;q=%d;w=%d", policy, res.Limit, window))
+	h.Set("RateLimit", fmt.Sprintf("%q;r=%d;t=%d", policy, res.Remaining, reset))
+	h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Duration(reset)*time.Second).Unix(), 10))
+}
+
+// maxReportedCostBursts caps the cost an upstream may report, in bucket
+// sizes, so that a bogus value cannot push a client out for good or overflow
+// the bucket's state.
+const maxReportedCostBursts = 4
+
+// requestCost is the up-front cost of r, capped at limit so that expensive
+// requests remain possible.
+func requestCost(r *http.Request, c RateLimitCost, limit int) int {
+	cost := max(1, c.Weight)
+	if c.BytesPerUnit > 0 {
+		if r.ContentLength < 0 {
+			return limit
+		}
+		cost += int((r.ContentLength + c.BytesPerUnit - 1) / c.BytesPerUnit)
+	}
+	return min(cost, limit)
+}
+
+// costWriter removes the upstream's cost header from the response and keeps
+// its value.
+type costWriter struct {
+	http.ResponseWriter
+	header      string
+	cost        int
+	wroteHeader bool
+}
+
+func (w *costWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.ResponseWriter.Header()
+		if n, err := strconv.Atoi(h.Get(w.header)); err == nil && n > 0 {
+			w.cost = n
+		}
+		h.Del(w.header)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *costWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so that
+// streamed responses are still flushed.
+func (w *costWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// rateLimitKey builds the bucket id for r from key, reporting false when a
+// part has no value for this request.
+func rateLimitKey(r *http.Request, key ratelimit.Key) (string, bool) {
+	if len(key) == 0 {
+		return "", false
+	}
+	parts := make([]string, 0, len(key))
+	for _, p := range key {
+		var v string
+		switch p.Source {
+		case ratelimit.SourceIP:
+			v = utils.ClientIp(r)
+		case ratelimit.SourceUser:
+			v, _ = r.Context().Value(UserContextKey{}).(string)
+		case ratelimit.SourceAPIKey:
+			if principal, ok := PrincipalFrom(r.Context()); ok && principal.Method == AuthMethodAPIKey {
+				v = principal.TokenID
+			}
+		case ratelimit.SourceHeader:
+			// Hashed so that arbitrary client input stays out of store keys.
+			if h := r.Header.Get(p.Header); h != "" {
+				v = p.Header + ":" + HashAPIKey(h)[:16]
+			}
+		}
+		if v == "" {
+			return "", false
+		}
+		parts = append(parts, p.Source+"="+v)
+	}
+	return strings.Join(parts, "|"), true
+}
+
+// retryAfterSeconds rounds d up to whole seconds, with a minimum of one.
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
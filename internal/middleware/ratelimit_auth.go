@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/FPT-OJT/gateway/pkg/utils"
+	"github.com/rs/zerolog"
+)
+
+// LimitAuthFailures returns a middleware that authenticates requests with
+// auth and rate limits the failures per client IP, so that invalid tokens
+// and API key guesses are throttled while requests that authenticate are
+// never charged.
+//
+//   - Every 401 written by auth takes one request from the client IP's
+//     bucket, which holds cfg's anonymous limit under cfg.Policy.
+//   - Empty bucket → the 401 is replaced with 429 rate_limited.
+//   - Responses from past auth, including the upstream's, are left alone.
+//   - Store error → the 401 is sent as is.
+func LimitAuthFailures(auth func(http.Handler) http.Handler, store RateLimiterStore, cfg RateLimitConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	if cfg.Policy == "" {
+		cfg.Policy = "default"
+	}
+	limit := ratelimit.PerSecond(cfg.RPS, cfg.RPS+cfg.Burst)
+	if cfg.AnonymousRPS > 0 {
+		limit = ratelimit.PerSecond(cfg.AnonymousRPS, cfg.AnonymousRPS+cfg.AnonymousBurst)
+	}
+
+	return func(next http.Handler) http.Handler {
+		authenticated := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if a, ok := r.Context().Value(authAttemptKey{}).(*authAttempt); ok {
+				a.passed = true
+			}
+			next.ServeHTTP(w, r)
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a := &authAttempt{}
+			fw := &authFailureWriter{
+				ResponseWriter: w,
+				attempt:        a,
+				charge: func() bool {
+					key := "rl:" + cfg.Policy + ":anon:ip=" + utils.ClientIp(r)
+
+					ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 200*time.Millisecond)
+					defer cancel()
+
+					res, err := store.AllowN(ctx, key, limit, 1)
+					if err != nil {
+						log.Debug().Err(err).Str("policy", cfg.Policy).Msg("rate limit: store error, sending the auth failure as is")
+						return true
+					}
+					if res.Allowed {
+						return true
+					}
+					log.Warn().
+						Str("policy", cfg.Policy).
+						Str("key", key).
+						Dur("retry_after", res.RetryAfter).
+						Msg("rate limit exceeded by failed authentication")
+					w.Header().Del("WWW-Authenticate")
+					setRateLimitHeaders(w, cfg.Policy, limit, res)
+					writeRateLimited(w, cfg.Policy, res)
+					return false
+				},
+			}
+			authenticated.ServeHTTP(fw, r.WithContext(context.WithValue(r.Context(), authAttemptKey{}, a)))
+		})
+	}
+}
+
+type authAttemptKey struct{}
+
+// authAttempt records whether a request got past authentication.
+type authAttempt struct {
+	passed bool
+}
+
+// authFailureWriter charges the 401s written before authentication passed,
+// and drops them when charge has answered with a 429 instead.
+type authFailureWriter struct {
+	http.ResponseWriter
+	attempt *authAttempt
+	charge  func() bool
+
+	wroteHeader bool
+	dropped     bool
+}
+
+func (w *authFailureWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		if !w.dropped {
+			w.ResponseWriter.WriteHeader(status)
+		}
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusUnauthorized && !w.attempt.passed && !w.charge() {
+		w.dropped = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *authFailureWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.dropped {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so that
+// streamed responses are still flushed.
+func (w *authFailureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"context"
+	stderrors "errors"
+	"sync"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/rs/zerolog"
+)
+
+type FallbackConfig struct {
+	Mode ratelimit.FailureMode
+	// Instances is the expected number of gateway instances. In local mode
+	// each instance allows 1/Instances of every limit, so that the cluster as
+	// a whole stays close to the configured rate.
+	Instances int
+	// RetryInterval is how long the shared store is left alone after it
+	// fails before it is tried again. Defaults to one second.
+	RetryInterval time.Duration
+}
+
+// FallbackLimiter is a RateLimiterStore that guards a shared store, usually
+// Redis, and applies the configured failure mode while it is unavailable.
+//
+// After a failure the shared store is only retried once per RetryInterval,
+// so an outage does not add a store timeout to every request. Switching to
+// the failure mode and back is logged once per outage.
+type FallbackLimiter struct {
+	primary   RateLimiterStore
+	local     *ratelimit.MemoryStore
+	mode      ratelimit.FailureMode
+	instances int
+	retry     time.Duration
+	log       zerolog.Logger
+
+	mu        sync.Mutex
+	degraded  bool
+	nextProbe time.Time
+	lastErr   error
+}
+
+func NewFallbackLimiter(primary RateLimiterStore, cfg FallbackConfig, log zerolog.Logger) *FallbackLimiter {
+	if cfg.Mode == "" {
+		cfg.Mode = ratelimit.FailOpen
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+	return &FallbackLimiter{
+		primary:   primary,
+		local:     ratelimit.NewMemoryStore(),
+		mode:      cfg.Mode,
+		instances: max(1, cfg.Instances),
+		retry:     cfg.RetryInterval,
+		log:       log,
+	}
+}
+
+// AllowN takes n requests from the shared bucket. While the shared store is
+// unavailable it returns the store error in the open and closed modes, and
+// the result of the scaled local bucket in local mode.
+func (f *FallbackLimiter) AllowN(ctx context.Context, key string, limit ratelimit.Limit, n int) (ratelimit.Result, error) {
+	if err := f.skipPrimary(); err != nil {
+		return f.fallback(ctx, key, limit, n, err)
+	}
+
+	res, err := f.primary.AllowN(ctx, key, limit, n)
+	if err != nil {
+		// A client going away says nothing about the store's health.
+		if !stderrors.Is(err, context.Canceled) {
+			f.markDown(err)
+		}
+		return f.fallback(ctx, key, limit, n, err)
+	}
+	f.markUp()
+	return res, nil
+}
+
+// DebitN debits the shared bucket, or the local one in local mode while the
+// shared store is unavailable.
+func (f *FallbackLimiter) DebitN(ctx context.Context, key string, limit ratelimit.Limit, n int) error {
+	err := f.skipPrimary()
+	if err == nil {
+		if err = f.primary.DebitN(ctx, key, limit, n); err == nil {
+			return nil
+		}
+	}
+	if f.mode != ratelimit.FailLocal {
+		return err
+	}
+	return f.local.DebitN(ctx, key, scaleLimit(limit, f.instances), n)
+}
+
+// Degraded reports whether the failure mode is currently in effect.
+func (f *FallbackLimiter) Degraded() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.degraded
+}
+
+// skipPrimary returns the last store error while the store is down and not
+// yet due to be retried.
+func (f *FallbackLimiter) skipPrimary() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.degraded && time.Now().Before(f.nextProbe) {
+		return f.lastErr
+	}
+	return nil
+}
+
+func (f *FallbackLimiter) markDown(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextProbe = time.Now().Add(f.retry)
+	f.lastErr = err
+	if !f.degraded {
+		f.degraded = true
+		f.log.Error().Err(err).Str("mode", string(f.mode)).Msg("rate limit: store unavailable, switching to failure mode")
+	}
+}
+
+func (f *FallbackLimiter) markUp() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.degraded {
+		f.degraded = false
+		f.lastErr = nil
+		f.log.Info().Str("mode", string(f.mode)).Msg("rate limit: store recovered, leaving failure mode")
+	}
+}
+
+func (f *FallbackLimiter) fallback(ctx context.Context, key string, limit ratelimit.Limit, n int, err error) (ratelimit.Result, error) {
+	if f.mode != ratelimit.FailLocal {
+		return ratelimit.Result{}, err
+	}
+	return f.local.AllowN(ctx, key, scaleLimit(limit, f.instances), n)
+}
+
+// scaleLimit divides l between instances by stretching its period, which
+// keeps the rate exact, and splitting its capacity, rounding up.
+func scaleLimit(l ratelimit.Limit, instances int) ratelimit.Limit {
+	if instances <= 1 {
+		return l
+	}
+	l.Period *= time.Duration(instances)
+	l.Burst = max(1, (l.Burst+instances-1)/instances)
+	return l
+}
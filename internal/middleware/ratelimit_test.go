@@ -5,34 +5,35 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-// mockRateLimiterStore is an in-memory implementation of middleware.RateLimiterStore.
+// mockRateLimiterStore wraps the in-memory GCRA store with error injection.
 type mockRateLimiterStore struct {
-	counters map[string]int64
-	incrErr  error
+	*ratelimit.MemoryStore
+	err   error
+	calls int
 }
 
 func newMockRateLimiterStore() *mockRateLimiterStore {
-	return &mockRateLimiterStore{counters: make(map[string]int64)}
+	return &mockRateLimiterStore{MemoryStore: ratelimit.NewMemoryStore()}
 }
 
-func (m *mockRateLimiterStore) Incr(_ context.Context, key string) (int64, error) {
-	if m.incrErr != nil {
-		return 0, m.incrErr
+func (m *mockRateLimiterStore) AllowN(ctx context.Context, key string, limit ratelimit.Limit, n int) (ratelimit.Result, error) {
+	m.calls++
+	if m.err != nil {
+		return ratelimit.Result{}, m.err
 	}
-	m.counters[key]++
-	return m.counters[key], nil
-}
-
-func (m *mockRateLimiterStore) Expire(_ context.Context, _ string, _ time.Duration) error {
-	return nil
+	return m.MemoryStore.AllowN(ctx, key, limit, n)
 }
 
 func TestRateLimit_UnderLimit_Passes(t *testing.T) {
@@ -81,12 +82,35 @@ func TestRateLimit_ExceedsLimit_Returns429(t *testing.T) {
 	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
 	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
 	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
-	assert.Contains(t, rr.Body.String(), "rate_limited")
+	assert.Equal(t, "application/json; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"code":"rate_limited","message":"Too many requests","detail":{"policy":"default","limit":3,"retry_after":1}}`, rr.Body.String())
+}
+
+func TestRateLimit_StandardHeaders(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	// Capacity 6 refilled at 2 per second: an empty bucket refills in 3s.
+	handler := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{Policy: "login", RPS: 2, Burst: 4}, zerolog.Nop())(next)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	before := time.Now()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, `"login";q=6;w=3`, rr.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, `"login";r=5;t=1`, rr.Header().Get("RateLimit"))
+	assert.Equal(t, "6", rr.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "5", rr.Header().Get("X-RateLimit-Remaining"))
+	reset, err := strconv.ParseInt(rr.Header().Get("X-RateLimit-Reset"), 10, 64)
+	require.NoError(t, err)
+	assert.InDelta(t, before.Add(time.Second).Unix(), reset, 1)
 }
 
 func TestRateLimit_StoreError_FailsOpen(t *testing.T) {
 	store := newMockRateLimiterStore()
-	store.incrErr = errors.New("redis: dial tcp: connection refused")
+	store.err = errors.New("redis: dial tcp: connection refused")
 	log := zerolog.Nop()
 
 	nextCalled := false
@@ -107,6 +131,70 @@ func TestRateLimit_StoreError_FailsOpen(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 }
 
+func TestRateLimit_StoreError_FailClosed(t *testing.T) {
+	store := newMockRateLimiterStore()
+	store.err = errors.New("redis: dial tcp: connection refused")
+
+	handler := mw.RateLimit(store, mw.RateLimitConfig{RPS: 10, FailClosed: true}, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("next must not be called")
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"service_unavailable"`)
+}
+
+func TestFallbackLimiter_LocalMode(t *testing.T) {
+	primary := newMockRateLimiterStore()
+	limiter := mw.NewFallbackLimiter(primary, mw.FallbackConfig{
+		Mode:          ratelimit.FailLocal,
+		Instances:     2,
+		RetryInterval: 50 * time.Millisecond,
+	}, zerolog.Nop())
+	ctx := context.Background()
+	limit := ratelimit.PerSecond(10, 4)
+
+	res, err := limiter.AllowN(ctx, "k", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 4, res.Limit)
+	assert.False(t, limiter.Degraded())
+
+	primary.err = errors.New("redis down")
+	res, err = limiter.AllowN(ctx, "k", limit, 1)
+	require.NoError(t, err, "local mode hides the store error")
+	assert.True(t, limiter.Degraded())
+	assert.Equal(t, 2, res.Limit, "each of two instances gets half the capacity")
+	res, err = limiter.AllowN(ctx, "k", limit, 1)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	res, _ = limiter.AllowN(ctx, "k", limit, 1)
+	assert.False(t, res.Allowed, "the local bucket enforces the scaled limit")
+	assert.Equal(t, 2, primary.calls, "the failed store is not retried before the interval")
+
+	primary.err = nil
+	time.Sleep(60 * time.Millisecond)
+	res, err = limiter.AllowN(ctx, "k", limit, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 4, res.Limit)
+	assert.False(t, limiter.Degraded(), "the limiter switches back once the store recovers")
+}
+
+func TestFallbackLimiter_OpenAndClosedModesReturnError(t *testing.T) {
+	for _, mode := range []ratelimit.FailureMode{ratelimit.FailOpen, ratelimit.FailClosed} {
+		primary := newMockRateLimiterStore()
+		primary.err = errors.New("redis down")
+		limiter := mw.NewFallbackLimiter(primary, mw.FallbackConfig{Mode: mode}, zerolog.Nop())
+
+		_, err := limiter.AllowN(context.Background(), "k", ratelimit.PerSecond(1, 1), 1)
+		assert.Error(t, err, mode)
+		_, err = limiter.AllowN(context.Background(), "k", ratelimit.PerSecond(1, 1), 1)
+		assert.Error(t, err, mode)
+		assert.Equal(t, 1, primary.calls, mode)
+	}
+}
+
 func TestRateLimit_DifferentIPs_IndependentCounters(t *testing.T) {
 	store := newMockRateLimiterStore()
 	log := zerolog.Nop()
@@ -133,3 +221,313 @@ func TestRateLimit_DifferentIPs_IndependentCounters(t *testing.T) {
 	handler.ServeHTTP(rrB, reqB)
 	assert.Equal(t, http.StatusOK, rrB.Code)
 }
+
+func TestRateLimit_RefillsAtRPS(t *testing.T) {
+	store := newMockRateLimiterStore()
+	now := time.Unix(1700000000, 0)
+	store.Now = func() time.Time { return now }
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// RPS=4, Burst=0 → one request every 250ms once the bucket is empty.
+	handler := mw.RateLimit(store, mw.RateLimitConfig{RPS: 4, Burst: 0}, zerolog.Nop())(next)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.2:1000"
+	serve := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusOK, serve().Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve().Code)
+
+	// Tokens come back one at a time rather than all at the next second.
+	now = now.Add(200 * time.Millisecond)
+	assert.Equal(t, http.StatusTooManyRequests, serve().Code)
+	now = now.Add(50 * time.Millisecond)
+	rr := serve()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, http.StatusTooManyRequests, serve().Code)
+
+	now = now.Add(time.Hour)
+	rr = serve()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "3", rr.Header().Get("X-RateLimit-Remaining"))
+}
+
+func TestRateLimit_RetryAfterRoundsUp(t *testing.T) {
+	store := newMockRateLimiterStore()
+	now := time.Unix(1700000000, 0)
+	store.Now = func() time.Time { return now }
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// One request per second.
+	handler := mw.RateLimit(store, mw.RateLimitConfig{RPS: 1, Burst: 0}, zerolog.Nop())(next)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.3:1000"
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	now = now.Add(100 * time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"), "900ms rounds up to one second")
+}
+
+func TestRateLimit_KeyStrategies(t *testing.T) {
+	alice := &mw.Principal{Subject: "alice", Method: mw.AuthMethodJWT}
+	bob := &mw.Principal{Subject: "bob", Method: mw.AuthMethodJWT}
+	worker := &mw.Principal{Subject: "ci", Method: mw.AuthMethodAPIKey, TokenID: "hash-1"}
+	worker2 := &mw.Principal{Subject: "ci", Method: mw.AuthMethodAPIKey, TokenID: "hash-2"}
+
+	type call struct {
+		principal *mw.Principal
+		ip        string
+		tenant    string
+	}
+	tests := []struct {
+		name   string
+		key    string
+		first  call
+		second call
+		shared bool
+	}{
+		{"ip: users behind one NAT share", "ip", call{alice, "10.0.0.1", ""}, call{bob, "10.0.0.1", ""}, true},
+		{"user: users behind one NAT are separate", "user", call{alice, "10.0.0.1", ""}, call{bob, "10.0.0.1", ""}, false},
+		{"user: one user on many IPs shares", "user", call{alice, "10.0.0.1", ""}, call{alice, "10.0.0.2", ""}, true},
+		{"user: anonymous falls back to IP", "user", call{nil, "10.0.0.1", ""}, call{nil, "10.0.0.2", ""}, false},
+		{"api_key: keys of one owner are separate", "api_key", call{worker, "10.0.0.1", ""}, call{worker2, "10.0.0.1", ""}, false},
+		{"header: same tenant shares", "header:X-Tenant", call{alice, "10.0.0.1", "fpt"}, call{bob, "10.0.0.2", "fpt"}, true},
+		{"composite: user+ip separates devices", "user+ip", call{alice, "10.0.0.1", ""}, call{alice, "10.0.0.2", ""}, false},
+		{"composite: user+ip same device shares", "user+ip", call{alice, "10.0.0.1", ""}, call{alice, "10.0.0.1", ""}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := ratelimit.ParseKey(tc.key)
+			require.NoError(t, err)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			// One request per client: the second call is only allowed when it
+			// lands in a different bucket.
+			handler := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{RPS: 1, Key: key}, zerolog.Nop())(next)
+
+			serve := func(c call) int {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = c.ip + ":1234"
+				if c.tenant != "" {
+					req.Header.Set("X-Tenant", c.tenant)
+				}
+				if c.principal != nil {
+					req = withPrincipal(req, c.principal)
+					req = req.WithContext(context.WithValue(req.Context(), mw.UserContextKey{}, c.principal.Subject))
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				return rr.Code
+			}
+
+			assert.Equal(t, http.StatusOK, serve(tc.first))
+			want := http.StatusOK
+			if tc.shared {
+				want = http.StatusTooManyRequests
+			}
+			assert.Equal(t, want, serve(tc.second))
+		})
+	}
+}
+
+func TestRateLimit_AnonymousLimits(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{
+		RPS: 10, Burst: 10,
+		AnonymousRPS: 1, AnonymousBurst: 1,
+	}, zerolog.Nop())(next)
+
+	anon := httptest.NewRequest(http.MethodGet, "/", nil)
+	anon.RemoteAddr = "10.0.0.9:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, anon)
+	assert.Equal(t, "2", rr.Header().Get("X-RateLimit-Limit"))
+
+	authed := withPrincipal(httptest.NewRequest(http.MethodGet, "/", nil), &mw.Principal{Subject: "alice"})
+	authed.RemoteAddr = "10.0.0.9:1234"
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, authed)
+	assert.Equal(t, "20", rr.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "19", rr.Header().Get("X-RateLimit-Remaining"), "authenticated traffic has its own bucket")
+}
+
+func TestRateLimitRules_SelectsPolicyAndSeparatesCounters(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	login := mw.RateLimitConfig{Policy: "login", RPS: 1}
+	handler := mw.RateLimitRules(newMockRateLimiterStore(), []mw.RateLimitRule{
+		{Methods: []string{http.MethodPost}, Paths: []string{"/api/auth/login"}, Policy: login},
+	}, mw.RateLimitConfig{Policy: "default", RPS: 1}, zerolog.Nop())(next)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "10.1.1.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "/api/auth/login").Code)
+	rr := serve(http.MethodPost, "/api/auth/login")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"policy":"login"`)
+
+	// The default policy has its own bucket for the same client.
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/api/auth/login").Code)
+	rr = serve(http.MethodGet, "/api/auth/me")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"policy":"default"`)
+}
+
+func TestRateLimit_APIKeyTier(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{
+		Policy: "ai", RPS: 1, Burst: 1,
+		Tiers: map[string]mw.RateLimitTier{"internal": {RPS: 50, Burst: 50}},
+	}, zerolog.Nop())(next)
+
+	serve := func(p *mw.Principal) string {
+		req := withPrincipal(httptest.NewRequest(http.MethodGet, "/", nil), p)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Header().Get("X-RateLimit-Limit")
+	}
+
+	assert.Equal(t, "100", serve(&mw.Principal{Subject: "judge", Method: mw.AuthMethodAPIKey, TokenID: "h1", Tier: "internal"}))
+	assert.Equal(t, "2", serve(&mw.Principal{Subject: "ci", Method: mw.AuthMethodAPIKey, TokenID: "h2", Tier: "partner"}),
+		"unknown tiers use the policy limits")
+	assert.Equal(t, "2", serve(&mw.Principal{Subject: "u1", Method: mw.AuthMethodJWT}))
+}
+
+func TestRateLimit_CostWeights(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func(h http.Handler, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	weighted := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{RPS: 1, Burst: 9, Cost: mw.RateLimitCost{Weight: 4}}, zerolog.Nop())(next)
+	assert.Equal(t, "6", serve(weighted, "").Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "2", serve(weighted, "").Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, http.StatusTooManyRequests, serve(weighted, "").Code)
+
+	sized := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{RPS: 1, Burst: 9, Cost: mw.RateLimitCost{BytesPerUnit: 10}}, zerolog.Nop())(next)
+	assert.Equal(t, "7", serve(sized, "0123456789x").Header().Get("X-RateLimit-Remaining"), "1 + 2 units for 11 bytes")
+
+	chunked := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{RPS: 1, Burst: 9, Cost: mw.RateLimitCost{BytesPerUnit: 10}}, zerolog.Nop())(next)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("x"))
+	req.ContentLength = -1
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	chunked.ServeHTTP(rr, req)
+	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"), "a body of unknown length takes the whole bucket")
+
+	capped := mw.RateLimit(newMockRateLimiterStore(), mw.RateLimitConfig{RPS: 1, Burst: 1, Cost: mw.RateLimitCost{Weight: 50}}, zerolog.Nop())(next)
+	assert.Equal(t, http.StatusOK, serve(capped, "").Code, "the cost is capped at the bucket size")
+}
+
+func TestRateLimit_CostHeaderDebitsAfterResponse(t *testing.T) {
+	store := newMockRateLimiterStore()
+	reported := "5"
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Cost", reported)
+		_, _ = w.Write([]byte("ok"))
+	})
+	handler := mw.RateLimit(store, mw.RateLimitConfig{RPS: 1, Burst: 9, Cost: mw.RateLimitCost{Header: "X-Request-Cost"}}, zerolog.Nop())(next)
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("X-Request-Cost"), "the cost header is not forwarded")
+
+	reported = "1"
+	rr = serve()
+	assert.Equal(t, "4", rr.Header().Get("X-RateLimit-Remaining"), "10 - 5 reported - 1")
+
+	reported = "100"
+	serve()
+	rr = serve()
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "a reported cost may overdraw the bucket")
+	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+	// 7 taken, then the report is capped at 4 × 10: 46 against a bucket of 10.
+	assert.Equal(t, "37", rr.Header().Get("Retry-After"), "the reported cost is capped at four bucket sizes")
+}
+
+func TestLimitAuthFailures_ChargesOnlyFailedAuthentication(t *testing.T) {
+	store := newMockRateLimiterStore()
+	// Rejects requests carrying "bad", as token verification would.
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "bad" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	// The upstream answers 401 to everything it is sent.
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	handler := mw.LimitAuthFailures(auth, store, mw.RateLimitConfig{Policy: "auth", RPS: 1, Burst: 1}, zerolog.Nop())(upstream)
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for range 5 {
+		assert.Equal(t, http.StatusUnauthorized, serve("good").Code, "upstream responses are left alone")
+	}
+	assert.Equal(t, 0, store.calls, "requests that authenticate are not charged")
+
+	assert.Equal(t, http.StatusUnauthorized, serve("bad").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("bad").Code)
+	rr := serve("bad")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Empty(t, rr.Header().Get("WWW-Authenticate"))
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), `"policy":"auth"`)
+}
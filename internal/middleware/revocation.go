@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+type RevocationConfig struct {
+	// CacheTTL is how long a lookup result is reused in-process before the
+	// store is asked again. It bounds how long a revocation takes to reach
+	// every gateway instance. Zero disables the cache.
+	CacheTTL time.Duration
+	// FailClosed rejects authenticated requests with 503 when the store
+	// cannot be reached. By default they are let through.
+	FailClosed bool
+}
+
+// Revocation returns a middleware that rejects tokens revoked through a
+// RevocationStore. It must run after JWTAuth; requests without a JWT
+// Principal are passed through.
+//
+// A token is revoked when:
+//   - its "jti" has been revoked, or
+//   - its subject carries a revocation marker and the token was issued at or
+//     before that time. Tokens without an "iat" claim cannot be told apart
+//     and are treated as revoked.
+//
+// Revoked tokens get 401 token_revoked.
+func Revocation(store RevocationStore, cfg RevocationConfig, log zerolog.Logger) func(http.Handler) http.Handler {
+	c := &revocationCache{ttl: cfg.CacheTTL, entries: make(map[string]revocationEntry)}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := PrincipalFrom(r.Context())
+			if !ok || principal.Method != AuthMethodJWT {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+			defer cancel()
+
+			revoked, err := c.revoked(ctx, store, principal)
+			if err != nil {
+				if cfg.FailClosed {
+					log.Error().Err(err).Str("sub", principal.Subject).Msg("revocation: store error, failing closed")
+					errors.WriteJSON(w, http.StatusServiceUnavailable, errors.ErrUnavailable)
+					return
+				}
+				log.Warn().Err(err).Str("sub", principal.Subject).Msg("revocation: store error, failing open")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if revoked {
+				log.Warn().Str("sub", principal.Subject).Str("jti", principal.TokenID).Msg("revocation: token revoked")
+				sendUnauthorized(w, errors.ErrTokenRevoked)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maxRevocationEntries caps the in-process cache; it is emptied when full.
+const maxRevocationEntries = 10000
+
+// revocationSweepEvery is how many insertions pass between removals of
+// expired entries.
+const revocationSweepEvery = 1024
+
+// revocationCache memoises store lookups, both positive and negative, for ttl.
+type revocationCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]revocationEntry
+	calls   int
+}
+
+type revocationEntry struct {
+	revoked bool
+	before  time.Time
+	expires time.Time
+}
+
+func (c *revocationCache) revoked(ctx context.Context, store RevocationStore, p *Principal) (bool, error) {
+	if p.TokenID != "" {
+		e, err := c.lookup("jti:"+p.TokenID, func() (revocationEntry, error) {
+			revoked, err := store.TokenRevoked(ctx, p.TokenID)
+			return revocationEntry{revoked: revoked}, err
+		})
+		if err != nil || e.revoked {
+			return e.revoked, err
+		}
+	}
+
+	e, err := c.lookup("sub:"+p.Subject, func() (revocationEntry, error) {
+		before, found, err := store.SubjectRevokedBefore(ctx, p.Subject)
+		return revocationEntry{revoked: found, before: before}, err
+	})
+	if err != nil || !e.revoked {
+		return false, err
+	}
+	// iat has one second resolution, so a token issued in the same second as
+	// the marker is revoked as well.
+	return p.IssuedAt.IsZero() || !p.IssuedAt.After(e.before), nil
+}
+
+func (c *revocationCache) lookup(key string, fetch func() (revocationEntry, error)) (revocationEntry, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e, nil
+	}
+
+	e, err := fetch()
+	if err != nil || c.ttl <= 0 {
+		return e, err
+	}
+	e.expires = now.Add(c.ttl)
+
+	c.mu.Lock()
+	c.sweepLocked(now)
+	if len(c.entries) >= maxRevocationEntries {
+		clear(c.entries)
+	}
+	c.entries[key] = e
+	c.mu.Unlock()
+	return e, nil
+}
+
+// sweepLocked periodically drops expired entries, which would otherwise stay
+// until the cache fills up.
+func (c *revocationCache) sweepLocked(now time.Time) {
+	if c.calls++; c.calls%revocationSweepEvery != 0 {
+		return
+	}
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
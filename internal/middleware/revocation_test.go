@@ -0,0 +1,132 @@
+package middleware_test
+
+import (
+	"context"
+	stderrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockRevocationStore is an in-memory RevocationStore that counts lookups.
+type mockRevocationStore struct {
+	tokens   map[string]bool
+	subjects map[string]time.Time
+	err      error
+	lookups  int
+}
+
+func newMockRevocationStore() *mockRevocationStore {
+	return &mockRevocationStore{tokens: make(map[string]bool), subjects: make(map[string]time.Time)}
+}
+
+func (m *mockRevocationStore) RevokeToken(_ context.Context, jti string, _ time.Duration) error {
+	m.tokens[jti] = true
+	return nil
+}
+
+func (m *mockRevocationStore) TokenRevoked(_ context.Context, jti string) (bool, error) {
+	m.lookups++
+	return m.tokens[jti], m.err
+}
+
+func (m *mockRevocationStore) RevokeSubject(_ context.Context, sub string, before time.Time, _ time.Duration) error {
+	m.subjects[sub] = before
+	return nil
+}
+
+func (m *mockRevocationStore) SubjectRevokedBefore(_ context.Context, sub string) (time.Time, bool, error) {
+	m.lookups++
+	before, ok := m.subjects[sub]
+	return before, ok, m.err
+}
+
+func serveRevocation(handler http.Handler, p *mw.Principal) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if p != nil {
+		req = withPrincipal(req, p)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRevocation(t *testing.T) {
+	marker := time.Now().Truncate(time.Second)
+
+	store := newMockRevocationStore()
+	store.tokens["revoked-jti"] = true
+	store.subjects["banned"] = marker
+
+	tests := []struct {
+		name      string
+		principal *mw.Principal
+		want      int
+	}{
+		{"anonymous", nil, http.StatusOK},
+		{"valid token", &mw.Principal{Method: mw.AuthMethodJWT, Subject: "u1", TokenID: "ok-jti", IssuedAt: marker}, http.StatusOK},
+		{"revoked jti", &mw.Principal{Method: mw.AuthMethodJWT, Subject: "u1", TokenID: "revoked-jti", IssuedAt: marker}, http.StatusUnauthorized},
+		{"issued before subject marker", &mw.Principal{Method: mw.AuthMethodJWT, Subject: "banned", IssuedAt: marker.Add(-time.Minute)}, http.StatusUnauthorized},
+		{"issued in the marker's second", &mw.Principal{Method: mw.AuthMethodJWT, Subject: "banned", IssuedAt: marker}, http.StatusUnauthorized},
+		{"issued after subject marker", &mw.Principal{Method: mw.AuthMethodJWT, Subject: "banned", IssuedAt: marker.Add(time.Second)}, http.StatusOK},
+		{"no iat with subject marker", &mw.Principal{Method: mw.AuthMethodJWT, Subject: "banned"}, http.StatusUnauthorized},
+		{"no jti or iat", &mw.Principal{Method: mw.AuthMethodJWT, Subject: "u1"}, http.StatusOK},
+		{"api key principal", &mw.Principal{Method: mw.AuthMethodAPIKey, Subject: "banned"}, http.StatusOK},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := mw.Revocation(store, mw.RevocationConfig{}, zerolog.Nop())(next)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := serveRevocation(handler, tc.principal)
+			assert.Equal(t, tc.want, rr.Code)
+			if tc.want == http.StatusUnauthorized {
+				assert.Contains(t, rr.Body.String(), `"code":"token_revoked"`)
+				assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+			}
+		})
+	}
+}
+
+func TestRevocation_CachesLookups(t *testing.T) {
+	store := newMockRevocationStore()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := mw.Revocation(store, mw.RevocationConfig{CacheTTL: time.Minute}, zerolog.Nop())(next)
+	p := &mw.Principal{Method: mw.AuthMethodJWT, Subject: "u1", TokenID: "t1", IssuedAt: time.Now()}
+
+	for range 3 {
+		assert.Equal(t, http.StatusOK, serveRevocation(handler, p).Code)
+	}
+	assert.Equal(t, 2, store.lookups, "one jti and one subject lookup, then served from cache")
+
+	// Revocations only take effect once the cached result expires.
+	store.tokens["t1"] = true
+	assert.Equal(t, http.StatusOK, serveRevocation(handler, p).Code)
+}
+
+func TestRevocation_StoreError(t *testing.T) {
+	store := newMockRevocationStore()
+	store.err = stderrors.New("redis down")
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	p := &mw.Principal{Method: mw.AuthMethodJWT, Subject: "u1", TokenID: "t1", IssuedAt: time.Now()}
+
+	open := mw.Revocation(store, mw.RevocationConfig{}, zerolog.Nop())(next)
+	assert.Equal(t, http.StatusOK, serveRevocation(open, p).Code)
+
+	closed := mw.Revocation(store, mw.RevocationConfig{FailClosed: true}, zerolog.Nop())(next)
+	rr := serveRevocation(closed, p)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"service_unavailable"`)
+}
@@ -2,15 +2,71 @@ package middleware
 
 import (
 	"context"
+	"net/netip"
 	"time"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
 )
 
+// RateLimiterStore applies the GCRA rate limit algorithm to a bucket key.
 type RateLimiterStore interface {
-	Incr(ctx context.Context, key string) (int64, error)
-	Expire(ctx context.Context, key string, ttl time.Duration) error
+	// AllowN atomically takes n requests from the bucket stored at key.
+	AllowN(ctx context.Context, key string, limit ratelimit.Limit, n int) (ratelimit.Result, error)
+	// DebitN takes n requests from the bucket even if that overdraws it.
+	DebitN(ctx context.Context, key string, limit ratelimit.Limit, n int) error
 }
 
 type CacheStore interface {
 	Get(ctx context.Context, key string) (data []byte, found bool, err error)
 	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
 }
+
+// RevocationStore records revoked tokens, keyed by "jti", and per-subject
+// markers invalidating every token issued before a point in time.
+type RevocationStore interface {
+	RevokeToken(ctx context.Context, jti string, ttl time.Duration) error
+	TokenRevoked(ctx context.Context, jti string) (bool, error)
+	RevokeSubject(ctx context.Context, sub string, before time.Time, ttl time.Duration) error
+	SubjectRevokedBefore(ctx context.Context, sub string) (before time.Time, found bool, err error)
+}
+
+// APIKeyStore resolves API keys by their HashAPIKey digest.
+type APIKeyStore interface {
+	LookupAPIKey(ctx context.Context, hash string) (key APIKey, found bool, err error)
+}
+
+// QuotaStore keeps long-window quota counters.
+type QuotaStore interface {
+	// ConsumeQuota atomically adds n to every counter unless that would take
+	// one of them over its limit, in which case nothing is charged. It
+	// returns the counters' values after the call.
+	ConsumeQuota(ctx context.Context, counters []ratelimit.QuotaCounter, n int64) (used []int64, allowed bool, err error)
+	// QuotaUsage returns the current value of each counter key.
+	QuotaUsage(ctx context.Context, keys []string) ([]int64, error)
+}
+
+// ConcurrencyStore hands out leases on a limited number of slots. Leases
+// lapse after their TTL so that slots held by a crashed instance are freed.
+type ConcurrencyStore interface {
+	// Acquire takes one of limit slots of key for the lease id, valid for
+	// ttl, reporting false when all slots are held. Acquiring a lease
+	// already held renews it.
+	Acquire(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, error)
+	// Release gives up the lease id on key.
+	Release(ctx context.Context, key, id string) error
+}
+
+// DenyListStore holds the dynamic IP denylist shared by all instances, and
+// the strike counters behind automatic bans.
+type DenyListStore interface {
+	// DenyList returns the denied prefixes and when each entry lapses; a zero
+	// time never lapses. Lapsed entries are not returned.
+	DenyList(ctx context.Context) (map[netip.Prefix]time.Time, error)
+	// Deny adds prefix to the list until the given time; zero is permanent.
+	Deny(ctx context.Context, prefix netip.Prefix, until time.Time) error
+	// Undeny removes prefix from the list.
+	Undeny(ctx context.Context, prefix netip.Prefix) error
+	// Strike counts a strike against key and returns the number of strikes
+	// within window of the first one.
+	Strike(ctx context.Context, key string, window time.Duration) (int64, error)
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/FPT-OJT/gateway/pkg/utils"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog"
 )
@@ -19,6 +20,7 @@ func TraceLog(log zerolog.Logger) func(http.Handler) http.Handler {
 					Str("request_id", middleware.GetReqID(r.Context())).
 					Str("method", r.Method).
 					Str("path", r.URL.Path).
+					Str("client_ip", utils.ClientIp(r)).
 					Str("remote_addr", r.RemoteAddr).
 					Int("status", ww.Status()).
 					Int("bytes", ww.BytesWritten()).
@@ -2,10 +2,13 @@ package proxy
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"strings"
+	"sync/atomic"
 
 	"github.com/FPT-OJT/gateway/pkg/errors"
 	"github.com/FPT-OJT/gateway/pkg/utils"
@@ -15,18 +18,28 @@ import (
 
 type Config struct {
 	Prefix string
-	Target *url.URL
+	// StripPrefix removes Prefix from the request path before it is sent upstream.
+	StripPrefix bool
+	// Targets are balanced round-robin; at least one is required.
+	Targets []*url.URL
 }
 
 func New(cfg Config, log zerolog.Logger) http.Handler {
-	rp := httputil.NewSingleHostReverseProxy(cfg.Target)
+	directors := make([]func(*http.Request), len(cfg.Targets))
+	for i, target := range cfg.Targets {
+		directors[i] = httputil.NewSingleHostReverseProxy(target).Director
+	}
 
-	defaultDirector := rp.Director
+	var next atomic.Uint64
+	rp := &httputil.ReverseProxy{}
 	rp.Director = func(req *http.Request) {
-		defaultDirector(req)
-		req.URL.Path = stripPrefix(cfg.Prefix, req.URL.Path)
-		req.URL.RawPath = stripPrefix(cfg.Prefix, req.URL.RawPath)
-		req.Host = cfg.Target.Host
+		i := int((next.Add(1) - 1) % uint64(len(cfg.Targets)))
+		if cfg.StripPrefix {
+			req.URL.Path = stripPrefix(cfg.Prefix, req.URL.Path)
+			req.URL.RawPath = stripPrefix(cfg.Prefix, req.URL.RawPath)
+		}
+		directors[i](req)
+		req.Host = cfg.Targets[i].Host
 		forwardIP(req)
 
 		log.Debug().
@@ -35,15 +48,15 @@ func New(cfg Config, log zerolog.Logger) http.Handler {
 			Msg("proxying request")
 	}
 
-	rp.ErrorHandler = makeErrorHandler(cfg.Target, log)
+	rp.ErrorHandler = makeErrorHandler(log)
 	return rp
 }
 
-func makeErrorHandler(target *url.URL, log zerolog.Logger) func(http.ResponseWriter, *http.Request, error) {
+func makeErrorHandler(log zerolog.Logger) func(http.ResponseWriter, *http.Request, error) {
 	return func(w http.ResponseWriter, r *http.Request, err error) {
 		log.Error().
 			Err(err).
-			Str("upstream", target.String()).
+			Str("upstream", r.URL.Host).
 			Str("path", r.URL.Path).
 			Msg("upstream request failed")
 
@@ -66,9 +79,30 @@ func stripPrefix(prefix, s string) string {
 	return trimmed
 }
 
+// forwardIP replaces the inbound forwarding headers with the client IP the
+// gateway resolved, so that upstreams never see a chain a client could have
+// forged. The reverse proxy appends the immediate peer to X-Forwarded-For,
+// so the client IP is only set ahead of it when a trusted proxy sits between.
 func forwardIP(req *http.Request) {
-	if clientIP := utils.ClientIp(req); clientIP != "" {
+	req.Header.Del("Forwarded")
+	req.Header.Del("X-Forwarded-For")
+	clientIP := utils.ClientIp(req)
+	if clientIP == "" {
+		return
+	}
+	req.Header.Set("X-Real-IP", clientIP)
+	if !isPeer(req.RemoteAddr, clientIP) {
 		req.Header.Set("X-Forwarded-For", clientIP)
-		req.Header.Set("X-Real-IP", clientIP)
 	}
 }
+
+// isPeer reports whether ip is the host of remoteAddr, the address the
+// reverse proxy appends to X-Forwarded-For.
+func isPeer(remoteAddr, ip string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Unmap().WithZone("").String() == ip
+}
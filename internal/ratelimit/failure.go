@@ -0,0 +1,26 @@
+package ratelimit
+
+import "fmt"
+
+// FailureMode is how rate limiting behaves while the shared store is
+// unavailable.
+type FailureMode string
+
+const (
+	// FailOpen lets every request through.
+	FailOpen FailureMode = "open"
+	// FailClosed rejects every rate-limited request.
+	FailClosed FailureMode = "closed"
+	// FailLocal counts requests in a per-instance in-memory store instead.
+	FailLocal FailureMode = "local"
+)
+
+// ParseFailureMode validates a failure mode name.
+func ParseFailureMode(s string) (FailureMode, error) {
+	switch m := FailureMode(s); m {
+	case FailOpen, FailClosed, FailLocal:
+		return m, nil
+	default:
+		return "", fmt.Errorf("ratelimit: unknown failure mode %q (open, closed, local)", s)
+	}
+}
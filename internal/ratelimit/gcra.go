@@ -0,0 +1,109 @@
+// Package ratelimit implements the generic cell rate algorithm (GCRA) shared
+// by the in-memory and Redis rate limiter stores.
+//
+// GCRA is a token bucket expressed as a single timestamp per key, the
+// theoretical arrival time (TAT) of the next request. Each request advances
+// the TAT by one emission interval (Period/Rate); a request is allowed while
+// the advanced TAT stays within Burst emission intervals of now. This gives
+// a smooth limit with no window boundaries, and the state fits in one value
+// that can be updated atomically.
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Limit describes a bucket refilled at Rate requests per Period, holding at
+// most Burst requests.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	// Burst is the bucket capacity: the number of requests that may be made
+	// at once by a client that has been idle. It must be at least 1.
+	Burst int
+}
+
+// PerSecond returns a Limit of rate requests per second with the given
+// capacity.
+func PerSecond(rate, burst int) Limit {
+	return Limit{Rate: rate, Period: time.Second, Burst: burst}
+}
+
+// Validate reports whether l describes a usable bucket.
+func (l Limit) Validate() error {
+	if l.Rate <= 0 || l.Period <= 0 {
+		return fmt.Errorf("ratelimit: rate and period must be positive")
+	}
+	if l.Burst < 1 {
+		return fmt.Errorf("ratelimit: burst must be at least 1")
+	}
+	if l.EmissionInterval() <= 0 {
+		return fmt.Errorf("ratelimit: rate too high for period")
+	}
+	return nil
+}
+
+// EmissionInterval is the time one request adds to the TAT, in microseconds.
+func (l Limit) EmissionInterval() int64 {
+	return l.Period.Microseconds() / int64(l.Rate)
+}
+
+// Tolerance is how far ahead of now the TAT may run, in microseconds.
+func (l Limit) Tolerance() int64 {
+	return l.EmissionInterval() * int64(l.Burst)
+}
+
+// Result is the outcome of taking requests from a bucket.
+type Result struct {
+	Allowed bool
+	// Limit is the bucket capacity.
+	Limit int
+	// Remaining is the number of requests that could be made right now. It is
+	// zero, never negative, while the bucket is in debt.
+	Remaining int
+	// RetryAfter is how long a denied caller has to wait; zero when allowed.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+// Evaluate applies GCRA to the stored TAT for n requests at now. Times are
+// Unix microseconds; a zero tat means the key has no state. It returns the
+// TAT to store, which is unchanged when the requests are denied.
+//
+// The Redis store runs the same computation in a Lua script; the two must be
+// kept in step.
+func Evaluate(tat, now int64, l Limit, n int) (int64, Result) {
+	interval := l.EmissionInterval()
+	tolerance := l.Tolerance()
+
+	tat = max(tat, now)
+	newTAT := tat + interval*int64(n)
+	allowAt := newTAT - tolerance
+
+	if allowAt > now {
+		return tat, Result{
+			Allowed:    false,
+			Limit:      l.Burst,
+			Remaining:  int(max(now-(tat-tolerance), 0) / interval),
+			RetryAfter: time.Duration(allowAt-now) * time.Microsecond,
+			ResetAfter: time.Duration(tat-now) * time.Microsecond,
+		}
+	}
+
+	return newTAT, Result{
+		Allowed:    true,
+		Limit:      l.Burst,
+		Remaining:  int((now - allowAt) / interval),
+		ResetAfter: time.Duration(newTAT-now) * time.Microsecond,
+	}
+}
+
+// Debit takes n requests from the bucket whether or not they are available,
+// for costs that are only known once a request has been served. The bucket
+// may go into debt, delaying the caller's next requests accordingly. It
+// returns the TAT to store.
+func Debit(tat, now int64, l Limit, n int) int64 {
+	return max(tat, now) + l.EmissionInterval()*int64(n)
+}
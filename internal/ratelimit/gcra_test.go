@@ -0,0 +1,179 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluate(t *testing.T) {
+	limit := ratelimit.PerSecond(10, 5) // one request per 100ms, 5 at once
+	now := int64(1_700_000_000_000_000)
+
+	tat, res := ratelimit.Evaluate(0, now, limit, 1)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 5, res.Limit)
+	assert.Equal(t, 4, res.Remaining)
+	assert.Equal(t, 100*time.Millisecond, res.ResetAfter)
+
+	for i := 0; i < 4; i++ {
+		tat, res = ratelimit.Evaluate(tat, now, limit, 1)
+		assert.True(t, res.Allowed)
+	}
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, 500*time.Millisecond, res.ResetAfter)
+
+	denied, res := ratelimit.Evaluate(tat, now, limit, 1)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, tat, denied, "a denied request leaves the state unchanged")
+	assert.Equal(t, 100*time.Millisecond, res.RetryAfter)
+
+	// 30ms later the next token is 70ms away.
+	_, res = ratelimit.Evaluate(tat, now+30_000, limit, 1)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 70*time.Millisecond, res.RetryAfter)
+
+	// Taking several at once needs that many tokens.
+	_, res = ratelimit.Evaluate(tat, now+200_000, limit, 3)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 2, res.Remaining)
+	_, res = ratelimit.Evaluate(tat, now+300_000, limit, 3)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	// A bucket in debt reports nothing remaining, not a negative count.
+	debt := ratelimit.Debit(tat, now, limit, 20)
+	_, res = ratelimit.Evaluate(debt, now, limit, 1)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+}
+
+func TestLimit_Validate(t *testing.T) {
+	assert.NoError(t, ratelimit.PerSecond(100, 120).Validate())
+	assert.Error(t, ratelimit.PerSecond(0, 1).Validate())
+	assert.Error(t, ratelimit.PerSecond(1, 0).Validate())
+	assert.Error(t, ratelimit.Limit{Rate: 10, Period: time.Microsecond, Burst: 1}.Validate())
+}
+
+func TestMemoryStore_IndependentKeys(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	now := time.Unix(1700000000, 0)
+	store.Now = func() time.Time { return now }
+	limit := ratelimit.PerSecond(1, 1)
+
+	res, err := store.AllowN(context.Background(), "a", limit, 1)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+
+	res, _ = store.AllowN(context.Background(), "a", limit, 1)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+
+	res, _ = store.AllowN(context.Background(), "b", limit, 1)
+	assert.True(t, res.Allowed)
+
+	_, err = store.AllowN(context.Background(), "a", ratelimit.Limit{}, 1)
+	assert.Error(t, err)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := ratelimit.ParseKey("user + header:x-tenant-id")
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.Key{
+		{Source: ratelimit.SourceUser},
+		{Source: ratelimit.SourceHeader, Header: "X-Tenant-Id"},
+	}, key)
+	assert.Equal(t, "user+header:X-Tenant-Id", key.String())
+
+	for _, spec := range []string{"", "session", "header:", "ip+", "header:bad name"} {
+		_, err := ratelimit.ParseKey(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestWindow_Bounds(t *testing.T) {
+	at := time.Date(2024, time.January, 31, 13, 45, 10, 0, time.FixedZone("ICT", 7*3600))
+
+	tests := []struct {
+		window      ratelimit.Window
+		start, next time.Time
+	}{
+		{ratelimit.Hour, time.Date(2024, 1, 31, 6, 0, 0, 0, time.UTC), time.Date(2024, 1, 31, 7, 0, 0, 0, time.UTC)},
+		{ratelimit.Day, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{ratelimit.Month, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range tests {
+		start, next := tc.window.Bounds(at)
+		assert.Equal(t, tc.start, start, tc.window)
+		assert.Equal(t, tc.next, next, tc.window)
+	}
+
+	_, err := ratelimit.ParseWindow("week")
+	assert.Error(t, err)
+}
+
+func TestMemoryStore_ConsumeQuota(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	reset := time.Now().Add(time.Hour)
+	daily := ratelimit.QuotaCounter{Key: "daily", Limit: 3, ResetAt: reset}
+	hourly := ratelimit.QuotaCounter{Key: "hourly", Limit: 2, ResetAt: reset}
+	ctx := context.Background()
+
+	for i := int64(1); i <= 2; i++ {
+		used, ok, err := store.ConsumeQuota(ctx, []ratelimit.QuotaCounter{daily, hourly}, 1)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []int64{i, i}, used)
+	}
+
+	used, ok, err := store.ConsumeQuota(ctx, []ratelimit.QuotaCounter{daily, hourly}, 1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []int64{2, 2}, used, "a denied request charges no counter")
+
+	usage, err := store.QuotaUsage(ctx, []string{"daily", "hourly", "unknown"})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{2, 2, 0}, usage)
+
+	// Counters are dropped once they reset.
+	store.Now = func() time.Time { return reset.Add(time.Second) }
+	used, ok, err = store.ConsumeQuota(ctx, []ratelimit.QuotaCounter{hourly}, 1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []int64{1}, used)
+}
+
+func TestMemoryStore_LeasesExpire(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	ctx := context.Background()
+	now := time.Now()
+	store.Now = func() time.Time { return now }
+
+	ok, err := store.Acquire(ctx, "k", "a", 1, time.Second)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, _ = store.Acquire(ctx, "k", "b", 1, time.Second)
+	assert.False(t, ok)
+	ok, _ = store.Acquire(ctx, "k", "a", 1, time.Second)
+	assert.True(t, ok, "the holder renews its lease")
+
+	now = now.Add(time.Second)
+	ok, _ = store.Acquire(ctx, "k", "b", 1, time.Second)
+	assert.True(t, ok, "an expired lease frees its slot")
+}
+
+func TestDebit(t *testing.T) {
+	limit := ratelimit.PerSecond(10, 5)
+	now := int64(1_700_000_000_000_000)
+
+	tat := ratelimit.Debit(0, now, limit, 8)
+	assert.Equal(t, now+800_000, tat, "a debit may overdraw the bucket")
+
+	_, res := ratelimit.Evaluate(tat, now, limit, 1)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 400*time.Millisecond, res.RetryAfter)
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Key sources a rate limit bucket can be keyed on.
+const (
+	SourceIP     = "ip"
+	SourceUser   = "user"
+	SourceAPIKey = "api_key"
+	SourceHeader = "header"
+)
+
+// KeyPart is one component of a bucket key.
+type KeyPart struct {
+	Source string
+	// Header names the request header read by SourceHeader.
+	Header string
+}
+
+// Key is a bucket key strategy. Composite keys combine several parts, e.g.
+// user+ip gives every user a separate bucket per client address.
+type Key []KeyPart
+
+// ParseKey parses a key strategy: one or more of "ip", "user", "api_key" and
+// "header:<Name>" joined with "+".
+func ParseKey(spec string) (Key, error) {
+	var key Key
+	for _, part := range strings.Split(spec, "+") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == SourceIP, part == SourceUser, part == SourceAPIKey:
+			key = append(key, KeyPart{Source: part})
+		case strings.HasPrefix(part, SourceHeader+":"):
+			name := strings.TrimSpace(strings.TrimPrefix(part, SourceHeader+":"))
+			if name == "" || strings.ContainsAny(name, " \t:") {
+				return nil, fmt.Errorf("ratelimit: invalid header name in key %q", spec)
+			}
+			key = append(key, KeyPart{Source: SourceHeader, Header: http.CanonicalHeaderKey(name)})
+		default:
+			return nil, fmt.Errorf("ratelimit: unknown key source %q (ip, user, api_key, header:<Name>)", part)
+		}
+	}
+	return key, nil
+}
+
+func (k Key) String() string {
+	parts := make([]string, len(k))
+	for i, p := range k {
+		parts[i] = p.Source
+		if p.Source == SourceHeader {
+			parts[i] += ":" + p.Header
+		}
+	}
+	return strings.Join(parts, "+")
+}
@@ -0,0 +1,187 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps GCRA, quota and concurrency lease state in process
+// memory. Limits are enforced per instance only.
+type MemoryStore struct {
+	// Now is the clock used by the store; tests may replace it.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	tats   map[string]int64
+	quotas map[string]quotaEntry
+	// leases maps a key to its lease ids and their expiry.
+	leases map[string]map[string]time.Time
+	calls  int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Now: time.Now, tats: make(map[string]int64), quotas: make(map[string]quotaEntry), leases: make(map[string]map[string]time.Time)}
+}
+
+// sweepEvery is how many calls pass between removals of idle keys.
+const sweepEvery = 1024
+
+func (s *MemoryStore) AllowN(_ context.Context, key string, limit Limit, n int) (Result, error) {
+	if err := limit.Validate(); err != nil {
+		return Result{}, err
+	}
+	t := s.Now()
+	now := t.UnixMicro()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tat, res := Evaluate(s.tats[key], now, limit, n)
+	s.tats[key] = tat
+
+	s.sweepLocked(t)
+	return res, nil
+}
+
+// DebitN takes n requests from the bucket unconditionally.
+func (s *MemoryStore) DebitN(_ context.Context, key string, limit Limit, n int) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+	now := s.Now().UnixMicro()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tats[key] = Debit(s.tats[key], now, limit, n)
+	return nil
+}
+
+// sweepLocked periodically drops state that no longer matters: buckets whose
+// TAT is in the past hold a full bucket, the same as holding no state, and
+// quota counters past their reset start again from zero.
+func (s *MemoryStore) sweepLocked(now time.Time) {
+	if s.calls++; s.calls%sweepEvery != 0 {
+		return
+	}
+	micros := now.UnixMicro()
+	for k, t := range s.tats {
+		if t <= micros {
+			delete(s.tats, k)
+		}
+	}
+	for k, e := range s.quotas {
+		if !now.Before(e.resetAt) {
+			delete(s.quotas, k)
+		}
+	}
+	for k := range s.leases {
+		s.expireLeasesLocked(k, now)
+	}
+}
+
+// ConsumeQuota adds n to every counter, unless that would take any of them
+// over its limit, in which case nothing is charged. It returns the counters'
+// values after the call.
+func (s *MemoryStore) ConsumeQuota(_ context.Context, counters []QuotaCounter, n int64) ([]int64, bool, error) {
+	now := s.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepLocked(now)
+
+	used := make([]int64, len(counters))
+	allowed := true
+	for i, c := range counters {
+		used[i] = s.quotaLocked(c.Key, now)
+		if used[i]+n > c.Limit {
+			allowed = false
+		}
+	}
+	if !allowed {
+		return used, false, nil
+	}
+	for i, c := range counters {
+		used[i] += n
+		s.quotas[c.Key] = quotaEntry{used: used[i], resetAt: c.ResetAt}
+	}
+	return used, true, nil
+}
+
+// QuotaUsage returns the current value of each counter key.
+func (s *MemoryStore) QuotaUsage(_ context.Context, keys []string) ([]int64, error) {
+	now := s.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used := make([]int64, len(keys))
+	for i, k := range keys {
+		used[i] = s.quotaLocked(k, now)
+	}
+	return used, nil
+}
+
+type quotaEntry struct {
+	used    int64
+	resetAt time.Time
+}
+
+func (s *MemoryStore) quotaLocked(key string, now time.Time) int64 {
+	e, ok := s.quotas[key]
+	if !ok {
+		return 0
+	}
+	if !now.Before(e.resetAt) {
+		delete(s.quotas, key)
+		return 0
+	}
+	return e.used
+}
+
+// Acquire takes one of limit slots of key for the lease id, valid for ttl.
+// Acquiring a lease already held renews it.
+func (s *MemoryStore) Acquire(_ context.Context, key, id string, limit int, ttl time.Duration) (bool, error) {
+	now := s.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepLocked(now)
+	s.expireLeasesLocked(key, now)
+
+	held := s.leases[key]
+	if _, ok := held[id]; !ok && len(held) >= limit {
+		return false, nil
+	}
+	if held == nil {
+		held = make(map[string]time.Time)
+		s.leases[key] = held
+	}
+	held[id] = now.Add(ttl)
+	return true, nil
+}
+
+// Release gives up the lease id on key.
+func (s *MemoryStore) Release(_ context.Context, key, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leases[key], id)
+	if len(s.leases[key]) == 0 {
+		delete(s.leases, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) expireLeasesLocked(key string, now time.Time) {
+	held := s.leases[key]
+	for id, expiry := range held {
+		if !now.Before(expiry) {
+			delete(held, id)
+		}
+	}
+	if held != nil && len(held) == 0 {
+		delete(s.leases, key)
+	}
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Window is a calendar period over which a quota is counted. Windows are
+// aligned to UTC: hours on the hour, days at midnight and months on the 1st.
+type Window string
+
+const (
+	Hour  Window = "hour"
+	Day   Window = "day"
+	Month Window = "month"
+)
+
+// ParseWindow validates a window name.
+func ParseWindow(s string) (Window, error) {
+	switch w := Window(s); w {
+	case Hour, Day, Month:
+		return w, nil
+	default:
+		return "", fmt.Errorf("ratelimit: unknown quota window %q (hour, day, month)", s)
+	}
+}
+
+// Bounds returns the start of the window containing t and the start of the
+// next one, when the quota resets.
+func (w Window) Bounds(t time.Time) (start, reset time.Time) {
+	t = t.UTC()
+	switch w {
+	case Hour:
+		start = t.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	case Month:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// QuotaCounter is one quota counter to charge. Key should identify the window
+// so that a new window starts from zero; the counter is dropped at ResetAt.
+type QuotaCounter struct {
+	Key     string
+	Limit   int64
+	ResetAt time.Time
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/config"
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// mountAdmin registers the gateway's own admin endpoints. They require a
+// token carrying the configured admin role, so none are mounted without JWT
+// verification; each is mounted only when its store is available.
+func mountAdmin(r *chi.Mux, b *routeBuilder) {
+	if b.keys == nil {
+		return
+	}
+
+	authz := mw.Authorize([]mw.AuthzRule{{Roles: []string{b.cfg.AdminRole}}}, b.log)
+	admin := func(h http.Handler) http.Handler {
+		return b.authenticate(mw.AuthRequired, b.rateLimit(config.Route{}, authz(h)))
+	}
+
+	if store := b.stores.Revocation; store != nil {
+		r.Method(http.MethodPost, "/admin/revocations", admin(handleRevoke(store, b.cfg.RevocationTTL, b.log)))
+	}
+	if store := b.stores.DenyList; store != nil {
+		r.Method(http.MethodGet, "/admin/denylist", admin(handleListDenied(store, b.log)))
+		r.Method(http.MethodPost, "/admin/denylist", admin(handleDeny(store, b.log)))
+		r.Method(http.MethodDelete, "/admin/denylist", admin(handleUndeny(store, b.log)))
+	}
+}
+
+// revokeRequest is the body of POST /admin/revocations. Exactly one of JTI and
+// Subject must be set.
+type revokeRequest struct {
+	// JTI revokes a single token.
+	JTI string `json:"jti"`
+	// ExpiresAt is the token's "exp" (Unix seconds). When set, the revocation
+	// is kept only until then instead of the full revocation TTL.
+	ExpiresAt int64 `json:"expires_at"`
+	// Subject revokes every token issued to the subject until now.
+	Subject string `json:"subject"`
+}
+
+func handleRevoke(store mw.RevocationStore, ttl time.Duration, log zerolog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req revokeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			errors.WriteJSON(w, http.StatusBadRequest, errors.ErrorResponse{
+				Code:    errors.ErrBadRequest.Code,
+				Message: "Request body must be a JSON object",
+			})
+			return
+		}
+		if (req.JTI == "") == (req.Subject == "") {
+			errors.WriteJSON(w, http.StatusBadRequest, errors.ErrorResponse{
+				Code:    errors.ErrBadRequest.Code,
+				Message: "Exactly one of 'jti' or 'subject' must be set",
+			})
+			return
+		}
+
+		admin, _ := mw.PrincipalFrom(r.Context())
+		now := time.Now()
+
+		var err error
+		if req.JTI != "" {
+			tokenTTL := ttl
+			if req.ExpiresAt > 0 {
+				tokenTTL = min(time.Unix(req.ExpiresAt, 0).Sub(now), ttl)
+			}
+			if tokenTTL > 0 {
+				err = store.RevokeToken(r.Context(), req.JTI, tokenTTL)
+			}
+		} else {
+			err = store.RevokeSubject(r.Context(), req.Subject, now, ttl)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("admin: failed to store revocation")
+			errors.WriteJSON(w, http.StatusServiceUnavailable, errors.ErrUnavailable)
+			return
+		}
+
+		log.Info().
+			Str("admin", admin.Subject).
+			Str("jti", req.JTI).
+			Str("subject", req.Subject).
+			Msg("admin: token revoked")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// denyRequest is the body of POST /admin/denylist.
+type denyRequest struct {
+	// CIDR is a prefix or a single address.
+	CIDR string `json:"cidr"`
+	// TTL is how long the entry lasts, in seconds. Zero is permanent.
+	TTL int64 `json:"ttl"`
+}
+
+type deniedEntry struct {
+	CIDR      string     `json:"cidr"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func handleListDenied(store mw.DenyListStore, log zerolog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := store.DenyList(r.Context())
+		if err != nil {
+			log.Error().Err(err).Msg("admin: failed to read denylist")
+			errors.WriteJSON(w, http.StatusServiceUnavailable, errors.ErrUnavailable)
+			return
+		}
+
+		out := make([]deniedEntry, 0, len(entries))
+		for prefix, until := range entries {
+			e := deniedEntry{CIDR: prefix.String()}
+			if !until.IsZero() {
+				e.ExpiresAt = &until
+			}
+			out = append(out, e)
+		}
+		slices.SortFunc(out, func(a, b deniedEntry) int { return strings.Compare(a.CIDR, b.CIDR) })
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]any{"entries": out})
+	}
+}
+
+func handleDeny(store mw.DenyListStore, log zerolog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req denyRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			errors.WriteJSON(w, http.StatusBadRequest, errors.ErrorResponse{
+				Code:    errors.ErrBadRequest.Code,
+				Message: "Request body must be a JSON object",
+			})
+			return
+		}
+		prefix, err := config.ParsePrefix(req.CIDR)
+		if err != nil || req.TTL < 0 {
+			errors.WriteJSON(w, http.StatusBadRequest, errors.ErrorResponse{
+				Code:    errors.ErrBadRequest.Code,
+				Message: "'cidr' must be an IP address or CIDR prefix and 'ttl' not negative",
+			})
+			return
+		}
+
+		var until time.Time
+		if req.TTL > 0 {
+			until = time.Now().Add(time.Duration(req.TTL) * time.Second)
+		}
+		if err := store.Deny(r.Context(), prefix, until); err != nil {
+			log.Error().Err(err).Msg("admin: failed to store denylist entry")
+			errors.WriteJSON(w, http.StatusServiceUnavailable, errors.ErrUnavailable)
+			return
+		}
+
+		admin, _ := mw.PrincipalFrom(r.Context())
+		log.Info().Str("admin", admin.Subject).Str("cidr", prefix.String()).Int64("ttl", req.TTL).Msg("admin: address range denied")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleUndeny removes the entry named by the "cidr" query parameter.
+func handleUndeny(store mw.DenyListStore, log zerolog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix, err := config.ParsePrefix(r.URL.Query().Get("cidr"))
+		if err != nil {
+			errors.WriteJSON(w, http.StatusBadRequest, errors.ErrorResponse{
+				Code:    errors.ErrBadRequest.Code,
+				Message: "Query parameter 'cidr' must be an IP address or CIDR prefix",
+			})
+			return
+		}
+		if err := store.Undeny(r.Context(), prefix); err != nil {
+			log.Error().Err(err).Msg("admin: failed to remove denylist entry")
+			errors.WriteJSON(w, http.StatusServiceUnavailable, errors.ErrUnavailable)
+			return
+		}
+
+		admin, _ := mw.PrincipalFrom(r.Context())
+		log.Info().Str("admin", admin.Subject).Str("cidr", prefix.String()).Msg("admin: denylist entry removed")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
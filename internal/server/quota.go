@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/config"
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// mountQuota registers GET /quota, which reports the caller's usage of the
+// quotas they can be charged: those of every route for authenticated callers,
+// those of routes not requiring authentication for anonymous ones, who see
+// their per-IP usage. The caller is identified as on proxied routes. Role and
+// scope rules are not taken into account.
+func mountQuota(r *chi.Mux, b *routeBuilder) {
+	if b.stores.Quota == nil {
+		return
+	}
+
+	all, anonymous := make(map[string]bool), make(map[string]bool)
+	for _, rt := range b.cfg.Routes {
+		for _, name := range rt.Quotas {
+			all[name] = true
+			if rt.Auth != config.AuthRequired {
+				anonymous[name] = true
+			}
+		}
+	}
+	if len(all) == 0 {
+		return
+	}
+
+	handler := handleQuota(b.stores.Quota,
+		b.quotas(slices.Sorted(maps.Keys(all))),
+		b.quotas(slices.Sorted(maps.Keys(anonymous))),
+		b.log)
+	r.Method(http.MethodGet, "/quota",
+		b.authenticate(mw.AuthOptional, b.rateLimit(config.Route{}, handler)))
+}
+
+type quotaResponse struct {
+	Quotas []mw.QuotaStatus `json:"quotas"`
+}
+
+func handleQuota(store mw.QuotaStore, quotas, anonymous []mw.QuotaConfig, log zerolog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applicable := quotas
+		if _, ok := mw.PrincipalFrom(r.Context()); !ok {
+			applicable = anonymous
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+		defer cancel()
+
+		usage, err := mw.QuotaUsage(ctx, store, applicable, r)
+		if err != nil {
+			log.Error().Err(err).Msg("quota: failed to read usage")
+			errors.WriteJSON(w, http.StatusServiceUnavailable, errors.ErrUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(quotaResponse{Quotas: usage})
+	}
+}
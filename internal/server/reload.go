@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// BuildFunc loads and validates the configuration and builds a router from it.
+type BuildFunc func() (http.Handler, error)
+
+// Reloader is an http.Handler that serves every request through the most
+// recently built router. Reload swaps the router atomically; requests already
+// being served keep running on the router they started with.
+type Reloader struct {
+	build   BuildFunc
+	current atomic.Pointer[handlerRef]
+	mu      sync.Mutex
+	log     zerolog.Logger
+}
+
+type handlerRef struct {
+	http.Handler
+}
+
+func NewReloader(initial http.Handler, build BuildFunc, log zerolog.Logger) *Reloader {
+	rl := &Reloader{build: build, log: log}
+	rl.current.Store(&handlerRef{initial})
+	return rl
+}
+
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.current.Load().ServeHTTP(w, r)
+}
+
+// Reload builds a fresh router and swaps it in. On failure the error is
+// logged and returned, and the previous router keeps serving.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	h, err := rl.safeBuild()
+	if err != nil {
+		rl.log.Error().Err(err).Msg("reload: failed, keeping previous configuration")
+		return err
+	}
+
+	rl.current.Store(&handlerRef{h})
+	rl.log.Info().Msg("reload: configuration applied")
+	return nil
+}
+
+// safeBuild converts a panic during router construction (e.g. a conflicting
+// chi mount) into an error so that a bad config cannot crash the process.
+func (rl *Reloader) safeBuild() (h http.Handler, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("build router: %v", rec)
+		}
+	}()
+	return rl.build()
+}
+
+// Watch polls the files listed by sources every interval and triggers a
+// Reload when any of them changes (modification time or size), appears or
+// disappears. sources is called on every poll, so that files named by a
+// reloaded configuration are watched from then on. It returns when ctx is
+// cancelled.
+func (rl *Reloader) Watch(ctx context.Context, sources func() []string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	paths := sources()
+	last := statFiles(paths)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if next := sources(); !slices.Equal(next, paths) {
+				paths, last = next, statFiles(next)
+				rl.log.Info().Strs("files", paths).Msg("reload: watching new config files")
+				continue
+			}
+			cur := statFiles(paths)
+			if cur == last {
+				continue
+			}
+			last = cur
+			rl.log.Info().Strs("files", paths).Msg("reload: config file change detected")
+			_ = rl.Reload()
+		}
+	}
+}
+
+// statFiles returns a fingerprint of the files' modification times and sizes.
+func statFiles(paths []string) string {
+	var fp string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			fp += p + ":missing;"
+			continue
+		}
+		fp += fmt.Sprintf("%s:%d:%d;", p, info.ModTime().UnixNano(), info.Size())
+	}
+	return fp
+}
@@ -0,0 +1,136 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/server"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func textHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	})
+}
+
+func serve(h http.Handler) string {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rr.Body.String()
+}
+
+func TestReloader_Reload_SwapsHandler(t *testing.T) {
+	rl := server.NewReloader(textHandler("v1"), func() (http.Handler, error) {
+		return textHandler("v2"), nil
+	}, zerolog.Nop())
+
+	assert.Equal(t, "v1", serve(rl))
+	require.NoError(t, rl.Reload())
+	assert.Equal(t, "v2", serve(rl))
+}
+
+func TestReloader_FailedReload_KeepsPreviousHandler(t *testing.T) {
+	rl := server.NewReloader(textHandler("v1"), func() (http.Handler, error) {
+		return nil, errors.New("config: route \"x\": prefix must start with '/'")
+	}, zerolog.Nop())
+
+	assert.Error(t, rl.Reload())
+	assert.Equal(t, "v1", serve(rl))
+}
+
+func TestReloader_PanickingBuild_KeepsPreviousHandler(t *testing.T) {
+	rl := server.NewReloader(textHandler("v1"), func() (http.Handler, error) {
+		panic("chi: attempting to Mount() a handler on an existing path")
+	}, zerolog.Nop())
+
+	assert.NotPanics(t, func() {
+		assert.Error(t, rl.Reload())
+	})
+	assert.Equal(t, "v1", serve(rl))
+}
+
+func TestReloader_InFlightRequest_FinishesOnOldHandler(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("v1"))
+	})
+
+	rl := server.NewReloader(slow, func() (http.Handler, error) {
+		return textHandler("v2"), nil
+	}, zerolog.Nop())
+
+	done := make(chan string)
+	go func() { done <- serve(rl) }()
+
+	<-started
+	require.NoError(t, rl.Reload())
+	assert.Equal(t, "v2", serve(rl))
+
+	close(release)
+	assert.Equal(t, "v1", <-done)
+}
+
+func TestReloader_Watch_ReloadsOnFileChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("routes: []"), 0o600))
+
+	var builds atomic.Int32
+	rl := server.NewReloader(textHandler("v1"), func() (http.Handler, error) {
+		builds.Add(1)
+		return textHandler("v2"), nil
+	}, zerolog.Nop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.Watch(ctx, func() []string { return []string{path} }, 10*time.Millisecond)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Zero(t, builds.Load(), "unchanged file must not trigger a reload")
+
+	require.NoError(t, os.WriteFile(path, []byte("routes: [{prefix: /a}]"), 0o600))
+
+	assert.Eventually(t, func() bool { return serve(rl) == "v2" }, time.Second, 10*time.Millisecond)
+}
+
+func TestReloader_Watch_FollowsChangedSources(t *testing.T) {
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old.yaml"), filepath.Join(dir, "new.yaml")
+	require.NoError(t, os.WriteFile(oldPath, []byte("routes: []"), 0o600))
+	require.NoError(t, os.WriteFile(newPath, []byte("routes: []"), 0o600))
+
+	var current atomic.Pointer[string]
+	current.Store(&oldPath)
+	var builds atomic.Int32
+	rl := server.NewReloader(textHandler("v0"), func() (http.Handler, error) {
+		builds.Add(1)
+		return textHandler("reloaded"), nil
+	}, zerolog.Nop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.Watch(ctx, func() []string { return []string{*current.Load()} }, 10*time.Millisecond)
+
+	current.Store(&newPath)
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, builds.Load(), "switching files does not reload by itself")
+
+	require.NoError(t, os.WriteFile(oldPath, []byte("routes: [{prefix: /old}]"), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, builds.Load(), "the old file is no longer watched")
+
+	require.NoError(t, os.WriteFile(newPath, []byte("routes: [{prefix: /new}]"), 0o600))
+	assert.Eventually(t, func() bool { return builds.Load() == 1 }, time.Second, 10*time.Millisecond)
+}
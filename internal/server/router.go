@@ -1,73 +1,415 @@
 package server
 
 import (
-	"crypto/rsa"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/FPT-OJT/gateway/internal/config"
 	mw "github.com/FPT-OJT/gateway/internal/middleware"
 	"github.com/FPT-OJT/gateway/internal/proxy"
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/FPT-OJT/gateway/pkg/errors"
+	"github.com/FPT-OJT/gateway/pkg/utils"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog"
 )
 
-func NewRouter(cfg *config.Config, rateStore mw.RateLimiterStore, cacheStore mw.CacheStore, pubKey *rsa.PublicKey, log zerolog.Logger) *chi.Mux {
+// Stores bundles the shared state backends used by the router. A nil
+// Revocation store disables token revocation and the admin endpoint; a nil
+// APIKeys store disables API key authentication; a nil Quota store disables
+// quotas and the usage endpoint; a nil Concurrency store disables
+// concurrency limits; a nil DenyList store disables the dynamic denylist and
+// automatic bans.
+//
+// RateLimit is usually a FallbackLimiter. It is created once per process so
+// that its local buckets and outage state survive reloads, and /health
+// reports whether it is degraded.
+type Stores struct {
+	RateLimit   mw.RateLimiterStore
+	Cache       mw.CacheStore
+	Revocation  mw.RevocationStore
+	APIKeys     mw.APIKeyStore
+	Quota       mw.QuotaStore
+	Concurrency mw.ConcurrencyStore
+	DenyList    mw.DenyListStore
+}
+
+func NewRouter(cfg *config.Config, stores Stores, keys mw.KeyProvider, log zerolog.Logger) *chi.Mux {
 	r := chi.NewRouter()
 
-	initMiddleware(r, cfg, rateStore, cacheStore, pubKey, log)
+	initMiddleware(r, cfg, stores, log)
+
+	b := newRouteBuilder(cfg, stores, keys, log)
 
-	r.Get("/health", handleHealth)
-	mountProxy(r, cfg, log)
+	r.Get("/health", handleHealth(stores.RateLimit))
+	mountAdmin(r, b)
+	mountQuota(r, b)
+	mountRoutes(r, b)
 
 	return r
 }
 
-func initMiddleware(r *chi.Mux, cfg *config.Config, rateStore mw.RateLimiterStore, cacheStore mw.CacheStore, pubKey *rsa.PublicKey, log zerolog.Logger) {
+func initMiddleware(r *chi.Mux, cfg *config.Config, stores Stores, log zerolog.Logger) {
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(mw.StripHeaders(ownedHeaders(cfg)))
+	r.Use(mw.ClientIP(utils.NewClientIPResolver(cfg.TrustedProxies, cfg.TrustedProxyHeader)))
 	r.Use(mw.Recovery(log))
 	r.Use(mw.Security)
 	r.Use(mw.TraceLog(log))
+	r.Use(mw.IPAccess(ipRules(cfg.IPRules), log))
+	if stores.DenyList != nil {
+		r.Use(mw.DenyList(stores.DenyList, mw.DenyListConfig{
+			Refresh:      cfg.DenyListRefresh,
+			BanThreshold: cfg.IPBanThreshold,
+			BanWindow:    cfg.IPBanWindow,
+			BanTTL:       cfg.IPBanTTL,
+		}, log))
+	}
+	r.Use(mw.RejectDotSegments)
 	r.Use(middleware.Compress(5))
+}
+
+// mountRoutes mounts one handler per distinct route prefix. Routes sharing a
+// prefix are told apart by host and method at request time.
+func mountRoutes(r *chi.Mux, b *routeBuilder) {
+	if b.keys == nil {
+		b.log.Warn().Msg("router: no key provider configured, JWT verification is DISABLED")
+	}
+
+	var prefixes []string
+	groups := make(map[string][]routeHandler)
+
+	for _, rt := range b.cfg.Routes {
+		if _, ok := groups[rt.Prefix]; !ok {
+			prefixes = append(prefixes, rt.Prefix)
+		}
+		groups[rt.Prefix] = append(groups[rt.Prefix], b.build(rt))
+
+		b.log.Info().
+			Str("route", rt.Name).
+			Str("prefix", rt.Prefix).
+			Str("host", rt.Host).
+			Str("auth", rt.Auth).
+			Str("rate_limit", rt.RateLimit).
+			Strs("quotas", rt.Quotas).
+			Strs("methods", rt.Methods).
+			Strs("upstreams", rt.Upstreams).
+			Msg("router: route mounted")
+	}
+
+	for _, prefix := range prefixes {
+		r.Mount(prefix, dispatch(groups[prefix]))
+	}
+}
+
+type routeHandler struct {
+	route   config.Route
+	handler http.Handler
+}
+
+// routeBuilder holds the state shared by every route's middleware chain.
+type routeBuilder struct {
+	cfg    *config.Config
+	stores Stores
+	keys   mw.KeyProvider
+	log    zerolog.Logger
+
+	// revocation is created once so that all routes share its lookup cache.
+	revocation func(http.Handler) http.Handler
+}
+
+func newRouteBuilder(cfg *config.Config, stores Stores, keys mw.KeyProvider, log zerolog.Logger) *routeBuilder {
+	b := &routeBuilder{cfg: cfg, stores: stores, keys: keys, log: log}
+	if stores.Revocation != nil {
+		b.revocation = mw.Revocation(stores.Revocation, mw.RevocationConfig{
+			CacheTTL:   cfg.RevocationCacheTTL,
+			FailClosed: cfg.RevocationFailClosed,
+		}, log)
+	}
+	return b
+}
+
+// build creates the per-route middleware chain in front of the proxy.
+// Middleware is applied inside-out, so the last wrapper runs first.
+func (b *routeBuilder) build(rt config.Route) routeHandler {
+	targets := make([]*url.URL, 0, len(rt.Upstreams))
+	for _, raw := range rt.Upstreams {
+		// Upstream URLs are validated by config.Load.
+		target, _ := url.Parse(raw)
+		targets = append(targets, target)
+	}
+
+	var h http.Handler = proxy.New(proxy.Config{
+		Prefix:      rt.Prefix,
+		StripPrefix: rt.StripPrefix,
+		Targets:     targets,
+	}, b.log.With().Str("route", rt.Name).Logger())
+
+	// Innermost, so that cache hits do not take a slot.
+	if rt.Concurrency.Enabled() && b.stores.Concurrency != nil {
+		cc := rt.Concurrency
+		h = mw.Concurrency(b.stores.Concurrency, mw.ConcurrencyConfig{
+			Name:         rt.Name,
+			PerKey:       cc.PerKey,
+			Key:          cc.KeyStrategy,
+			Total:        cc.Total,
+			MaxQueue:     cc.Queue,
+			QueueTimeout: cc.QueueTimeout,
+			LeaseTTL:     cc.LeaseTTL,
+		}, b.log)(h)
+	}
+
+	if rt.Cache.Enabled {
+		ttl := b.cfg.CacheTTL
+		if rt.Cache.TTL > 0 {
+			ttl = rt.Cache.TTL
+		}
+		keepStale := b.cfg.CacheKeepStale
+		if rt.Cache.KeepStale > 0 {
+			keepStale = rt.Cache.KeepStale
+		}
+		h = mw.Cache(b.stores.Cache, mw.CacheConfig{
+			Route:                rt.Name,
+			CostHeader:           rt.RateLimitCost.Header,
+			TTL:                  ttl,
+			KeepStale:            keepStale,
+			StaleWhileRevalidate: rt.Cache.StaleWhileRevalidate,
+			StaleIfError:         rt.Cache.StaleIfError,
+			Scope:                mw.CacheScope(rt.Cache.Scope),
+		}, b.log)(h)
+	}
+
+	if len(rt.Quotas) > 0 && b.stores.Quota != nil {
+		h = mw.Quota(b.stores.Quota, b.quotas(rt.Quotas), b.log)(h)
+	}
+
+	if len(rt.Authorize) > 0 {
+		h = mw.Authorize(authzRules(rt.Authorize), b.log)(h)
+	}
+
+	h = b.rateLimit(rt, h)
+
+	h = b.authenticate(mw.AuthMode(rt.Auth), h)
+	h = mw.IPAccess(ipRules(rt.IPRules), b.log)(h)
+
+	return routeHandler{route: rt, handler: h}
+}
+
+// rateLimit wraps h with the route's rate limit policies, weighted by the
+// route's cost. It runs after authentication so that buckets can be keyed on
+// the user or API key.
+func (b *routeBuilder) rateLimit(rt config.Route, h http.Handler) http.Handler {
+	cost := mw.RateLimitCost{
+		Weight:       rt.RateLimitCost.Weight,
+		BytesPerUnit: rt.RateLimitCost.BytesPerUnit,
+		Header:       rt.RateLimitCost.Header,
+	}
+	policy := func(name string) mw.RateLimitConfig {
+		p := b.rateLimitPolicy(name)
+		p.Cost = cost
+		return p
+	}
+
+	rules := make([]mw.RateLimitRule, 0, len(rt.RateLimitRules))
+	for _, rule := range rt.RateLimitRules {
+		rules = append(rules, mw.RateLimitRule{
+			Methods: rule.Methods,
+			Paths:   rule.Paths,
+			Policy:  policy(rule.Policy),
+		})
+	}
+	return mw.RateLimitRules(b.stores.RateLimit, rules, policy(rt.RateLimit), b.log)(h)
+}
+
+// rateLimitPolicy resolves a policy name validated by config.Load; an empty
+// name selects the default policy.
+func (b *routeBuilder) rateLimitPolicy(name string) mw.RateLimitConfig {
+	if name == "" {
+		name = config.DefaultRateLimitPolicy
+	}
+	p := b.cfg.RateLimitPolicies[name]
+	tiers := make(map[string]mw.RateLimitTier, len(p.Tiers))
+	for tier, t := range p.Tiers {
+		tiers[tier] = mw.RateLimitTier{RPS: t.RPS, Burst: t.Burst}
+	}
+	return mw.RateLimitConfig{
+		Policy:         name,
+		RPS:            p.RPS,
+		Burst:          p.Burst,
+		AnonymousRPS:   p.AnonymousRPS,
+		AnonymousBurst: p.AnonymousBurst,
+		Key:            p.KeyStrategy,
+		Tiers:          tiers,
+		FailClosed:     b.cfg.RateLimitFailureMode == ratelimit.FailClosed,
+	}
+}
+
+// quotas resolves quota names validated by config.Load.
+func (b *routeBuilder) quotas(names []string) []mw.QuotaConfig {
+	out := make([]mw.QuotaConfig, 0, len(names))
+	for _, name := range names {
+		q := b.cfg.Quotas[name]
+		out = append(out, mw.QuotaConfig{Name: name, Limit: q.Limit, Window: q.Period, Key: q.KeyStrategy})
+	}
+	return out
+}
+
+// authFailurePolicy names the per-IP limit on failed authentication.
+const authFailurePolicy = "auth"
+
+// authenticate wraps h with API key and token verification and the
+// revocation check. An API key, when present, takes precedence over a token.
+// Failures are limited per client IP with the default policy's anonymous
+// limits; requests that authenticate are not charged.
+func (b *routeBuilder) authenticate(mode mw.AuthMode, h http.Handler) http.Handler {
+	if mode == mw.AuthNone {
+		return b.verify(mode, h)
+	}
+	limit := b.rateLimitPolicy(config.DefaultRateLimitPolicy)
+	limit.Policy = authFailurePolicy
+	return mw.LimitAuthFailures(func(h http.Handler) http.Handler {
+		return b.verify(mode, h)
+	}, b.stores.RateLimit, limit, b.log)(h)
+}
 
-	r.Use(mw.RateLimit(rateStore, mw.RateLimitConfig{
-		RPS:   cfg.RateLimitRPS,
-		Burst: cfg.RateLimitBurst,
-	}, log))
+func (b *routeBuilder) verify(mode mw.AuthMode, h http.Handler) http.Handler {
+	claims := mw.ClaimNames{
+		Roles:  b.cfg.RolesClaim,
+		Scopes: b.cfg.ScopesClaim,
+		Email:  b.cfg.EmailClaim,
+		Tenant: b.cfg.TenantClaim,
+	}
 
-	if pubKey != nil {
-		r.Use(mw.JWTAuth(pubKey, log))
-	} else {
-		log.Warn().Msg("router: no public key provided, JWT verification is DISABLED")
+	if b.keys != nil && mode != mw.AuthNone {
+		if b.revocation != nil {
+			h = b.revocation(h)
+		}
+		h = mw.JWTAuth(b.keys, mw.JWTConfig{
+			Mode:                mode,
+			Issuers:             b.cfg.JWTIssuers,
+			Audiences:           b.cfg.JWTAudiences,
+			Algorithms:          b.cfg.JWTAlgorithms,
+			Leeway:              b.cfg.JWTLeeway,
+			Claims:              claims,
+			ClaimHeaders:        claimHeaders(b.cfg),
+			MaxClaimHeaderBytes: b.cfg.ClaimHeaderMaxBytes,
+		}, b.log)(h)
 	}
 
-	r.Use(mw.Cache(cacheStore, mw.CacheConfig{
-		TTL: cfg.CacheTTL,
-	}, log))
+	// Applied on AuthNone routes too, so that keys are never proxied.
+	if b.stores.APIKeys != nil {
+		h = mw.APIKeyAuth(b.stores.APIKeys, mw.APIKeyConfig{
+			Mode:                mode,
+			Header:              b.cfg.APIKeyHeader,
+			QueryParam:          b.cfg.APIKeyQueryParam,
+			Claims:              claims,
+			ClaimHeaders:        claimHeaders(b.cfg),
+			MaxClaimHeaderBytes: b.cfg.ClaimHeaderMaxBytes,
+		}, b.log)(h)
+	}
+
+	return h
 }
 
-func mountProxy(r *chi.Mux, cfg *config.Config, log zerolog.Logger) {
-	services := []struct {
-		prefix string
-		rawURL string
-	}{
-		{"/api/core", cfg.CoreServiceURL},
-		{"/api/auth", cfg.AuthServiceURL},
-		{"/api/ai", cfg.AiServiceURL},
+func authzRules(rules []config.AuthzRule) []mw.AuthzRule {
+	out := make([]mw.AuthzRule, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, mw.AuthzRule{Methods: r.Methods, Paths: r.Paths, Roles: r.Roles, Scopes: r.Scopes})
 	}
+	return out
+}
 
-	for _, svc := range services {
-		target, _ := url.Parse(svc.rawURL)
-		p := proxy.New(proxy.Config{Prefix: svc.prefix, Target: target}, log)
-		r.Mount(svc.prefix, http.StripPrefix(svc.prefix, p))
+func ipRules(rules []config.IPRule) []mw.IPRule {
+	out := make([]mw.IPRule, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, mw.IPRule{Allow: r.Action == config.IPAllow, Prefixes: r.Prefixes})
 	}
+	return out
 }
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+func claimHeaders(cfg *config.Config) []mw.ClaimHeader {
+	out := make([]mw.ClaimHeader, 0, len(cfg.ClaimHeaders))
+	for _, ch := range cfg.ClaimHeaders {
+		out = append(out, mw.ClaimHeader{Claim: ch.Claim, Header: ch.Header})
+	}
+	return out
+}
+
+// ownedHeaders lists the headers stripped from inbound requests: the
+// configured set plus every header the gateway derives from token claims.
+func ownedHeaders(cfg *config.Config) []string {
+	names := append([]string{"X-User-Id"}, cfg.OwnedHeaders...)
+	for _, ch := range cfg.ClaimHeaders {
+		names = append(names, ch.Header)
+	}
+	return names
+}
+
+// dispatch selects the first route whose host and method match the request.
+func dispatch(routes []routeHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		hostMatched := false
+
+		for _, rh := range routes {
+			if !matchHost(rh.route.Host, r.Host) {
+				continue
+			}
+			hostMatched = true
+			if matchMethod(rh.route.Methods, r.Method) {
+				rh.handler.ServeHTTP(w, r)
+				return
+			}
+			allowed = append(allowed, rh.route.Methods...)
+		}
+
+		if !hostMatched {
+			errors.WriteJSON(w, http.StatusNotFound, errors.ErrNotFound)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		errors.WriteJSON(w, http.StatusMethodNotAllowed, errors.ErrMethodNotAllowed)
+	})
+}
+
+func matchHost(pattern, host string) bool {
+	if pattern == "" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+func matchMethod(methods []string, method string) bool {
+	return len(methods) == 0 || slices.Contains(methods, method)
+}
+
+// handleHealth reports the gateway as up and, when rate limiting can fall
+// back to a failure mode, whether it currently does ("degraded"). A degraded
+// gateway still serves requests, so the status stays 200.
+func handleHealth(limiter mw.RateLimiterStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{"status": "ok"}
+		if f, ok := limiter.(*mw.FallbackLimiter); ok {
+			body["rate_limit"] = "ok"
+			if f.Degraded() {
+				body["rate_limit"] = "degraded"
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(body)
+	}
 }
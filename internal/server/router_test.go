@@ -0,0 +1,528 @@
+package server_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FPT-OJT/gateway/internal/config"
+	mw "github.com/FPT-OJT/gateway/internal/middleware"
+	"github.com/FPT-OJT/gateway/internal/ratelimit"
+	"github.com/FPT-OJT/gateway/internal/server"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memStore is a minimal in-memory implementation of every store interface.
+type memStore struct {
+	*ratelimit.MemoryStore
+	data     map[string][]byte
+	tokens   map[string]bool
+	subjects map[string]time.Time
+	apiKeys  map[string]mw.APIKey
+
+	mu     sync.Mutex
+	denied map[netip.Prefix]time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		MemoryStore: ratelimit.NewMemoryStore(),
+		data:        make(map[string][]byte),
+		tokens:      make(map[string]bool),
+		subjects:    make(map[string]time.Time),
+		denied:      make(map[netip.Prefix]time.Time),
+		apiKeys: map[string]mw.APIKey{
+			mw.HashAPIKey("worker-key"): {Owner: "judge-worker-1", Scopes: []string{"submissions:write"}},
+		},
+	}
+}
+
+func (m *memStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	v, ok := m.data[key]
+	return v, ok, nil
+}
+
+func (m *memStore) Set(_ context.Context, key string, value []byte, _ time.Duration) error {
+	m.data[key] = value
+	return nil
+}
+
+func (m *memStore) RevokeToken(_ context.Context, jti string, _ time.Duration) error {
+	m.tokens[jti] = true
+	return nil
+}
+
+func (m *memStore) TokenRevoked(_ context.Context, jti string) (bool, error) {
+	return m.tokens[jti], nil
+}
+
+func (m *memStore) RevokeSubject(_ context.Context, sub string, before time.Time, _ time.Duration) error {
+	m.subjects[sub] = before
+	return nil
+}
+
+func (m *memStore) SubjectRevokedBefore(_ context.Context, sub string) (time.Time, bool, error) {
+	before, ok := m.subjects[sub]
+	return before, ok, nil
+}
+
+func (m *memStore) LookupAPIKey(_ context.Context, hash string) (mw.APIKey, bool, error) {
+	k, ok := m.apiKeys[hash]
+	return k, ok, nil
+}
+
+func (m *memStore) DenyList(context.Context) (map[netip.Prefix]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.denied), nil
+}
+
+func (m *memStore) Deny(_ context.Context, prefix netip.Prefix, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.denied[prefix] = until
+	return nil
+}
+
+func (m *memStore) Undeny(_ context.Context, prefix netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.denied, prefix)
+	return nil
+}
+
+func (m *memStore) Strike(context.Context, string, time.Duration) (int64, error) {
+	return 1, nil
+}
+
+type testGateway struct {
+	handler http.Handler
+	key     *rsa.PrivateKey
+}
+
+// newTestGateway builds a router for routes whose upstreams are all set to a
+// test server that echoes the request path and, in the body, the user.
+func newTestGateway(t *testing.T, routes []config.Route, opts ...func(*config.Config)) *testGateway {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+		w.Header().Set("X-Upstream-User", r.Header.Get("X-User-Id"))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(r.Header.Get("X-User-Id")))
+	}))
+	t.Cleanup(upstream.Close)
+
+	for i := range routes {
+		routes[i].Upstreams = []string{upstream.URL}
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		RateLimitPolicies: map[string]config.RateLimitPolicy{
+			config.DefaultRateLimitPolicy: {RPS: 1000, Burst: 1000, AnonymousRPS: 1000, AnonymousBurst: 1000},
+			"login":                       {RPS: 1, AnonymousRPS: 1},
+		},
+		Quotas: map[string]config.Quota{
+			"ai-daily": {Limit: 2, Period: ratelimit.Day, KeyStrategy: ratelimit.Key{{Source: ratelimit.SourceUser}}},
+		},
+		DenyListRefresh: time.Millisecond,
+		CacheTTL:        time.Minute,
+		JWTAlgorithms:   []string{"RS256"},
+		RolesClaim:      "roles",
+		RevocationTTL:   time.Hour,
+		AdminRole:       "admin",
+		APIKeyHeader:    "X-API-Key",
+		Routes:          routes,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	store := newMemStore()
+	stores := server.Stores{RateLimit: store, Cache: store, Revocation: store, APIKeys: store, Quota: store, DenyList: store}
+
+	return &testGateway{
+		handler: server.NewRouter(cfg, stores, mw.StaticKey(&key.PublicKey), zerolog.Nop()),
+		key:     key,
+	}
+}
+
+func (g *testGateway) token(t *testing.T, sub string) string {
+	t.Helper()
+	return g.tokenWith(t, jwt.MapClaims{"sub": sub})
+}
+
+// tokenWith signs claims, adding an "exp" one hour ahead.
+func (g *testGateway) tokenWith(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(g.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func (g *testGateway) do(method, path, token string) *httptest.ResponseRecorder {
+	return g.doBody(method, path, token, "")
+}
+
+func (g *testGateway) doBody(method, path, token, body string) *httptest.ResponseRecorder {
+	return g.doFrom("192.0.2.1", method, path, token, body)
+}
+
+func (g *testGateway) doFrom(ip, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = ip + ":1234"
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	g.handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRouter_PerRouteAuthModes(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{Name: "core", Prefix: "/api/core", StripPrefix: true, Auth: config.AuthRequired},
+		{Name: "core-public", Prefix: "/api/core/public", StripPrefix: true, Auth: config.AuthNone},
+		{Name: "auth", Prefix: "/api/auth", StripPrefix: true, Auth: config.AuthOptional},
+	})
+
+	assert.Equal(t, http.StatusUnauthorized, g.do(http.MethodGet, "/api/core/problems", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, g.do(http.MethodGet, "/api/core/publications", "").Code,
+		"a path merely containing 'public' must not bypass authentication")
+	assert.Equal(t, http.StatusOK, g.do(http.MethodGet, "/api/core/problems", g.token(t, "u1")).Code)
+
+	rr := g.do(http.MethodGet, "/api/core/public/problems", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "/problems", rr.Header().Get("X-Upstream-Path"))
+
+	for _, target := range []string{"/api/core/public/../secret", "/api/core/public/%2e%2e/secret"} {
+		assert.Equal(t, http.StatusBadRequest, g.do(http.MethodGet, target, "").Code,
+			"%s must not reach the protected route through the public one", target)
+	}
+
+	assert.Equal(t, http.StatusOK, g.do(http.MethodGet, "/api/auth/login", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, g.do(http.MethodGet, "/api/auth/me", "garbage").Code)
+}
+
+func TestRouter_HostAndMethodDispatch(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{Name: "judge-read", Prefix: "/api/judge", Methods: []string{http.MethodGet}, StripPrefix: true, Auth: config.AuthNone},
+		{Name: "judge-admin", Prefix: "/api/judge", Host: "admin.example.com", StripPrefix: false, Auth: config.AuthNone},
+	})
+
+	rr := g.do(http.MethodGet, "/api/judge/queue", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "/queue", rr.Header().Get("X-Upstream-Path"))
+
+	rr = g.do(http.MethodPost, "/api/judge/queue", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET", rr.Header().Get("Allow"))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/judge/queue", nil)
+	req.Host = "admin.example.com:8080"
+	rr = httptest.NewRecorder()
+	g.handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "/api/judge/queue", rr.Header().Get("X-Upstream-Path"))
+}
+
+func TestRouter_AdminRevocation(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{Name: "core", Prefix: "/api/core", StripPrefix: true, Auth: config.AuthRequired},
+	})
+
+	issued := time.Now().Add(-10 * time.Second).Unix()
+	admin := g.tokenWith(t, jwt.MapClaims{"sub": "root", "roles": []string{"admin"}})
+	user := g.tokenWith(t, jwt.MapClaims{"sub": "u1", "jti": "t1", "iat": issued})
+	other := g.tokenWith(t, jwt.MapClaims{"sub": "u1", "jti": "t2", "iat": issued})
+	banned := g.tokenWith(t, jwt.MapClaims{"sub": "u2", "jti": "t3", "iat": issued})
+
+	assert.Equal(t, http.StatusOK, g.do(http.MethodGet, "/api/core/problems", user).Code)
+
+	assert.Equal(t, http.StatusUnauthorized, g.doBody(http.MethodPost, "/admin/revocations", "", `{"jti":"t1"}`).Code)
+	assert.Equal(t, http.StatusForbidden, g.doBody(http.MethodPost, "/admin/revocations", user, `{"jti":"t1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, g.doBody(http.MethodPost, "/admin/revocations", admin, `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, g.doBody(http.MethodPost, "/admin/revocations", admin, `{"jti":"t1","subject":"u1"}`).Code)
+
+	assert.Equal(t, http.StatusNoContent, g.doBody(http.MethodPost, "/admin/revocations", admin, `{"jti":"t1"}`).Code)
+	rr := g.do(http.MethodGet, "/api/core/problems", user)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"token_revoked"`)
+	assert.Equal(t, http.StatusOK, g.do(http.MethodGet, "/api/core/problems", other).Code,
+		"revoking one jti leaves the subject's other tokens valid")
+
+	assert.Equal(t, http.StatusNoContent, g.doBody(http.MethodPost, "/admin/revocations", admin, `{"subject":"u2"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, g.do(http.MethodGet, "/api/core/problems", banned).Code)
+
+	reissued := g.tokenWith(t, jwt.MapClaims{"sub": "u2", "iat": time.Now().Add(2 * time.Second).Unix()})
+	assert.Equal(t, http.StatusOK, g.do(http.MethodGet, "/api/core/problems", reissued).Code,
+		"tokens issued after the subject marker are accepted")
+}
+
+func TestRouter_APIKeyAuth(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{Name: "judge", Prefix: "/api/judge", StripPrefix: true, Auth: config.AuthRequired},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/judge/results", nil)
+	req.Header.Set("X-API-Key", "worker-key")
+	rr := httptest.NewRecorder()
+	g.handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "judge-worker-1", rr.Header().Get("X-Upstream-User"))
+
+	req = httptest.NewRequest(http.MethodPost, "/api/judge/results", nil)
+	req.Header.Set("X-API-Key", "stolen-key")
+	rr = httptest.NewRecorder()
+	g.handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	assert.Equal(t, http.StatusOK, g.do(http.MethodPost, "/api/judge/results", g.token(t, "u1")).Code,
+		"JWTs keep working alongside API keys")
+}
+
+func TestRouter_RateLimitPolicies(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{
+			Name: "auth", Prefix: "/api/auth", StripPrefix: true, Auth: config.AuthOptional,
+			RateLimitRules: []config.RateLimitRule{
+				{Methods: []string{http.MethodPost}, Paths: []string{"/api/auth/login"}, Policy: "login"},
+			},
+		},
+	})
+
+	assert.Equal(t, http.StatusOK, g.do(http.MethodPost, "/api/auth/login", "").Code)
+	rr := g.do(http.MethodPost, "/api/auth/login", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"policy":"login"`)
+
+	assert.Equal(t, http.StatusOK, g.do(http.MethodGet, "/api/auth/me", "").Code,
+		"other endpoints of the route keep the default policy")
+	assert.Equal(t, http.StatusOK, g.do(http.MethodPost, "/api/auth/register", "").Code)
+}
+
+func TestRouter_RateLimitsFailedAuthentication(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{Name: "core", Prefix: "/api/core", StripPrefix: true, Auth: config.AuthRequired},
+	}, func(cfg *config.Config) {
+		cfg.RateLimitPolicies[config.DefaultRateLimitPolicy] = config.RateLimitPolicy{
+			RPS: 1000, Burst: 1000, AnonymousRPS: 1, AnonymousBurst: 4,
+		}
+	})
+
+	codes := make(map[int]int)
+	for range 20 {
+		codes[g.do(http.MethodGet, "/api/core/problems", "garbage").Code]++
+	}
+	assert.Equal(t, 5, codes[http.StatusUnauthorized])
+	assert.Equal(t, 15, codes[http.StatusTooManyRequests], "invalid tokens are counted per IP")
+
+	rr := g.do(http.MethodGet, "/api/core/problems", "garbage")
+	assert.Contains(t, rr.Body.String(), `"policy":"auth"`)
+	assert.Empty(t, rr.Header().Get("WWW-Authenticate"))
+
+	for range 20 {
+		assert.Equal(t, http.StatusOK, g.do(http.MethodGet, "/api/core/problems", g.token(t, "u1")).Code,
+			"clients sharing the address that authenticate are not charged")
+	}
+	assert.Equal(t, http.StatusOK, g.do(http.MethodGet, "/health", "").Code, "liveness probes are never limited")
+	assert.Equal(t, http.StatusNotFound, g.do(http.MethodGet, "/unknown", "").Code)
+}
+
+func TestRouter_Quotas(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{Name: "ai", Prefix: "/api/ai", StripPrefix: true, Auth: config.AuthRequired, Quotas: []string{"ai-daily"}},
+	}, func(cfg *config.Config) {
+		cfg.Quotas["unused"] = config.Quota{Limit: 10, Period: ratelimit.Day}
+	})
+	alice := g.token(t, "alice")
+
+	rr := g.do(http.MethodPost, "/api/ai/hint", alice)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ai-daily", rr.Header().Get("X-Quota-Name"))
+	assert.Equal(t, "1", rr.Header().Get("X-Quota-Remaining"))
+
+	assert.Equal(t, http.StatusOK, g.do(http.MethodPost, "/api/ai/hint", alice).Code)
+	rr = g.do(http.MethodPost, "/api/ai/hint", alice)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"quota_exceeded"`)
+
+	assert.Equal(t, http.StatusOK, g.do(http.MethodPost, "/api/ai/hint", g.token(t, "bob")).Code)
+
+	rr = g.do(http.MethodGet, "/quota", alice)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var body struct {
+		Quotas []struct {
+			Name      string    `json:"name"`
+			Window    string    `json:"window"`
+			Limit     int64     `json:"limit"`
+			Used      int64     `json:"used"`
+			Remaining int64     `json:"remaining"`
+			ResetAt   time.Time `json:"reset_at"`
+		} `json:"quotas"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	require.Len(t, body.Quotas, 1)
+	q := body.Quotas[0]
+	assert.Equal(t, "ai-daily", q.Name)
+	assert.Equal(t, "day", q.Window)
+	assert.Equal(t, int64(2), q.Used)
+	assert.Equal(t, int64(0), q.Remaining)
+	_, reset := ratelimit.Day.Bounds(time.Now())
+	assert.True(t, reset.Equal(q.ResetAt))
+
+	rr = g.do(http.MethodGet, "/quota", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Empty(t, body.Quotas, "anonymous callers cannot reach the ai route")
+
+	rr = g.do(http.MethodGet, "/quota", alice)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Len(t, body.Quotas, 1, "quotas of no route are not listed")
+}
+
+func TestRouter_IPRules(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{Name: "core", Prefix: "/api/core", StripPrefix: true, Auth: config.AuthNone},
+		{
+			Name: "internal", Prefix: "/api/internal", StripPrefix: true, Auth: config.AuthNone,
+			IPRules: []config.IPRule{
+				{Action: config.IPAllow, Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+				{Action: config.IPDeny, Prefixes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}},
+			},
+		},
+	})
+
+	assert.Equal(t, http.StatusOK, g.doFrom("10.1.1.1", http.MethodGet, "/api/internal/x", "", "").Code)
+	rr := g.doFrom("192.0.2.1", http.MethodGet, "/api/internal/x", "", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"ip_denied"`)
+	assert.Equal(t, http.StatusOK, g.doFrom("192.0.2.1", http.MethodGet, "/api/core/x", "", "").Code)
+}
+
+func TestRouter_AdminDenyList(t *testing.T) {
+	g := newTestGateway(t, []config.Route{
+		{Name: "core", Prefix: "/api/core", StripPrefix: true, Auth: config.AuthNone},
+	})
+	admin := g.tokenWith(t, jwt.MapClaims{"sub": "root", "roles": []string{"admin"}})
+
+	assert.Equal(t, http.StatusOK, g.doFrom("198.51.100.7", http.MethodGet, "/api/core/x", "", "").Code)
+
+	assert.Equal(t, http.StatusForbidden, g.doBody(http.MethodPost, "/admin/denylist", g.token(t, "u1"), `{"cidr":"198.51.100.0/24"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, g.doBody(http.MethodPost, "/admin/denylist", admin, `{"cidr":"198.51.100.0/33"}`).Code)
+	assert.Equal(t, http.StatusNoContent, g.doBody(http.MethodPost, "/admin/denylist", admin, `{"cidr":"198.51.100.0/24","ttl":600}`).Code)
+
+	assert.Eventually(t, func() bool {
+		return g.doFrom("198.51.100.7", http.MethodGet, "/api/core/x", "", "").Code == http.StatusForbidden
+	}, time.Second, 10*time.Millisecond)
+
+	rr := g.do(http.MethodGet, "/admin/denylist", admin)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"cidr":"198.51.100.0/24"`)
+	assert.Contains(t, rr.Body.String(), `"expires_at"`)
+
+	assert.Equal(t, http.StatusNoContent, g.do(http.MethodDelete, "/admin/denylist?cidr=198.51.100.0/24", admin).Code)
+	assert.Eventually(t, func() bool {
+		return g.doFrom("198.51.100.7", http.MethodGet, "/api/core/x", "", "").Code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRouter_CacheNeverLeaksAcrossUsers(t *testing.T) {
+	gw := newTestGateway(t, []config.Route{
+		{Name: "core", Prefix: "/api/core", StripPrefix: true, Auth: config.AuthOptional, Cache: config.RouteCache{Enabled: true, Scope: config.CacheScopePublic}},
+		{Name: "me", Prefix: "/api/me", StripPrefix: true, Auth: config.AuthRequired, Cache: config.RouteCache{Enabled: true, Scope: config.CacheScopeUser}},
+	})
+	alice, bob := gw.token(t, "alice"), gw.token(t, "bob")
+
+	for _, path := range []string{"/api/core/profile", "/api/me"} {
+		t.Run(path, func(t *testing.T) {
+			for range 2 {
+				rr := gw.do(http.MethodGet, path, alice)
+				assert.Equal(t, "alice", rr.Body.String())
+
+				rr = gw.do(http.MethodGet, path, bob)
+				assert.Equal(t, "bob", rr.Body.String())
+			}
+		})
+	}
+
+	assert.Equal(t, "HIT", gw.do(http.MethodGet, "/api/me", bob).Header().Get("X-Cache"))
+	assert.Equal(t, "BYPASS", gw.do(http.MethodGet, "/api/core/profile", bob).Header().Get("X-Cache"))
+}
+
+func TestRouter_CacheNeverLeaksAcrossHosts(t *testing.T) {
+	gw := newTestGateway(t, []config.Route{
+		{Name: "a", Prefix: "/api", Host: "a.test", StripPrefix: true, Auth: config.AuthNone, Cache: config.RouteCache{Enabled: true}},
+		{Name: "b", Prefix: "/api", Host: "b.test", Auth: config.AuthNone, Cache: config.RouteCache{Enabled: true}},
+	})
+	get := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+		req.Host = host
+		rr := httptest.NewRecorder()
+		gw.handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, "/x", get("a.test").Header().Get("X-Upstream-Path"))
+	rr := get("b.test")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Cache"))
+	assert.Equal(t, "/api/x", rr.Header().Get("X-Upstream-Path"))
+
+	assert.Equal(t, "/x", get("a.test").Header().Get("X-Upstream-Path"))
+	assert.Equal(t, "HIT", get("b.test").Header().Get("X-Cache"))
+}
+
+// downStore is a rate limit store that is always unreachable.
+type downStore struct{}
+
+func (downStore) AllowN(context.Context, string, ratelimit.Limit, int) (ratelimit.Result, error) {
+	return ratelimit.Result{}, context.DeadlineExceeded
+}
+
+func (downStore) DebitN(context.Context, string, ratelimit.Limit, int) error {
+	return context.DeadlineExceeded
+}
+
+func TestRouter_HealthReportsDegradedRateLimiting(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(upstream.Close)
+
+	cfg := &config.Config{
+		RateLimitPolicies: map[string]config.RateLimitPolicy{
+			config.DefaultRateLimitPolicy: {RPS: 100, Burst: 100},
+		},
+		Routes: []config.Route{{Name: "core", Prefix: "/api/core", Upstreams: []string{upstream.URL}}},
+	}
+	health := func(store mw.RateLimiterStore) map[string]string {
+		limiter := mw.NewFallbackLimiter(store, mw.FallbackConfig{Mode: ratelimit.FailOpen}, zerolog.Nop())
+		handler := server.NewRouter(cfg, server.Stores{RateLimit: limiter}, nil, zerolog.Nop())
+
+		// The limiter learns the store's state from rate limited traffic.
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/core/problems", nil))
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var body map[string]string
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		return body
+	}
+
+	assert.Equal(t, map[string]string{"status": "ok", "rate_limit": "ok"}, health(newMemStore()))
+	assert.Equal(t, map[string]string{"status": "ok", "rate_limit": "degraded"}, health(downStore{}))
+}
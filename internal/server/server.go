@@ -20,8 +20,9 @@ const (
 )
 
 type Server struct {
-	http *http.Server
-	log  zerolog.Logger
+	http   *http.Server
+	log    zerolog.Logger
+	reload func() error
 }
 
 func New(addr string, handler http.Handler, log zerolog.Logger) *Server {
@@ -37,10 +38,21 @@ func New(addr string, handler http.Handler, log zerolog.Logger) *Server {
 	}
 }
 
+// OnReload registers fn to be called whenever the process receives SIGHUP.
+func (s *Server) OnReload(fn func() error) {
+	s.reload = fn
+}
+
 func (s *Server) Run() error {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
+	hup := make(chan os.Signal, 1)
+	if s.reload != nil {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
 	errCh := make(chan error, 1)
 
 	go func() {
@@ -50,11 +62,18 @@ func (s *Server) Run() error {
 		}
 	}()
 
-	select {
-	case err := <-errCh:
-		return err
-	case sig := <-quit:
-		s.log.Info().Str("signal", sig.String()).Msg("shutdown signal received")
+wait:
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case <-hup:
+			s.log.Info().Msg("SIGHUP received, reloading configuration")
+			_ = s.reload()
+		case sig := <-quit:
+			s.log.Info().Str("signal", sig.String()).Msg("shutdown signal received")
+			break wait
+		}
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
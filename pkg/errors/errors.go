@@ -12,10 +12,27 @@ type ErrorResponse struct {
 }
 
 var (
-	ErrNotFound     = ErrorResponse{Code: "not_found", Message: "The requested resource was not found"}
-	ErrUnauthorized = ErrorResponse{Code: "unauthorized", Message: "Authentication is required"}
-	ErrBadGateway   = ErrorResponse{Code: "bad_gateway", Message: "Upstream service is unavailable"}
-	ErrInternal     = ErrorResponse{Code: "internal_error", Message: "An unexpected error occurred"}
+	ErrNotFound          = ErrorResponse{Code: "not_found", Message: "The requested resource was not found"}
+	ErrUnauthorized      = ErrorResponse{Code: "unauthorized", Message: "Authentication is required"}
+	ErrBadGateway        = ErrorResponse{Code: "bad_gateway", Message: "Upstream service is unavailable"}
+	ErrInternal          = ErrorResponse{Code: "internal_error", Message: "An unexpected error occurred"}
+	ErrTokenExpired      = ErrorResponse{Code: "token_expired", Message: "The access token has expired"}
+	ErrInvalidAudience   = ErrorResponse{Code: "invalid_audience", Message: "The access token is not intended for this service"}
+	ErrInvalidIssuer     = ErrorResponse{Code: "invalid_issuer", Message: "The access token was issued by an untrusted issuer"}
+	ErrInvalidSignature  = ErrorResponse{Code: "invalid_signature", Message: "The access token signature could not be verified"}
+	ErrInvalidToken      = ErrorResponse{Code: "invalid_token", Message: "The access token is invalid"}
+	ErrUnverifiableToken = ErrorResponse{Code: "unverifiable_token", Message: "The access token could not be verified, its key is unavailable"}
+	ErrInvalidAPIKey     = ErrorResponse{Code: "invalid_api_key", Message: "The API key is invalid"}
+	ErrTokenRevoked      = ErrorResponse{Code: "token_revoked", Message: "The access token has been revoked"}
+	ErrBadRequest        = ErrorResponse{Code: "bad_request", Message: "The request is invalid"}
+	ErrUnavailable       = ErrorResponse{Code: "service_unavailable", Message: "The service is temporarily unavailable"}
+	ErrForbidden         = ErrorResponse{Code: "forbidden", Message: "You do not have permission to access this resource"}
+	ErrIPDenied          = ErrorResponse{Code: "ip_denied", Message: "Access from this address is not allowed"}
+	ErrRateLimited       = ErrorResponse{Code: "rate_limited", Message: "Too many requests"}
+	ErrQuotaExceeded     = ErrorResponse{Code: "quota_exceeded", Message: "The usage quota for this period has been exhausted"}
+	ErrTooManyInFlight   = ErrorResponse{Code: "too_many_in_flight", Message: "Too many requests are already in progress"}
+	ErrNotCached         = ErrorResponse{Code: "not_cached", Message: "The response is not available from the cache"}
+	ErrMethodNotAllowed  = ErrorResponse{Code: "method_not_allowed", Message: "The request method is not allowed for this route"}
 )
 
 func WriteJSON(w http.ResponseWriter, status int, resp ErrorResponse) {
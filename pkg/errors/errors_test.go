@@ -71,6 +71,23 @@ func TestPredefinedErrors_HaveNonEmptyMessages(t *testing.T) {
 		errors.ErrUnauthorized,
 		errors.ErrBadGateway,
 		errors.ErrInternal,
+		errors.ErrTokenExpired,
+		errors.ErrInvalidAudience,
+		errors.ErrInvalidIssuer,
+		errors.ErrInvalidSignature,
+		errors.ErrInvalidToken,
+		errors.ErrUnverifiableToken,
+		errors.ErrTokenRevoked,
+		errors.ErrInvalidAPIKey,
+		errors.ErrForbidden,
+		errors.ErrBadRequest,
+		errors.ErrUnavailable,
+		errors.ErrIPDenied,
+		errors.ErrRateLimited,
+		errors.ErrQuotaExceeded,
+		errors.ErrTooManyInFlight,
+		errors.ErrNotCached,
+		errors.ErrMethodNotAllowed,
 	} {
 		assert.NotEmpty(t, e.Message, "error %q should have a message", e.Code)
 	}
@@ -0,0 +1,21 @@
+package utils
+
+// SplitQuoted splits a header value s at sep outside of double-quoted
+// strings, honouring backslash escapes inside them, as in Cache-Control and
+// Forwarded. Parts are not trimmed.
+func SplitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
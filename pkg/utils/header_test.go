@@ -0,0 +1,15 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/FPT-OJT/gateway/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	assert.Equal(t, []string{"a", " b", ""}, utils.SplitQuoted("a, b,", ','))
+	assert.Equal(t, []string{`for="[::1]:80";host="a,b"`, " for=x"}, utils.SplitQuoted(`for="[::1]:80";host="a,b", for=x`, ','))
+	assert.Equal(t, []string{`a="x\",y"`, "b"}, utils.SplitQuoted(`a="x\",y",b`, ','))
+	assert.Equal(t, []string{""}, utils.SplitQuoted("", ','))
+}
@@ -1,20 +1,157 @@
 package utils
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 )
 
+type clientIPKey struct{}
+
+// WithClientIP returns a copy of ctx carrying the resolved client IP, which
+// ClientIp then returns for requests using that context.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIp returns the client IP resolved by a ClientIPResolver earlier in
+// the chain, or else the address of the peer that opened the connection.
+// Headers are never trusted here.
 func ClientIp(r *http.Request) string {
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok && ip != "" {
 		return ip
 	}
-	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
-		return strings.SplitN(fwd, ",", 2)[0]
+	if addr, ok := peerAddr(r); ok {
+		return addr.String()
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+// Client IP headers understood by ClientIPResolver.
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+// ClientIPResolver determines the client address of requests that reach the
+// gateway through trusted reverse proxies.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// NewClientIPResolver returns a resolver that believes forwarding headers
+// only when they were appended by a peer within trusted. header selects the
+// chain consulted: HeaderXForwardedFor (the default) or HeaderForwarded
+// (RFC 7239). Only the header the proxies actually maintain may be used;
+// the other one passes through them unchecked and is client-controlled.
+func NewClientIPResolver(trusted []netip.Prefix, header string) *ClientIPResolver {
+	if !strings.EqualFold(header, HeaderForwarded) {
+		header = HeaderXForwardedFor
+	} else {
+		header = HeaderForwarded
+	}
+	return &ClientIPResolver{trusted: trusted, header: header}
+}
+
+// Resolve returns the client IP of r. Starting from the connection's peer,
+// it walks the forwarding chain from the right for as long as the hop it
+// is at is a trusted proxy, and returns the first address that is not. An
+// unparseable or obfuscated entry stops the walk at the proxy that added
+// it; a chain made only of trusted proxies yields its leftmost address.
+func (c *ClientIPResolver) Resolve(r *http.Request) string {
+	addr, ok := peerAddr(r)
+	if !ok {
+		return remoteHost(r.RemoteAddr)
+	}
+	if !c.trusts(addr) {
+		return addr.String()
+	}
+
+	var chain []string
+	if c.header == HeaderForwarded {
+		chain = forwardedFor(r.Header.Values(HeaderForwarded))
+	} else {
+		chain = forwardedList(r.Header.Values(HeaderXForwardedFor))
+	}
+	for _, hop := range slices.Backward(chain) {
+		next, ok := parseHop(hop)
+		if !ok {
+			break
+		}
+		addr = next
+		if !c.trusts(addr) {
+			break
+		}
 	}
-	addr := r.RemoteAddr
-	if i := strings.LastIndex(addr, ":"); i != -1 {
-		return addr[:i]
+	return addr.String()
+}
+
+func (c *ClientIPResolver) trusts(addr netip.Addr) bool {
+	return slices.ContainsFunc(c.trusted, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// peerAddr parses the host of r.RemoteAddr.
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	return parseHop(remoteHost(r.RemoteAddr))
+}
+
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
 	}
 	return addr
 }
+
+// parseHop parses one forwarding entry: a bare IP, or an IP with a port
+// ("192.0.2.1:443", "[2001:db8::1]:443"). IPv4-mapped IPv6 addresses are
+// unmapped and zones dropped, so that the result compares like the
+// configured prefixes.
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap().WithZone(""), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap().WithZone(""), true
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return addr.Unmap().WithZone(""), true
+	}
+	return netip.Addr{}, false
+}
+
+// forwardedList splits X-Forwarded-For values into hops, in order.
+func forwardedList(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for hop := range strings.SplitSeq(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// forwardedFor extracts the "for" parameters of RFC 7239 Forwarded values,
+// one per forwarded element and in order. Elements without one yield an
+// empty hop, which stops the walk.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range SplitQuoted(v, ',') {
+			var hop string
+			for _, pair := range SplitQuoted(elem, ';') {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(strings.TrimSpace(name), "for") {
+					hop = strings.Trim(strings.TrimSpace(value), `"`)
+					break
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
@@ -1,56 +1,120 @@
 package utils_test
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 
 	"github.com/FPT-OJT/gateway/pkg/utils"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestClientIp_XRealIP_TakesPriority(t *testing.T) {
+var trustedProxies = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("2001:db8:ffff::/48"),
+}
+
+func TestClientIp_IgnoresHeaders(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.Header.Set("X-Real-IP", "203.0.113.1")
 	req.Header.Set("X-Forwarded-For", "10.0.0.1")
 	req.RemoteAddr = "192.168.1.1:9000"
 
-	assert.Equal(t, "203.0.113.1", utils.ClientIp(req))
+	assert.Equal(t, "192.168.1.1", utils.ClientIp(req))
 }
 
-func TestClientIp_XForwardedFor_Single(t *testing.T) {
+func TestClientIp_RemoteAddr_WithPort_StripsPort(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	req.Header.Set("X-Forwarded-For", "198.51.100.5")
+	req.RemoteAddr = "192.0.2.10:50123"
 
-	assert.Equal(t, "198.51.100.5", utils.ClientIp(req))
+	assert.Equal(t, "192.0.2.10", utils.ClientIp(req))
 }
 
-func TestClientIp_XForwardedFor_MultipleIPs_ReturnsFirst(t *testing.T) {
+func TestClientIp_RemoteAddr_NoPort(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	req.Header.Set("X-Forwarded-For", "10.0.0.1, 172.16.0.1, 192.168.1.1")
+	req.RemoteAddr = "192.0.2.99"
 
-	assert.Equal(t, "10.0.0.1", utils.ClientIp(req))
+	assert.Equal(t, "192.0.2.99", utils.ClientIp(req))
 }
 
-func TestClientIp_RemoteAddr_WithPort_StripsPort(t *testing.T) {
+func TestClientIp_RemoteAddr_IPv6(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	req.RemoteAddr = "192.0.2.10:50123"
+	req.RemoteAddr = "[2001:db8::1]:8080"
 
-	assert.Equal(t, "192.0.2.10", utils.ClientIp(req))
+	assert.Equal(t, "2001:db8::1", utils.ClientIp(req))
 }
 
-func TestClientIp_RemoteAddr_NoPort(t *testing.T) {
+func TestClientIp_PrefersResolvedIP(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	req.RemoteAddr = "192.0.2.99"
+	req.RemoteAddr = "10.0.0.1:8080"
+	req = req.WithContext(utils.WithClientIP(context.Background(), "198.51.100.5"))
 
-	assert.Equal(t, "192.0.2.99", utils.ClientIp(req))
+	assert.Equal(t, "198.51.100.5", utils.ClientIp(req))
 }
 
-func TestClientIp_NoHeaders_FallsBackToRemoteAddr(t *testing.T) {
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	req.Header.Del("X-Real-IP")
-	req.Header.Del("X-Forwarded-For")
-	req.RemoteAddr = "1.2.3.4:8080"
+func TestClientIPResolver_XForwardedFor(t *testing.T) {
+	resolver := utils.NewClientIPResolver(trustedProxies, utils.HeaderXForwardedFor)
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"untrusted peer ignores header", "192.0.2.1:1234", []string{"198.51.100.5"}, "192.0.2.1"},
+		{"trusted peer, single hop", "10.0.0.1:1234", []string{"198.51.100.5"}, "198.51.100.5"},
+		{"forged entries left of the client", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.5"}, "198.51.100.5"},
+		{"trusted hops are skipped", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.5, 10.0.0.7"}, "198.51.100.5"},
+		{"repeated headers form one chain", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.5", "10.0.0.7"}, "198.51.100.5"},
+		{"only trusted hops", "10.0.0.1:1234", []string{"10.0.0.9, 10.0.0.7"}, "10.0.0.9"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"garbage stops at the proxy that added it", "10.0.0.1:1234", []string{"198.51.100.5, unknown"}, "10.0.0.1"},
+		{"hop with port", "10.0.0.1:1234", []string{"198.51.100.5:5555"}, "198.51.100.5"},
+		{"IPv6 hops", "[2001:db8:ffff::1]:443", []string{"2001:db8::42, 2001:db8:ffff::2"}, "2001:db8::42"},
+		{"IPv4-mapped peer", "[::ffff:10.0.0.1]:1234", []string{"198.51.100.5"}, "198.51.100.5"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			req.Header.Set("Forwarded", "for=203.0.113.9")
+
+			assert.Equal(t, tc.want, resolver.Resolve(req))
+		})
+	}
+}
+
+func TestClientIPResolver_Forwarded(t *testing.T) {
+	resolver := utils.NewClientIPResolver(trustedProxies, utils.HeaderForwarded)
+
+	tests := []struct {
+		name      string
+		forwarded string
+		want      string
+	}{
+		{"single element", "for=198.51.100.5;proto=https", "198.51.100.5"},
+		{"case-insensitive parameter", "For=198.51.100.5", "198.51.100.5"},
+		{"trusted hops are skipped", "for=1.1.1.1, for=198.51.100.5;by=10.0.0.7, for=10.0.0.7", "198.51.100.5"},
+		{"quoted IPv6 with port", `for="[2001:db8::42]:4711"`, "2001:db8::42"},
+		{"quoted separators", `for=198.51.100.5;host="a,b;c"`, "198.51.100.5"},
+		{"obfuscated identifier", "for=198.51.100.5, for=_hidden", "10.0.0.1"},
+		{"element without for", "for=198.51.100.5, proto=https", "10.0.0.1"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("Forwarded", tc.forwarded)
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
 
-	assert.Equal(t, "1.2.3.4", utils.ClientIp(req))
+			assert.Equal(t, tc.want, resolver.Resolve(req))
+		})
+	}
 }